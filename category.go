@@ -1,32 +1,244 @@
 package logs
 
 import (
+	"context"
 	"fmt"
 	"runtime"
 	"strings"
 	"time"
 )
 
-// LOGGER get the log Filter by category
+// GetLogger returns the logger for category.  Categories form a dotted
+// hierarchy ala log4j: a category without a filter of its own, such as
+// "app.db.query", logs with the level of its nearest configured ancestor
+// ("app.db", then "app") and writes to the writers of that ancestor.  Records
+// then propagate to every further ancestor and finally to the root filter
+// ("stdout", or "default" if there is no console filter), until a filter whose
+// additivity is off is reached.  Each filter on the way only writes records at
+// or above its own level.
+//
+// The Filter returned for a configured category is a child of the registered
+// one, as made by With.  For any other category it has no writer of its own:
+// LogWrite and Write go to the nearest configured ancestor, while Close, Flush
+// and SetFormat do nothing, the ancestors' writers not being its to manage.
 func GetLogger(category string) *Filter {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+
 	f, ok := Global[category]
 	if !ok {
-		f = &Filter{TRACE, NewConsoleLogWriter(), "DEFAULT"}
-	} else {
-		f.Category = category
+		return &Filter{Level: TRACE, Category: category}
+	}
+	child := *f
+	child.Category = category
+	child.origin = f.base()
+	return &child
+}
+
+// With returns a child Filter sharing the receiver's writer, level and
+// category, with kv bound as extra fields on every record it logs.  The
+// receiver's own fields are kept; a repeated key takes the new value.
+func (f *Filter) With(kv ...interface{}) *Filter {
+	child := *f
+	child.Fields = f.Fields.With(kv...)
+	child.origin = f.base()
+	return &child
+}
+
+// SetAdditivity controls whether records written by f also propagate to the
+// filters of its ancestor categories and the root (chainable).  Filters are
+// additive by default.
+func (f *Filter) SetAdditivity(additive bool) *Filter {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	f.base().detached = !additive
+	return f
+}
+
+// Additivity reports whether records written by f propagate to its ancestors.
+func (f *Filter) Additivity() bool {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	return !f.base().detached
+}
+
+// base returns the Filter registered in the Logger that f was derived from, so
+// that children made by With follow a configuration reload of their parent.
+func (f *Filter) base() *Filter {
+	if f.origin != nil {
+		return f.origin
 	}
 	return f
 }
 
+// writer returns the LogWriter of the filter f was derived from, nil for a
+// category without a filter of its own.
+func (f *Filter) writer() LogWriter {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	return f.base().LogWriter
+}
+
+// LogWrite writes rec to the writer of f, or for a category without a filter
+// of its own to the writers its records propagate to.
+func (f *Filter) LogWrite(rec *LogRecord) {
+	globalMu.RLock()
+	w := f.base().LogWriter
+	var chain []target
+	if w == nil {
+		_, chain = f.resolve()
+	}
+	globalMu.RUnlock()
+
+	if w != nil {
+		w.LogWrite(rec)
+		return
+	}
+	dispatch(chain, rec)
+}
+
+// Write writes p to the writer of f, or to that of the nearest configured
+// ancestor.  p is discarded if there is none.
+func (f *Filter) Write(p []byte) (n int, err error) {
+	globalMu.RLock()
+	_, chain := f.resolve()
+	globalMu.RUnlock()
+
+	if len(chain) == 0 {
+		return len(p), nil
+	}
+	return chain[0].writer.Write(p)
+}
+
+// Close closes the writer of f, if it has one.
+func (f *Filter) Close() {
+	if w := f.writer(); w != nil {
+		w.Close()
+	}
+}
+
+// Flush flushes the writer of f, if it has one and it is a Flusher.
+func (f *Filter) Flush(ctx context.Context) error {
+	if w, ok := f.writer().(Flusher); ok {
+		return w.Flush(ctx)
+	}
+	return nil
+}
+
+// CloseContext closes the writer of f, if it has one.  A writer that is not a
+// Flusher is closed with Close, which is left running in the background if
+// ctx is done first.
+func (f *Filter) CloseContext(ctx context.Context) error {
+	switch w := f.writer().(type) {
+	case nil:
+		return nil
+	case Flusher:
+		return w.CloseContext(ctx)
+	default:
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			defer recoverPanic()
+			w.Close()
+		}()
+		select {
+		case <-closed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SetFormat sets the format of the writer of f, if it has one.
+func (f *Filter) SetFormat(format string) {
+	if w := f.writer(); w != nil {
+		w.SetFormat(format)
+	}
+}
+
+// parentCategory returns the category one level up the dotted hierarchy, or
+// "" for a top-level category.
+func parentCategory(category string) string {
+	if i := strings.LastIndexByte(category, '.'); i >= 0 {
+		return category[:i]
+	}
+	return ""
+}
+
+// A target is a writer a record is sent to, with the level of the filter it
+// was found in, as they were when the chain was resolved.
+type target struct {
+	level  Level
+	writer LogWriter
+}
+
+// resolve returns the effective level of f and the writers its records are
+// sent to, nearest first.  A filter with a writer of its own (a registered
+// one) comes first; then the registered ancestors of its category and the root
+// filter follow as long as additivity allows.  A writer shared by several
+// filters appears once.  The caller must hold globalMu.RLock.
+func (f *Filter) resolve() (Level, []target) {
+	base := f.base()
+	level, levelSet := base.Level, false
+	chain := make([]target, 0, 4)
+	seen := make(map[interface{}]bool, 4)
+
+	add := func(filt *Filter) bool {
+		if !levelSet {
+			level, levelSet = filt.Level, true
+		}
+		if key := writerKey(filt); !seen[key] {
+			seen[key] = true
+			chain = append(chain, target{level: filt.Level, writer: filt.LogWriter})
+		}
+		return !filt.detached
+	}
+
+	category := f.Category
+	if base.LogWriter != nil {
+		if !add(base) {
+			return level, chain
+		}
+		category = parentCategory(category)
+	}
+	for ; category != ""; category = parentCategory(category) {
+		if filt, ok := Global[category]; ok && filt != base && filt.LogWriter != nil {
+			if !add(filt) {
+				return level, chain
+			}
+		}
+	}
+
+	root, ok := Global["stdout"]
+	if !ok {
+		root = Global["default"]
+	}
+	if root != nil && root != base && root.LogWriter != nil {
+		add(root)
+	}
+	return level, chain
+}
+
+// dispatch writes rec to each writer of chain whose level it reaches.  It is
+// called without globalMu, so that a slow writer, or one that logs itself,
+// cannot hold up a configuration swap.
+func dispatch(chain []target, rec *LogRecord) {
+	for _, t := range chain {
+		if rec.Level >= t.level {
+			t.writer.LogWrite(rec)
+		}
+	}
+}
+
 // Send a formatted log message internally
 func (f *Filter) intLogf(lvl Level, format string, args ...interface{}) {
-	skip := true
+	globalMu.RLock()
+	level, chain := f.resolve()
+	globalMu.RUnlock()
 
 	// Determine if any logging will be done
-	if lvl >= f.Level {
-		skip = false
-	}
-	if skip {
+	if lvl < level || len(chain) == 0 {
 		return
 	}
 
@@ -49,37 +261,22 @@ func (f *Filter) intLogf(lvl Level, format string, args ...interface{}) {
 		Source:   src,
 		Message:  msg,
 		Category: f.Category,
+		Fields:   f.Fields,
 	}
 
 	// Dispatch the logs
-	/*for _, filt := range log {
-		if lvl < filt.Level {
-			continue
-		}
-		filt.LogWrite(rec)
-	}
-	*/
-	defaultFilter := Global["stdout"]
-
-	if defaultFilter != nil && lvl > defaultFilter.Level {
-		defaultFilter.LogWrite(rec)
-	}
-
-	if f.Category != "DEFAULT" && f.Category != "stdout" {
-		f.LogWrite(rec)
-	}
+	dispatch(chain, rec)
 
 }
 
 // Send a closure log message internally
 func (f *Filter) intLogc(lvl Level, closure func() string) {
-	skip := true
+	globalMu.RLock()
+	level, chain := f.resolve()
+	globalMu.RUnlock()
 
 	// Determine if any logging will be done
-	if lvl >= f.Level {
-		skip = false
-	}
-	if skip {
+	if lvl < level || len(chain) == 0 {
 		return
 	}
 
@@ -97,28 +294,21 @@ func (f *Filter) intLogc(lvl Level, closure func() string) {
 		Source:   src,
 		Message:  closure(),
 		Category: f.Category,
+		Fields:   f.Fields,
 	}
 
-	default_filter := Global["stdout"]
-
-	if default_filter != nil && lvl > default_filter.Level {
-		default_filter.LogWrite(rec)
-	}
-
-	if f.Category != "DEFAULT" && f.Category != "stdout" {
-		f.LogWrite(rec)
-	}
+	// Dispatch the logs
+	dispatch(chain, rec)
 }
 
 // Send a log message with manual level, source, and message.
 func (f *Filter) Log(lvl Level, source, message string) {
-	skip := true
+	globalMu.RLock()
+	level, chain := f.resolve()
+	globalMu.RUnlock()
 
 	// Determine if any logging will be done
-	if lvl >= f.Level {
-		skip = false
-	}
-	if skip {
+	if lvl < level || len(chain) == 0 {
 		return
 	}
 
@@ -129,17 +319,11 @@ func (f *Filter) Log(lvl Level, source, message string) {
 		Source:   source,
 		Message:  message,
 		Category: f.Category,
+		Fields:   f.Fields,
 	}
 
-	defaultFilter := Global["stdout"]
-
-	if defaultFilter != nil && lvl > defaultFilter.Level {
-		defaultFilter.LogWrite(rec)
-	}
-
-	if f.Category != "DEFAULT" && f.Category != "stdout" {
-		f.LogWrite(rec)
-	}
+	// Dispatch the logs
+	dispatch(chain, rec)
 }
 
 // Logf logs a formatted log message at the given log level, using the caller as
@@ -167,19 +351,19 @@ func (f *Filter) Logc(lvl Level, closure func() string) {
 //   When given anything else, the f message will be each of the arguments
 //   formatted with %v and separated by spaces (ala Sprint).
 func (f *Filter) Debug(arg0 interface{}, args ...interface{}) {
-	f.intLogf(DEBUG, f.getMsg(arg0, args))
+	f.intLogf(DEBUG, f.getMsg(arg0, args...))
 }
 
 // Trace fs a message at the trace f level.
 // See Debug for an explanation of the arguments.
 func (f *Filter) Trace(arg0 interface{}, args ...interface{}) {
-	f.intLogf(TRACE, f.getMsg(arg0, args))
+	f.intLogf(TRACE, f.getMsg(arg0, args...))
 }
 
 // Info fs a message at the info f level.
 // See Debug for an explanation of the arguments.
 func (f *Filter) Info(arg0 interface{}, args ...interface{}) {
-	f.intLogf(INFO, f.getMsg(arg0, args))
+	f.intLogf(INFO, f.getMsg(arg0, args...))
 }
 
 // Warn fs a message at the warning f level and returns the formatted error.
@@ -188,21 +372,21 @@ func (f *Filter) Info(arg0 interface{}, args ...interface{}) {
 // closures are executed to format the error message.
 // See Debug for further explanation of the arguments.
 func (f *Filter) Warn(arg0 interface{}, args ...interface{}) {
-	f.intLogf(WARN, f.getMsg(arg0, args))
+	f.intLogf(WARN, f.getMsg(arg0, args...))
 }
 
 // Error fs a message at the error f level and returns the formatted error,
 // See Warn for an explanation of the performance and Debug for an explanation
 // of the parameters.
 func (f *Filter) Error(arg0 interface{}, args ...interface{}) {
-	f.intLogf(ERROR, f.getMsg(arg0, args))
+	f.intLogf(ERROR, f.getMsg(arg0, args...))
 }
 
 // Fatal fs a message at the error f level and returns the formatted error,
 // See Fatal for an explanation of the performance and Debug for an explanation
 // of the parameters.
 func (f *Filter) Fatal(arg0 interface{}, args ...interface{}) {
-	f.intLogf(FATAL, f.getMsg(arg0, args))
+	f.intLogf(FATAL, f.getMsg(arg0, args...))
 }
 
 func (f *Filter) getMsg(arg0 interface{}, args ...interface{}) string {
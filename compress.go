@@ -0,0 +1,104 @@
+package logs
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Suffixes of compressed backups.  A backup is first compressed to a .gz.tmp
+// file that is renamed to .gz once complete, and the uncompressed backup is
+// removed only after that, so a process dying mid-compression never loses a
+// backup: the next writer with compression on removes the partial .gz.tmp and
+// compresses the backup again.
+const (
+	gzipSuffix    = ".gz"
+	gzipTmpSuffix = ".gz.tmp"
+)
+
+// compressBackup gzips the rotated log file name in the background.  The
+// writer goroutine carries on with the new log file meanwhile.
+func (w *FileLogWriter) compressBackup(name string) {
+	w.background(func() {
+		if err := gzipFile(name); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "FileLogWriter(%q): compress: %s\n", w.filename, err)
+		}
+	})
+}
+
+// recoverBackups finishes the compressions interrupted by an earlier process:
+// partial .gz.tmp files are removed, and backups still uncompressed are
+// compressed (or just removed, when their .gz was already completed).
+func (w *FileLogWriter) recoverBackups() {
+	isBackup := w.backupMatcher()
+	dir := filepath.Dir(w.filename)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		name := info.Name()
+		path := filepath.Join(dir, name)
+		switch {
+		case info.IsDir():
+		case strings.HasSuffix(name, gzipTmpSuffix) && isBackup(strings.TrimSuffix(name, gzipTmpSuffix)):
+			_ = os.Remove(path)
+		case isBackup(name):
+			if _, err := os.Stat(path + gzipSuffix); err == nil {
+				_ = os.Remove(path)
+			} else {
+				w.compressBackup(path)
+			}
+		}
+	}
+}
+
+// gzipFile replaces the file name with name.gz, keeping its modification time.
+// A file already removed, e.g. by the retention policy, is not an error.
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := name + gzipTmpSuffix
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	zw.Name = filepath.Base(name)
+	zw.ModTime = info.ModTime()
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if serr := dst.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	_ = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	if err := os.Rename(tmp, name+gzipSuffix); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(name)
+}
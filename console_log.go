@@ -6,48 +6,54 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"time"
+	"sync"
 )
 
 var stdout io.Writer = os.Stdout
 
 // This is the standard writer that prints to standard output.
 type ConsoleLogWriter struct {
-	format string
-	w      chan *LogRecord
+	mu     sync.Mutex // guards layout
+	layout Layout
+	*recordQueue
 }
 
 // This creates a new ConsoleLogWriter
 func NewConsoleLogWriter() *ConsoleLogWriter {
 	consoleWriter := &ConsoleLogWriter{
-		format: "[%A][%L][%P] %F:%M",
-		w:      make(chan *LogRecord, LogBufferLength),
+		layout:      PatternLayout("[%A][%L][%P] %F:%M%X"),
+		recordQueue: newRecordQueue(),
 	}
-	go consoleWriter.run(stdout)
+	consoleWriter.start("ConsoleLogWriter", consoleWriter.writer(stdout), nil, nil)
 	return consoleWriter
 }
 
 func (c *ConsoleLogWriter) SetFormat(format string) {
-	c.format = format
+	c.SetLayout(PatternLayout(format))
 }
 
-func (c *ConsoleLogWriter) run(out io.Writer) {
-	for rec := range c.w {
-		_, _ = fmt.Fprint(out, FormatLogRecord(c.format, rec))
-	}
+// SetLayout replaces the %-pattern with an arbitrary Layout, e.g. JSONLayout{}.
+func (c *ConsoleLogWriter) SetLayout(layout Layout) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.layout = layout
 }
 
-// This is the ConsoleLogWriter's output method.  This will block if the output
-// buffer is full.
-func (c *ConsoleLogWriter) LogWrite(rec *LogRecord) {
-	c.w <- rec
+func (c *ConsoleLogWriter) writer(out io.Writer) func(*LogRecord) error {
+	return func(rec *LogRecord) error {
+		c.mu.Lock()
+		layout := c.layout
+		c.mu.Unlock()
+		_, err := fmt.Fprint(out, layout.Format(rec))
+		return err
+	}
 }
 
-// Close stops the logger from sending messages to standard output.  Attempts to
-// send log messages to this logger after a Close have undefined behavior.
+// Close stops the logger from sending messages to standard output, once the
+// messages already queued have been printed.  Attempts to send log messages to
+// this logger after a Close have undefined behavior.
 func (c *ConsoleLogWriter) Close() {
-	close(c.w)
-	time.Sleep(50 * time.Millisecond) // Try to give console I/O time to complete
+	c.recordQueue.Close()
 }
 
 func (c *ConsoleLogWriter) Write(p []byte) (n int, err error) {
@@ -0,0 +1,172 @@
+package logs
+
+import (
+	"context"
+	"sync"
+)
+
+// Field keys conventionally used for request-scoped values.  NewContext
+// accepts any key, these are just the names the ContextExtractors and the
+// network writers agree on.
+const (
+	RequestIDKey = "request_id"
+	TenantKey    = "tenant"
+	TraceIDKey   = "trace_id"
+	SpanIDKey    = "span_id"
+)
+
+type contextKey struct{}
+
+// A ContextExtractor returns the fields to log for ctx, e.g. the trace and
+// span IDs of a tracing library's span stored in ctx.
+type ContextExtractor func(ctx context.Context) Fields
+
+var (
+	extractorsMu sync.RWMutex
+	extractors   []*ContextExtractor
+)
+
+// RegisterContextExtractor adds fn to the extractors consulted by
+// ContextFields, so values that other packages keep in a context (such as
+// their trace/span IDs) are logged without being copied with NewContext.
+// Calling the returned function removes fn again.
+func RegisterContextExtractor(fn ContextExtractor) (unregister func()) {
+	entry := &fn
+	extractorsMu.Lock()
+	defer extractorsMu.Unlock()
+	extractors = append(extractors, entry)
+
+	return func() {
+		extractorsMu.Lock()
+		defer extractorsMu.Unlock()
+		for i, e := range extractors {
+			if e == entry {
+				extractors = append(extractors[:i:i], extractors[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// NewContext returns a copy of ctx carrying kv as logging fields in addition
+// to those already in ctx, e.g.
+//
+//	ctx = logs.NewContext(ctx, logs.RequestIDKey, id, logs.TenantKey, tenant)
+//
+// See NewFields for how kv is interpreted.  A nil ctx stands for
+// context.Background().
+func NewContext(ctx context.Context, kv ...interface{}) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	fields, _ := ctx.Value(contextKey{}).(Fields)
+	return context.WithValue(ctx, contextKey{}, fields.With(kv...))
+}
+
+// ContextFields returns the fields stored in ctx by NewContext followed by the
+// ones returned by the registered ContextExtractors.
+func ContextFields(ctx context.Context) Fields {
+	if ctx == nil {
+		return nil
+	}
+	fields, _ := ctx.Value(contextKey{}).(Fields)
+
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+	for _, fn := range extractors {
+		fields = fields.Merge((*fn)(ctx))
+	}
+	return fields
+}
+
+// FromContext returns the default logger of Global with the fields of ctx
+// bound to it.
+func FromContext(ctx context.Context) *Filter {
+	filt, ok := currentGlobal()["default"]
+	if !ok {
+		filt = &Filter{Level: TRACE, Category: "DEFAULT"}
+	}
+	return filt.WithContext(ctx)
+}
+
+// WithContext returns a child of f with the fields of ctx bound to it.
+func (f *Filter) WithContext(ctx context.Context) *Filter {
+	child := *f
+	child.Fields = f.Fields.Merge(ContextFields(ctx))
+	child.origin = f.base()
+	return &child
+}
+
+// WithContext returns a child of log with the fields of ctx bound to every
+// filter.
+func (log Logger) WithContext(ctx context.Context) Logger {
+	fields := ContextFields(ctx)
+	child := make(Logger, len(log))
+	for name, filt := range log {
+		c := *filt
+		c.Fields = filt.Fields.Merge(fields)
+		c.origin = filt.base()
+		child[name] = &c
+	}
+	return child
+}
+
+// TraceCtx is Trace with the fields of ctx added to the record.
+func (f *Filter) TraceCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	f.WithContext(ctx).intLogf(TRACE, f.getMsg(arg0, args...))
+}
+
+// DebugCtx is Debug with the fields of ctx added to the record.
+func (f *Filter) DebugCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	f.WithContext(ctx).intLogf(DEBUG, f.getMsg(arg0, args...))
+}
+
+// InfoCtx is Info with the fields of ctx added to the record.
+func (f *Filter) InfoCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	f.WithContext(ctx).intLogf(INFO, f.getMsg(arg0, args...))
+}
+
+// WarnCtx is Warn with the fields of ctx added to the record.
+func (f *Filter) WarnCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	f.WithContext(ctx).intLogf(WARN, f.getMsg(arg0, args...))
+}
+
+// ErrorCtx is Error with the fields of ctx added to the record.
+func (f *Filter) ErrorCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	f.WithContext(ctx).intLogf(ERROR, f.getMsg(arg0, args...))
+}
+
+// FatalCtx is Fatal with the fields of ctx added to the record.
+func (f *Filter) FatalCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	f.WithContext(ctx).intLogf(FATAL, f.getMsg(arg0, args...))
+}
+
+// TraceCtx is Trace with the fields of ctx added to the record.
+func TraceCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	doLog(currentGlobal().WithContext(ctx), TRACE, arg0, args...)
+}
+
+// DebugCtx is Debug with the fields of ctx added to the record.
+func DebugCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	doLog(currentGlobal().WithContext(ctx), DEBUG, arg0, args...)
+}
+
+// InfoCtx is Info with the fields of ctx added to the record.
+func InfoCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	doLog(currentGlobal().WithContext(ctx), INFO, arg0, args...)
+}
+
+// WarnCtx is Warn with the fields of ctx added to the record.
+func WarnCtx(ctx context.Context, arg0 interface{}, args ...interface{}) error {
+	return doErrLog(currentGlobal().WithContext(ctx), WARN, arg0, args...)
+}
+
+// ErrorCtx is Error with the fields of ctx added to the record.
+func ErrorCtx(ctx context.Context, arg0 interface{}, args ...interface{}) error {
+	return doErrLog(currentGlobal().WithContext(ctx), ERROR, arg0, args...)
+}
+
+// FatalCtx is Fatal with the fields of ctx added to the record.
+func FatalCtx(ctx context.Context, arg0 interface{}, args ...interface{}) error {
+	return doErrLog(currentGlobal().WithContext(ctx), FATAL, arg0, args...)
+}
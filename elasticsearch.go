@@ -0,0 +1,195 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ElasticsearchWriter indexes records into Elasticsearch or OpenSearch with
+// the _bulk API.  It is an HTTPWriter, batching and retrying alike; besides,
+// the documents the cluster rejects with 429 or 5xx in an otherwise successful
+// response are sent again on their own, while those rejected for other
+// reasons (e.g. a mapping conflict) are given up.
+//
+// Each record becomes a document with the fields
+//
+//	@timestamp            time of the record, UTC
+//	log.level             INFO, WARN...
+//	log.logger            category
+//	log.origin.function   source function
+//	log.origin.file.line  source line
+//	message
+//	service.name          Project
+//	fields                object of the fields of the record
+//
+// created in an index named after the time of the record (UTC), see SetIndex.
+// The layout is not used.
+type ElasticsearchWriter struct {
+	*HTTPWriter
+	index string
+	dated *nameTemplate // nil if index has no strftime verbs
+}
+
+// NewElasticsearchWriter returns an ElasticsearchWriter for the cluster at url,
+// e.g. "http://localhost:9200", indexing into the daily indices of Project.
+func NewElasticsearchWriter(url string, level Level) *ElasticsearchWriter {
+	w := &ElasticsearchWriter{HTTPWriter: newHTTPWriter(strings.TrimRight(url, "/")+"/_bulk", level)}
+	w.format = HTTPBatchNDJSON
+	w.encode = w.document
+	w.results = w.bulkResults
+	w.start(fmt.Sprintf("ElasticsearchWriter(%s)", url), w.write, w.flushBatch, w.exit)
+	return w
+}
+
+// SetIndex sets the name of the indices: strftime verbs (%Y, %m, %d, %H...)
+// are replaced by the time of each record in UTC, e.g. "app-%Y.%m.%d".  The
+// empty name stands for the lower-cased Project followed by "-%Y.%m.%d".
+func (w *ElasticsearchWriter) SetIndex(index string) error {
+	dated, err := parseIndexTemplate(index)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.index, w.dated = index, dated
+	return nil
+}
+
+// SetAPIKey authenticates the requests with an API key, in the base64 form
+// returned by the create API key API.
+func (w *ElasticsearchWriter) SetAPIKey(key string) {
+	w.SetHeader("Authorization", "ApiKey "+key)
+}
+
+// parseIndexTemplate returns the template of an index name holding strftime
+// verbs, nil for a fixed name.
+func parseIndexTemplate(index string) (*nameTemplate, error) {
+	if !strings.Contains(index, "%") {
+		return nil, nil
+	}
+	return parseNameTemplate(index)
+}
+
+// indexName returns the index of a record created at t.  It is called holding
+// w.mu.
+func (w *ElasticsearchWriter) indexName(t time.Time) string {
+	t = t.UTC()
+	switch {
+	case w.dated != nil:
+		return w.dated.format(t)
+	case w.index != "":
+		return w.index
+	}
+	return strings.ToLower(Project) + "-" + t.Format("2006.01.02")
+}
+
+// document encodes rec as the action and the source of a bulk request.  It is
+// called holding w.mu.
+func (w *ElasticsearchWriter) document(rec *LogRecord) []byte {
+	created := rec.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	category := rec.Category
+	if category == "" {
+		category = "DEFAULT"
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, 256))
+	out.WriteString(`{"create":{"_index":`)
+	writeJSONString(out, w.indexName(created))
+	out.WriteString("}}\n")
+
+	out.WriteString(`{"@timestamp":`)
+	writeJSONString(out, created.UTC().Format(JSONTimeFormat))
+	out.WriteString(`,"log.level":`)
+	writeJSONString(out, rec.Level.String())
+	out.WriteString(`,"log.logger":`)
+	writeJSONString(out, category)
+	if rec.Source != "" {
+		function, line := splitSource(rec.Source)
+		out.WriteString(`,"log.origin.function":`)
+		writeJSONString(out, function)
+		if line != "" {
+			out.WriteString(`,"log.origin.file.line":`)
+			out.WriteString(line)
+		}
+	}
+	out.WriteString(`,"message":`)
+	writeJSONString(out, rec.Message)
+	out.WriteString(`,"service.name":`)
+	writeJSONString(out, Project)
+	if len(rec.Fields) > 0 {
+		out.WriteString(`,"fields":{`)
+		for i, field := range rec.Fields {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			writeJSONString(out, field.Key)
+			out.WriteByte(':')
+			writeJSONValue(out, field.Value)
+		}
+		out.WriteByte('}')
+	}
+	out.WriteString("}\n")
+	return out.Bytes()
+}
+
+// bulkResponse is the part of the response of the _bulk API telling which
+// documents failed.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// bulkResults picks the documents to send again out of the response to a bulk
+// request, and counts the ones rejected for good.  A response that cannot be
+// read, or that does not tell about every document, has the whole batch sent
+// again.
+func (w *ElasticsearchWriter) bulkResults(resp []byte, batch [][]byte) (retry [][]byte, rejected int, err error) {
+	var r bulkResponse
+	if err := json.Unmarshal(resp, &r); err != nil {
+		return batch, 0, fmt.Errorf("unreadable bulk response: %s", err)
+	}
+	if len(r.Items) != len(batch) {
+		return batch, 0, fmt.Errorf("bulk response has %d items for %d documents", len(r.Items), len(batch))
+	}
+	if !r.Errors {
+		return nil, 0, nil
+	}
+	var rejectReason, retryReason string
+	for i, item := range r.Items {
+		for _, result := range item {
+			reason := fmt.Sprintf("%d %s: %s", result.Status, result.Error.Type, result.Error.Reason)
+			switch {
+			case result.Status < 300:
+			case result.Status == 429 || result.Status >= 500:
+				retry = append(retry, batch[i])
+				if retryReason == "" {
+					retryReason = reason
+				}
+			default:
+				rejected++
+				if rejectReason == "" {
+					rejectReason = reason
+				}
+			}
+		}
+	}
+	if len(retry) == 0 && rejected == 0 {
+		return nil, 0, nil
+	}
+	if rejectReason == "" {
+		rejectReason = retryReason
+	}
+	return retry, rejected, fmt.Errorf("%d documents rejected and %d to retry, first: %s", rejected, len(retry), rejectReason)
+}
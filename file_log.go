@@ -3,23 +3,29 @@
 package logs
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
+// timeNow is the clock deciding when FileLogWriters rotate, set by tests.
+var timeNow = time.Now
+
 // This log writer sends output to a file
 type FileLogWriter struct {
-	rec chan *LogRecord
-	rot chan bool
+	*recordQueue
 
 	// The opened file
 	filename string
 	file     *os.File
 
-	// The logging format
-	format string
+	// The logging layout
+	layoutMu sync.Mutex
+	layout   Layout
 
 	// File header/trailer
 	header, trailer string
@@ -33,8 +39,20 @@ type FileLogWriter struct {
 	maxsizeCurSize int
 
 	// Rotate daily
-	daily         bool
-	dailyOpenDate int
+	daily bool
+
+	// Rotate by time, naming the backups after the template if set
+	schedule Schedule
+	template *nameTemplate
+
+	// Rotate when the policy set with SetRotationPolicy says so
+	custom RotationPolicy
+
+	// All of the above, consulted before each write
+	rotation     RotationPolicy
+	opened       time.Time
+	linesCounted bool
+	wrote        bool
 
 	// Keep old logfiles (.001, .002, etc)
 	rotate    bool
@@ -42,16 +60,30 @@ type FileLogWriter struct {
 
 	// Sanitize newlines to prevent log injection
 	sanitize bool
-}
 
-// This is the FileLogWriter's output method
-func (w *FileLogWriter) LogWrite(rec *LogRecord) {
-	w.rec <- rec
+	// Gzip old logfiles (.1.gz, .2006-01-02.gz) in the background
+	compress bool
+
+	// Remove old logfiles by age, count and total size
+	retention retention
+
+	// Reopen the file when it is moved, removed or truncated by someone else
+	copyTruncate bool
+	checkStop    chan struct{}
+
+	// Lock shared with the other processes writing the file, see
+	// OpenSharedFileLogWriter
+	shared *os.File
+
+	// Background work on old logfiles, run one job at a time
+	backups  sync.WaitGroup
+	backupMu sync.Mutex
 }
 
+// Close stops the writer once the records already queued have been written,
+// then writes the trailer and closes the file.
 func (w *FileLogWriter) Close() {
-	close(w.rec)
-	_ = w.file.Sync()
+	w.recordQueue.Close()
 }
 
 // NewFileLogWriter creates a new LogWriter which writes to the given file and
@@ -62,74 +94,118 @@ func (w *FileLogWriter) Close() {
 // to configure log rotation based on lines, size, and daily.
 //
 // The standard log-line format is:
-//   [%D %T] [%L] (%S) %M
+//   [%D %T] [%L] (%S) %M%X
 func NewFileLogWriter(fileName string, rotate bool, daily bool) *FileLogWriter {
+	w, err := OpenFileLogWriter(fileName, rotate, daily)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return nil
+	}
+	return w
+}
+
+// OpenFileLogWriter is NewFileLogWriter, but reports a failure to open the
+// file as an error instead of printing it and returning nil.
+func OpenFileLogWriter(fileName string, rotate bool, daily bool) (*FileLogWriter, error) {
+	return openFileLogWriter(fileName, rotate, daily, false, nil)
+}
+
+// openFileLogWriter opens a FileLogWriter, shared with other processes if
+// shared is true.  setup, if not nil, configures the writer before the file is
+// first opened, so that the rotation on opening follows its schedule, name
+// template and policies.
+func openFileLogWriter(fileName string, rotate, daily, shared bool, setup func(*FileLogWriter)) (*FileLogWriter, error) {
 	w := &FileLogWriter{
-		rec:       make(chan *LogRecord, LogBufferLength),
-		rot:       make(chan bool),
-		filename:  fileName,
-		format:    "[%D %T] [%L] (%S) %M",
-		daily:     daily,
-		rotate:    rotate,
-		maxBackup: 999,
-		sanitize:  false, // set to false so as not to break compatibility
+		recordQueue: newRecordQueue(),
+		filename:    fileName,
+		layout:      PatternLayout("[%D %T] [%L] (%S) %M%X"),
+		rotate:      rotate,
+		maxBackup:   999,
+		sanitize:    false, // set to false so as not to break compatibility
+	}
+	if shared {
+		lock, err := os.OpenFile(fileName+writeLockSuffix, os.O_RDWR|os.O_CREATE, 0660)
+		if err != nil {
+			return nil, fmt.Errorf("FileLogWriter(%q): %s", fileName, err)
+		}
+		w.shared = lock
+	}
+	w.SetRotateDaily(daily)
+	if setup != nil {
+		setup(w)
 	}
 	// open the file for the first time
-	if err := w.intRotate(); err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-		return nil
+	if err := w.locked(w.intRotate); err != nil {
+		w.SetReopenCheck(0)
+		if w.shared != nil {
+			_ = w.shared.Close()
+		}
+		return nil, fmt.Errorf("FileLogWriter(%q): %s", w.filename, err)
 	}
 
-	go func() {
-		defer recoverPanic()
-		defer func() {
-			if w.file != nil {
-				_, _ = fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
-				_ = w.file.Close()
-			}
-		}()
-
-		for {
-			select {
-			case <-w.rot:
-				if err := w.intRotate(); err != nil {
-					_, _ = fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-					return
-				}
-			case rec, ok := <-w.rec:
-				if !ok {
-					return
-				}
-				now := time.Now()
-				if (w.MaxLines > 0 && w.MaxLinesCurLines >= w.MaxLines) ||
-					(w.maxsize > 0 && w.maxsizeCurSize >= w.maxsize) ||
-					(w.daily && now.Day() != w.dailyOpenDate) {
-					if err := w.intRotate(); err != nil {
-						_, _ = fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-						return
-					}
-				}
+	w.start(fmt.Sprintf("FileLogWriter(%q)", w.filename), w.writeRecord, w.sync, w.closeFile)
 
-				// Sanitize newlines
-				if w.sanitize {
-					rec.Message = strings.Replace(rec.Message, "\n", "\\n", -1)
-				}
+	return w, nil
+}
 
-				// Perform the write
-				n, err := fmt.Fprint(w.file, FormatLogRecord(w.format, rec))
-				if err != nil {
-					_, _ = fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-					return
-				}
+func (w *FileLogWriter) writeRecord(rec *LogRecord) error {
+	if w.shared != nil {
+		if err := flock(w.shared); err != nil {
+			return fmt.Errorf("lock: %s", err)
+		}
+		defer funlock(w.shared)
+		if err := w.followSiblings(); err != nil {
+			return err
+		}
+	}
 
-				// Update the counts
-				w.MaxLinesCurLines++
-				w.maxsizeCurSize += n
-			}
+	now := timeNow()
+	if w.rotation != nil && w.rotation.ShouldRotate(w.fileState(), now) {
+		if err := w.intRotate(); err != nil {
+			return err
 		}
-	}()
+	}
 
-	return w
+	// Sanitize newlines, on a copy as the record is shared with other writers
+	if w.sanitize && strings.Contains(rec.Message, "\n") {
+		sanitized := *rec
+		sanitized.Message = strings.Replace(rec.Message, "\n", "\\n", -1)
+		rec = &sanitized
+	}
+
+	// Perform the write
+	w.layoutMu.Lock()
+	layout := w.layout
+	w.layoutMu.Unlock()
+	n, err := fmt.Fprint(w.file, layout.Format(rec))
+	if err != nil {
+		return err
+	}
+
+	// Update the counts
+	w.MaxLinesCurLines++
+	w.maxsizeCurSize += n
+	w.wrote = true
+	return nil
+}
+
+func (w *FileLogWriter) sync() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+func (w *FileLogWriter) closeFile() {
+	if w.file != nil {
+		_, _ = fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
+		_ = w.file.Sync()
+		_ = w.file.Close()
+	}
+	w.backups.Wait()
+	if w.shared != nil {
+		_ = w.shared.Close()
+	}
 }
 
 func (w *FileLogWriter) Write(p []byte) (n int, err error) {
@@ -139,11 +215,45 @@ func (w *FileLogWriter) Write(p []byte) (n int, err error) {
 
 // Request that the logs rotate
 func (w *FileLogWriter) Rotate() {
-	w.rot <- true
+	_ = w.do(context.Background(), func() {
+		if err := w.locked(w.intRotate); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+		}
+	})
+}
+
+// reconfigure runs fn on the writer goroutine, between two records, so that
+// the settings of a writer already in use can be changed safely.
+func (w *FileLogWriter) reconfigure(fn func(*FileLogWriter)) {
+	_ = w.do(context.Background(), func() { fn(w) })
+}
+
+// background runs fn on the old logfiles away from the writer goroutine, so a
+// slow compression or cleanup never stalls logging.  Jobs run one at a time.
+func (w *FileLogWriter) background(fn func()) {
+	w.backups.Add(1)
+	go func() {
+		defer w.backups.Done()
+		defer recoverPanic()
+		w.backupMu.Lock()
+		defer w.backupMu.Unlock()
+		w.lockBackups(fn)
+	}()
+}
+
+// rotated schedules the compression of the logfile just renamed to name and
+// the removal of the backups the retention policy no longer keeps.
+func (w *FileLogWriter) rotated(name string) {
+	if w.compress {
+		w.compressBackup(name)
+	}
+	w.pruneBackups()
 }
 
 // If this is called in a threaded context, it MUST be synchronized
 func (w *FileLogWriter) intRotate() error {
+	opening := w.file == nil
+
 	// Close any log file that may be open
 	if w.file != nil {
 		_, _ = fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
@@ -155,73 +265,90 @@ func (w *FileLogWriter) intRotate() error {
 		// _, err = os.Lstat(w.filename)
 
 		if err == nil { // file exists
-			// Find the next available number
-			modifiedTime := info.ModTime()
-			w.dailyOpenDate = modifiedTime.Day()
-			num := 1
 			fileName := ""
-			if w.daily && time.Now().Day() != w.dailyOpenDate {
-				modifiedDate := modifiedTime.Format("2006-01-02")
-				// for ; err == nil && num <= w.maxBackup; num++ {
-				// 	fileName = w.filename + fmt.Sprintf(".%s.%03d", yesterday, num)
-				// 	_, err = os.Lstat(fileName)
-				// }
-				// if err == nil {
-				// 	return fmt.Errorf("Rotate: Cannot find free log number to rename %s\n", w.filename)
-				// }
-				fileName = w.filename + fmt.Sprintf(".%s", modifiedDate)
-				_ = w.file.Close()
-				// Rename the file to its newfound home
-				err = os.Rename(w.filename, fileName)
-				if err != nil {
-					return fmt.Errorf("Rotate: %s\n", err)
-				}
-			} else if !w.daily {
-				num = w.maxBackup - 1
-				for ; num >= 1; num-- {
-					fileName = w.filename + fmt.Sprintf(".%d", num)
-					nfileName := w.filename + fmt.Sprintf(".%d", num+1)
-					_, err = os.Lstat(fileName)
-					if err == nil {
-						_ = os.Rename(fileName, nfileName)
+			if w.schedule != nil {
+				// On opening, a file of the current period is appended to.
+				if !opening || !w.schedule.Next(info.ModTime()).After(timeNow()) {
+					fileName = w.timeBackupName(info.ModTime())
+					_ = w.file.Close()
+					// Rename the file to its newfound home
+					err = os.Rename(w.filename, fileName)
+					if err != nil {
+						return fmt.Errorf("Rotate: %s\n", err)
 					}
+					w.rotated(fileName)
 				}
-				_ = w.file.Close()
-				// Rename the file to its newfound home
-				err = os.Rename(w.filename, fileName)
+			} else if !opening || w.shared == nil {
+				// Backups still being compressed must not be renamed under
+				// the compressor's feet.
+				w.backups.Wait()
+				w.lockBackups(func() {
+					num := w.maxBackup - 1
+					for ; num >= 1; num-- {
+						fileName = w.filename + fmt.Sprintf(".%d", num)
+						nfileName := w.filename + fmt.Sprintf(".%d", num+1)
+						_, err = os.Lstat(fileName)
+						if err == nil {
+							_ = os.Rename(fileName, nfileName)
+						}
+						_, err = os.Lstat(fileName + gzipSuffix)
+						if err == nil {
+							_ = os.Rename(fileName+gzipSuffix, nfileName+gzipSuffix)
+						}
+					}
+					_ = w.file.Close()
+					// Rename the file to its newfound home
+					err = os.Rename(w.filename, fileName)
+				})
 				// return error if the last file checked still existed
 				if err != nil {
 					return fmt.Errorf("Rotate: %s\n", err)
 				}
+				w.rotated(fileName)
 			}
 
 		}
 	}
 
 	// Open the log file
+	return w.openFile(opening)
+}
+
+// openFile opens the log file for appending and writes the header.  With seed,
+// the rotation values count what the file holds already.
+func (w *FileLogWriter) openFile(seed bool) error {
+	var prev os.FileInfo
+	if seed {
+		prev, _ = os.Stat(w.filename)
+	}
 	fd, err := os.OpenFile(w.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
 	if err != nil {
 		return err
 	}
 	w.file = fd
 
-	now := time.Now()
+	now := timeNow()
 	_, _ = fmt.Fprint(w.file, FormatLogRecord(w.header, &LogRecord{Created: now}))
 
-	// Set the daily open date to the current date
-	w.dailyOpenDate = now.Day()
-
-	// initialize rotation values
-	w.MaxLinesCurLines = 0
-	w.maxsizeCurSize = 0
+	// initialize rotation values from what the file holds
+	w.seedState(prev, now)
+	w.wrote = false
 
 	return nil
 }
 
-// Set the logging format (chainable).  Must be called before the first log
-// message is written.
+// Set the logging format.  Records already queued may be written with either
+// format.
 func (w *FileLogWriter) SetFormat(format string) {
-	w.format = format
+	w.SetLayout(PatternLayout(format))
+}
+
+// Set the logging layout, replacing the %-pattern.  Records already queued may
+// be written with either layout.
+func (w *FileLogWriter) SetLayout(layout Layout) {
+	w.layoutMu.Lock()
+	defer w.layoutMu.Unlock()
+	w.layout = layout
 }
 
 // Set the logfile header and footer (chainable).  Must be called before the first log
@@ -229,7 +356,7 @@ func (w *FileLogWriter) SetFormat(format string) {
 // you can use %D and %T in your header/footer for date and time).
 func (w *FileLogWriter) SetHeadFoot(head, foot string) *FileLogWriter {
 	w.header, w.trailer = head, foot
-	if w.MaxLinesCurLines == 0 {
+	if !w.wrote {
 		_, _ = fmt.Fprint(w.file, FormatLogRecord(w.header, &LogRecord{Created: time.Now()}))
 	}
 	return w
@@ -240,6 +367,7 @@ func (w *FileLogWriter) SetHeadFoot(head, foot string) *FileLogWriter {
 func (w *FileLogWriter) SetRotateLines(MaxLines int) *FileLogWriter {
 	//fmt.Fprintf(os.Stderr, "FileLogWriter.SetRotateLines: %v\n", MaxLines)
 	w.MaxLines = MaxLines
+	w.updateRotation()
 	return w
 }
 
@@ -248,17 +376,77 @@ func (w *FileLogWriter) SetRotateLines(MaxLines int) *FileLogWriter {
 func (w *FileLogWriter) SetRotateSize(maxsize int) *FileLogWriter {
 	//fmt.Fprintf(os.Stderr, "FileLogWriter.SetRotateSize: %v\n", maxsize)
 	w.maxsize = maxsize
+	w.updateRotation()
 	return w
 }
 
-// Set rotate daily (chainable). Must be called before the first log message is
-// written.
+// Set rotate daily (chainable), at local midnight.  Backups are named after
+// the date of their last write (.2006-01-02).  Must be called before the first
+// log message is written.
 func (w *FileLogWriter) SetRotateDaily(daily bool) *FileLogWriter {
 	//fmt.Fprintf(os.Stderr, "FileLogWriter.SetRotateDaily: %v\n", daily)
+	var schedule Schedule
+	if daily {
+		schedule, _ = Every(24*time.Hour, 0, time.Local)
+	}
+	w.SetRotateSchedule(schedule)
 	w.daily = daily
 	return w
 }
 
+// SetRotateSchedule rotates the file at the times of schedule, or not by time
+// if schedule is nil (chainable).  A file left by an earlier process is
+// rotated on the first write if a rotation time has passed since it was last
+// written.  Backups are named after the template set with SetNameTemplate,
+// or the log file name followed by the time of their last write
+// (.2006-01-02T15-04).
+func (w *FileLogWriter) SetRotateSchedule(schedule Schedule) *FileLogWriter {
+	w.schedule, w.daily = schedule, false
+	w.updateRotation()
+	return w
+}
+
+// SetNameTemplate names the backups of time-based rotation after the time of
+// their last write, e.g. "app-%Y%m%d%H.log" or the equivalent Go
+// layout "app-2006010215.log".  The template is a file name in the directory of
+// the log file; an empty template restores the default names.
+func (w *FileLogWriter) SetNameTemplate(template string) error {
+	if template == "" {
+		w.template = nil
+		return nil
+	}
+	t, err := parseNameTemplate(template)
+	if err != nil {
+		return err
+	}
+	w.template = t
+	return nil
+}
+
+// timeBackupName returns the name of the backup of a file last written at
+// last, with a .N suffix if that backup exists already.
+func (w *FileLogWriter) timeBackupName(last time.Time) string {
+	var name string
+	switch {
+	case w.template != nil:
+		name = filepath.Join(filepath.Dir(w.filename), w.template.format(last))
+	case w.daily:
+		name = w.filename + "." + last.Format(dailyBackupLayout)
+	default:
+		name = w.filename + "." + last.Format(timeBackupLayout)
+	}
+	taken := func(path string) bool {
+		_, err := os.Lstat(path)
+		_, gzErr := os.Lstat(path + gzipSuffix)
+		return err == nil || gzErr == nil
+	}
+	backup := name
+	for n := 1; taken(backup); n++ {
+		backup = fmt.Sprintf("%s.%d", name, n)
+	}
+	return backup
+}
+
 // Set max backup files. Must be called before the first log message
 // is written.
 func (w *FileLogWriter) SetRotatemaxBackup(maxBackup int) *FileLogWriter {
@@ -284,3 +472,16 @@ func (w *FileLogWriter) SetSanitize(sanitize bool) *FileLogWriter {
 	w.sanitize = sanitize
 	return w
 }
+
+// SetRotateCompress changes whether old logfiles are gzipped once rotated
+// (chainable).  Compression runs in the background, so the writer does not
+// stall while a large backup is compressed; backups become .N.gz or
+// .YYYY-MM-DD.gz.  Turning it on also completes the compressions an earlier
+// process was interrupted in.
+func (w *FileLogWriter) SetRotateCompress(compress bool) *FileLogWriter {
+	if compress && !w.compress {
+		w.recoverBackups()
+	}
+	w.compress = compress
+	return w
+}
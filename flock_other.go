@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package logs
+
+import "os"
+
+// flock is a no-op where flock(2) is not available: the multi-process mode of
+// FileLogWriter does not protect the file there.
+func flock(f *os.File) error {
+	return nil
+}
+
+func funlock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,393 @@
+package logs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of a new FluentWriter, see SetBatchLimits and SetAck.
+const (
+	DefaultFluentBatchRecords = 500
+	DefaultFluentBatchBytes   = 1 << 20
+	DefaultFluentBatchWait    = time.Second
+	DefaultFluentAckTimeout   = 30 * time.Second
+)
+
+// fluentChunkLen is the length of the chunk ids, 16 random bytes in base64.
+const fluentChunkLen = 24
+
+// fluentHeartbeatMisses is how many heartbeats in a row may go unanswered
+// before the connection is taken for dead.
+const fluentHeartbeatMisses = 3
+
+var errNoHeartbeat = errors.New("no heartbeat from the collector")
+
+// fluentReserved are the keys written for every record; fields using one of
+// these names are emitted with a "fields." prefix instead.
+var fluentReserved = map[string]bool{
+	"message": true, "level": true, "category": true, "source": true,
+}
+
+// FluentWriter sends records to fluentd or fluent-bit with the Forward
+// protocol.  It is a ConnWriter, and so reconnects, spools and speaks TLS
+// alike.  Records are batched by tag, the tag of a record being Project and
+// its category joined by a dot ("App-Api.db"), and each batch is sent as a
+// PackedForward message of [time, record] entries.  The time is an EventTime,
+// to the nanosecond; the record holds the message formatted by the layout
+// ("%M" by default), the level, the category, the source and the fields.
+//
+// While the connection is down the batches, not the records, are spooled:
+// SetSpool counts batches.
+//
+// With acks (SetAck) each batch carries a chunk id and the writer waits for
+// the collector to acknowledge it; a batch not acknowledged in time is spooled
+// and sent again over a new connection.  Delivery is at least once: the
+// collector does not recognise the batches it already has, so a batch whose
+// ack was lost is received twice.  With heartbeats (SetHeartbeat) the writer
+// checks over UDP that the collector is alive, and drops a connection that
+// may be half-open.
+type FluentWriter struct {
+	*ConnWriter
+
+	// Guarded by the lock of the ConnWriter
+	maxRecords int
+	maxBytes   int
+	maxWait    time.Duration
+	ackTimeout time.Duration
+	heartbeat  time.Duration
+	beating    bool
+
+	// The batches being collected, only used on the writer goroutine
+	batches map[string]*fluentBatch
+	tags    []string // in the order their batches started
+	records int
+	size    int
+	timer   *time.Timer
+	started time.Time
+}
+
+// fluentBatch holds the entries of a tag, each a msgpack [time, record].
+type fluentBatch struct {
+	entries []byte
+	count   int
+}
+
+// NewFluentWriter returns a FluentWriter sending to addr over network ("tcp"
+// or "unix"), without acks.
+func NewFluentWriter(network, addr string, level Level) *FluentWriter {
+	w := &FluentWriter{
+		ConnWriter: newConn(network, addr, "%M", level),
+		maxRecords: DefaultFluentBatchRecords,
+		maxBytes:   DefaultFluentBatchBytes,
+		maxWait:    DefaultFluentBatchWait,
+		ackTimeout: DefaultFluentAckTimeout,
+		batches:    make(map[string]*fluentBatch),
+	}
+	w.start(fmt.Sprintf("FluentWriter(%s %s)", network, addr), w.write, w.flushBatch, w.exit)
+	go w.retryLoop()
+	return w
+}
+
+// SetBatchLimits sets when a batch is sent: once it holds records records or
+// bytes bytes, or its first record has waited for wait.  0 disables a limit.
+func (w *FluentWriter) SetBatchLimits(records, bytes int, wait time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+	w.maxRecords, w.maxBytes, w.maxWait = records, bytes, wait
+}
+
+// SetAck makes the writer ask the collector to acknowledge every batch, and
+// wait up to timeout for it.  The batches are then sent one at a time.  It is
+// meant to be called before logging, as the spooled batches are sent as they
+// were built.
+func (w *FluentWriter) SetAck(enable bool, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultFluentAckTimeout
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.ackTimeout = timeout
+	if enable {
+		w.ack = w.waitAck
+	} else {
+		w.ack = nil
+	}
+}
+
+// SetHeartbeat sends a heartbeat to the collector every interval, over UDP to
+// the same address, as fluentd's in_forward expects.  When several heartbeats
+// in a row are not answered the connection is closed, so that records are not
+// written to a collector that went away without closing it.  0 stops the
+// heartbeats; they are only sent over tcp.
+func (w *FluentWriter) SetHeartbeat(interval time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+	w.heartbeat = interval
+	if interval > 0 && !w.beating && strings.HasPrefix(w.Net, "tcp") {
+		w.beating = true
+		go w.heartbeatLoop()
+	}
+}
+
+// Write sends p as the message of a record of its own.
+func (w *FluentWriter) Write(p []byte) (n int, err error) {
+	rec := &LogRecord{Level: INFO, Created: time.Now(), Message: strings.TrimRight(string(p), "\n")}
+	w.Lock()
+	defer w.Unlock()
+	batch := &fluentBatch{entries: w.entry(rec), count: 1}
+	if err := w.send(w.forward(fluentTag(rec), batch)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// write adds rec to the batch of its tag, sending the batches if they are
+// full.
+func (w *FluentWriter) write(rec *LogRecord) error {
+	w.Lock()
+	entry := w.entry(rec)
+	maxRecords, maxBytes, maxWait := w.maxRecords, w.maxBytes, w.maxWait
+	w.Unlock()
+
+	var err error
+	if maxBytes > 0 && w.records > 0 && w.size+len(entry) > maxBytes {
+		err = w.flushBatch()
+	}
+	if w.records == 0 {
+		w.started = time.Now()
+		if maxWait > 0 {
+			w.timer = time.AfterFunc(maxWait, func() {
+				_ = w.do(context.Background(), w.flushDue)
+			})
+		}
+	}
+	tag := fluentTag(rec)
+	batch, ok := w.batches[tag]
+	if !ok {
+		batch = &fluentBatch{}
+		w.batches[tag] = batch
+		w.tags = append(w.tags, tag)
+	}
+	batch.entries = append(batch.entries, entry...)
+	batch.count++
+	w.records++
+	w.size += len(entry)
+	if (maxRecords > 0 && w.records >= maxRecords) || (maxBytes > 0 && w.size >= maxBytes) {
+		if ferr := w.flushBatch(); err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// flushDue sends the batches if their first record has waited long enough.
+func (w *FluentWriter) flushDue() {
+	w.Lock()
+	maxWait := w.maxWait
+	w.Unlock()
+	if w.records > 0 && time.Since(w.started) >= maxWait {
+		if err := w.flushBatch(); err != nil && w.err == nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", w.name, err)
+			w.err = err
+		}
+	}
+}
+
+// flushBatch sends the batches collected so far, spooling those that cannot
+// be sent.
+func (w *FluentWriter) flushBatch() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.records == 0 {
+		return nil
+	}
+	w.Lock()
+	defer w.Unlock()
+	var err error
+	for _, tag := range w.tags {
+		batch := w.batches[tag]
+		if serr := w.send(w.forward(tag, batch)); serr != nil {
+			if serr == errSpoolFull {
+				// The spool counted the batch as one record dropped.
+				atomic.AddUint64(&w.dropped, uint64(batch.count-1))
+			}
+			if err == nil {
+				err = serr
+			}
+		}
+	}
+	w.batches = make(map[string]*fluentBatch)
+	w.tags, w.records, w.size = nil, 0, 0
+	return err
+}
+
+// fluentTag returns the tag of rec: Project and its category joined by a dot.
+func fluentTag(rec *LogRecord) string {
+	category := rec.Category
+	if category == "" {
+		category = "DEFAULT"
+	}
+	if Project == "" {
+		return category
+	}
+	return Project + "." + category
+}
+
+// entry encodes rec as a msgpack [time, record].  It is called holding the
+// lock of the ConnWriter.
+func (w *FluentWriter) entry(rec *LogRecord) []byte {
+	created := rec.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	category := rec.Category
+	if category == "" {
+		category = "DEFAULT"
+	}
+	n := 3 + len(rec.Fields)
+	if rec.Source != "" {
+		n++
+	}
+
+	b := appendMsgpackArray(make([]byte, 0, 128), 2)
+	b = appendMsgpackEventTime(b, created)
+	b = appendMsgpackMap(b, n)
+	b = appendMsgpackString(b, "message")
+	b = appendMsgpackString(b, strings.TrimRight(w.layout.Format(rec), "\r\n"))
+	b = appendMsgpackString(b, "level")
+	b = appendMsgpackString(b, rec.Level.String())
+	b = appendMsgpackString(b, "category")
+	b = appendMsgpackString(b, category)
+	if rec.Source != "" {
+		b = appendMsgpackString(b, "source")
+		b = appendMsgpackString(b, rec.Source)
+	}
+	for _, field := range rec.Fields {
+		key := field.Key
+		if fluentReserved[key] {
+			key = "fields." + key
+		}
+		b = appendMsgpackString(b, key)
+		b = appendMsgpackValue(b, field.Value)
+	}
+	return b
+}
+
+// forward builds the PackedForward message of a batch: [tag, entries,
+// option].  With acks the option ends with the chunk id, which waitAck reads
+// back from the end of the message.  It is called holding the lock of the
+// ConnWriter.
+func (w *FluentWriter) forward(tag string, batch *fluentBatch) []byte {
+	b := make([]byte, 0, len(tag)+len(batch.entries)+64)
+	b = appendMsgpackArray(b, 3)
+	b = appendMsgpackString(b, tag)
+	b = appendMsgpackBin(b, batch.entries)
+	if w.ack == nil {
+		b = appendMsgpackMap(b, 1)
+		b = appendMsgpackString(b, "size")
+		return appendMsgpackInt(b, int64(batch.count))
+	}
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	b = appendMsgpackMap(b, 2)
+	b = appendMsgpackString(b, "size")
+	b = appendMsgpackInt(b, int64(batch.count))
+	b = appendMsgpackString(b, "chunk")
+	return appendMsgpackString(b, base64.StdEncoding.EncodeToString(id[:]))
+}
+
+// waitAck reads the ack of msg from the connection.  It is called holding the
+// lock of the ConnWriter.
+func (w *FluentWriter) waitAck(msg []byte) error {
+	if len(msg) < fluentChunkLen {
+		return nil
+	}
+	chunk := string(msg[len(msg)-fluentChunkLen:])
+	conn, ok := w.writer.(net.Conn)
+	if !ok {
+		return nil
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(w.ackTimeout))
+	resp, err := readMsgpackStringMap(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("waiting for ack: %s", err)
+	}
+	if resp["ack"] != chunk {
+		return fmt.Errorf("ack %q for chunk %q", resp["ack"], chunk)
+	}
+	return nil
+}
+
+// heartbeatLoop sends the heartbeats until the writer is closed or they are
+// stopped, closing the connection when they go unanswered.
+func (w *FluentWriter) heartbeatLoop() {
+	defer recoverPanic()
+	last, lost := time.Now(), false
+	for {
+		w.Lock()
+		interval := w.heartbeat
+		if interval <= 0 {
+			w.beating = false
+		}
+		w.Unlock()
+		if interval <= 0 {
+			return
+		}
+
+		select {
+		case <-w.done:
+			return
+		case <-time.After(interval):
+		}
+		if w.beat(interval) {
+			last, lost = time.Now(), false
+			continue
+		}
+		if !lost && time.Since(last) >= fluentHeartbeatMisses*interval {
+			lost = true
+			_ = w.do(context.Background(), func() {
+				w.Lock()
+				defer w.Unlock()
+				if w.writer != nil {
+					w.fail(errNoHeartbeat)
+				}
+			})
+		}
+	}
+}
+
+// beat sends a heartbeat and reports whether it was answered within timeout.
+func (w *FluentWriter) beat(timeout time.Duration) bool {
+	conn, err := net.DialTimeout("udp", w.Addr, timeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return false
+	}
+	var buf [16]byte
+	_, err = conn.Read(buf[:])
+	return err == nil
+}
+
+// exit sends the last batches when the writer is closed, then closes the
+// connection.
+func (w *FluentWriter) exit() {
+	if err := w.flushBatch(); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", w.name, err)
+	}
+	w.disconnect()
+}
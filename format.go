@@ -8,6 +8,8 @@ import (
 	"io"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type formatCacheType struct {
@@ -16,7 +18,9 @@ type formatCacheType struct {
 	longTime, longDate   string
 }
 
-var formatCache = &formatCacheType{}
+// formatCache holds the *formatCacheType of the last second formatted; it is
+// shared by every writer goroutine.
+var formatCache atomic.Value
 
 // Known format codes:
 // %A - Time (2006-01-02T15:04:05.000Z)  means all
@@ -27,6 +31,9 @@ var formatCache = &formatCacheType{}
 // %L - Level (FNST, FINE, DEBG, TRAC, WARN, EROR, CRIT)
 // %S - Source
 // %M - Message
+// %C - Category
+// %P - Project
+// %X - Fields, each rendered as " key=value" (nothing when there are none)
 // Ignores unknown formats
 // Recommended: "[%D %T] [%L] (%S) %M"
 func FormatLogRecord(format string, rec *LogRecord) string {
@@ -40,8 +47,8 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 	out := bytes.NewBuffer(make([]byte, 0, 64))
 	secs := rec.Created.UnixNano() / 1e9
 
-	cache := *formatCache
-	if cache.LastUpdateSeconds != secs {
+	cache, _ := formatCache.Load().(*formatCacheType)
+	if cache == nil || cache.LastUpdateSeconds != secs {
 		month, day, year := rec.Created.Month(), rec.Created.Day(), rec.Created.Year()
 		hour, minute, second := rec.Created.Hour(), rec.Created.Minute(), rec.Created.Second()
 		updated := &formatCacheType{
@@ -51,8 +58,8 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 			longTime:          fmt.Sprintf("%02d:%02d:%02d", hour, minute, second),
 			longDate:          fmt.Sprintf("%04d-%02d-%02d", year, month, day),
 		}
-		cache = *updated
-		formatCache = updated
+		cache = updated
+		formatCache.Store(updated)
 
 	}
 	//custom format datetime pattern %D{2006-01-02T15:04:05}
@@ -88,11 +95,14 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 				out.WriteString(rec.Message)
 			case 'C':
 				if len(rec.Category) == 0 {
-					rec.Category = "DEFAULT"
+					out.WriteString("DEFAULT")
+				} else {
+					out.WriteString(rec.Category)
 				}
-				out.WriteString(rec.Category)
 			case 'P':
 				out.WriteString(Project)
+			case 'X':
+				writeFields(out, rec.Fields)
 			}
 			if len(piece) > 1 {
 				out.Write(piece[1:])
@@ -106,33 +116,87 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 	return out.String()
 }
 
+// writeFields renders each field as " key=value", quoting values the same way
+// as LogfmtLayout so they stay unambiguous to a reader splitting on spaces.
+func writeFields(out *bytes.Buffer, fields Fields) {
+	for _, field := range fields {
+		out.WriteByte(' ')
+		writeLogfmtPair(out, field.Key, field.Value)
+	}
+}
+
+/****** Layout ******/
+
+// A Layout renders a LogRecord as a single newline-terminated entry.
+type Layout interface {
+	Format(rec *LogRecord) string
+}
+
+// PatternLayout is the %-pattern understood by FormatLogRecord.
+type PatternLayout string
+
+// Format implements Layout.
+func (p PatternLayout) Format(rec *LogRecord) string {
+	return FormatLogRecord(string(p), rec)
+}
+
 // This is the standard writer that prints to standard output.
-type FormatLogWriter chan *LogRecord
+type FormatLogWriter struct {
+	out    io.Writer
+	mu     sync.Mutex // guards layout
+	layout Layout
+	*recordQueue
+}
 
 // This creates a new FormatLogWriter
-func NewFormatLogWriter(out io.Writer, format string) FormatLogWriter {
-	records := make(FormatLogWriter, LogBufferLength)
-	go records.run(out, format)
-	return records
+func NewFormatLogWriter(out io.Writer, format string) *FormatLogWriter {
+	return NewLayoutLogWriter(out, PatternLayout(format))
 }
 
-func (w FormatLogWriter) run(out io.Writer, format string) {
-	defer recoverPanic()
-	for rec := range w {
-		fmt.Fprint(out, FormatLogRecord(format, rec))
+// NewLayoutLogWriter creates a FormatLogWriter rendering records with layout.
+// If out has a Flush method (e.g. a *bufio.Writer), it is called on Flush.
+func NewLayoutLogWriter(out io.Writer, layout Layout) *FormatLogWriter {
+	w := &FormatLogWriter{
+		out:         out,
+		layout:      layout,
+		recordQueue: newRecordQueue(),
 	}
+	var flush func() error
+	if f, ok := out.(interface{ Flush() error }); ok {
+		flush = f.Flush
+	}
+	w.start("FormatLogWriter", w.write, flush, nil)
+	return w
+}
+
+func (w *FormatLogWriter) write(rec *LogRecord) error {
+	w.mu.Lock()
+	layout := w.layout
+	w.mu.Unlock()
+	_, err := fmt.Fprint(w.out, layout.Format(rec))
+	return err
+}
+
+// Close stops the logger from sending messages to out, once the messages
+// already queued have been written.  Attempts to send log messages to this
+// logger after a Close have undefined behavior.
+func (w *FormatLogWriter) Close() {
+	w.recordQueue.Close()
 }
 
-// This is the FormatLogWriter's output method.  This will block if the output
-// buffer is full.
-func (w FormatLogWriter) LogWrite(rec *LogRecord) {
-	w <- rec
+func (w *FormatLogWriter) SetFormat(format string) {
+	w.SetLayout(PatternLayout(format))
 }
 
-// Close stops the logger from sending messages to standard output.  Attempts to
-// send log messages to this logger after a Close have undefined behavior.
-func (w FormatLogWriter) Close() {
-	close(w)
+// SetLayout replaces the %-pattern with an arbitrary Layout, e.g. JSONLayout{}.
+func (w *FormatLogWriter) SetLayout(layout Layout) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.layout = layout
+}
+
+func (w *FormatLogWriter) Write(p []byte) (n int, err error) {
+	return w.out.Write(p)
 }
 
 func changeDttmFormat(format string, rec *LogRecord) []byte {
@@ -152,3 +216,12 @@ func changeDttmFormat(format string, rec *LogRecord) []byte {
 	})
 	return formatByte
 }
+
+// splitSource splits the source of a record, "function:line", into the
+// function and the line; line is empty if there is none.
+func splitSource(source string) (function, line string) {
+	if i := strings.LastIndexByte(source, ':'); i >= 0 && isDigits(source[i+1:]) {
+		return source[:i], source[i+1:]
+	}
+	return source, ""
+}
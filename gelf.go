@@ -0,0 +1,239 @@
+package logs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// GELFCompression is the compression of the GELF messages sent over UDP.
+type GELFCompression string
+
+const (
+	GELFGzip GELFCompression = "gzip"
+	GELFZlib GELFCompression = "zlib"
+	GELFNone GELFCompression = "none"
+)
+
+// ParseGELFCompression maps "gzip" (or ""), "zlib" and "none" to a
+// GELFCompression.
+func ParseGELFCompression(s string) (GELFCompression, error) {
+	switch c := GELFCompression(strings.ToLower(strings.TrimSpace(s))); c {
+	case "":
+		return GELFGzip, nil
+	case GELFGzip, GELFZlib, GELFNone:
+		return c, nil
+	}
+	return GELFGzip, fmt.Errorf("unknown GELF compression %q", s)
+}
+
+// Chunking of GELF over UDP: a message larger than the chunk size is sent as
+// up to gelfMaxChunks datagrams, each starting with a header of the magic
+// bytes, the message id, the sequence number and the sequence count.
+const (
+	DefaultGELFChunkSize = 1420 // fits the MTU of most networks
+	gelfChunkHeader      = 12
+	gelfMaxChunks        = 128
+)
+
+// gelfReserved are the additional fields written for every record; fields
+// using one of these names are emitted with a "fields." prefix instead.
+var gelfReserved = map[string]bool{
+	"id": true, "category": true, "project": true, "file": true, "line": true,
+}
+
+// GELFWriter sends records to Graylog in GELF 1.1.  It is a ConnWriter, and
+// so reconnects, spools and speaks TLS alike.  Over udp each message is
+// compressed and, if larger than the chunk size, chunked; over tcp each
+// message is uncompressed and terminated by a null byte.
+//
+// The level is sent as a syslog severity; the category, project, source
+// function ("_file") and line, and the fields of the record are sent as
+// additional fields.
+type GELFWriter struct {
+	*ConnWriter
+	host        string
+	compression GELFCompression
+	chunkSize   int
+}
+
+// NewGELFWriter returns a GELFWriter sending to addr over network ("udp" or
+// "tcp"), gzipping the messages sent over udp.
+func NewGELFWriter(network, addr string, level Level) *GELFWriter {
+	w := &GELFWriter{
+		ConnWriter:  newConn(network, addr, "%M", level),
+		compression: GELFGzip,
+		chunkSize:   DefaultGELFChunkSize,
+	}
+	w.host, _ = os.Hostname()
+	w.encode = w.message
+	if !w.streaming() {
+		w.split = w.chunks
+	}
+	w.start(fmt.Sprintf("GELFWriter(%s %s)", network, addr), w.write, nil, w.disconnect)
+	go w.retryLoop()
+	return w
+}
+
+// SetCompression sets the compression of the messages sent over udp.
+func (w *GELFWriter) SetCompression(compression GELFCompression) {
+	w.Lock()
+	defer w.Unlock()
+	w.compression = compression
+}
+
+// SetChunkSize sets the size of the datagrams sent over udp, headers
+// included.  Messages larger than gelfMaxChunks chunks are dropped.
+func (w *GELFWriter) SetChunkSize(size int) {
+	if size <= gelfChunkHeader {
+		size = DefaultGELFChunkSize
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.chunkSize = size
+}
+
+// SetHost sets the host of the messages; the empty name stands for
+// os.Hostname().
+func (w *GELFWriter) SetHost(name string) {
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.host = name
+}
+
+func (w *GELFWriter) streaming() bool {
+	return strings.HasPrefix(w.Net, "tcp") || w.Net == "unix"
+}
+
+// message builds the GELF message of rec, framed or compressed for the
+// network.  It returns nil if the message does not fit in gelfMaxChunks
+// chunks.  It is called holding the lock of the ConnWriter.
+func (w *GELFWriter) message(rec *LogRecord) []byte {
+	created := rec.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	short, full := rec.Message, ""
+	if i := strings.IndexByte(short, '\n'); i >= 0 {
+		short, full = short[:i], rec.Message
+	}
+	if short == "" {
+		// Graylog rejects an empty short_message.
+		short = "-"
+	}
+	category := rec.Category
+	if category == "" {
+		category = "DEFAULT"
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, 256))
+	out.WriteString(`{"version":"1.1","host":`)
+	writeJSONString(out, w.host)
+	out.WriteString(`,"short_message":`)
+	writeJSONString(out, short)
+	if full != "" {
+		out.WriteString(`,"full_message":`)
+		writeJSONString(out, full)
+	}
+	fmt.Fprintf(out, `,"timestamp":%d.%06d,"level":%d`, created.Unix(), created.Nanosecond()/1000, syslogSeverity(rec.Level))
+	out.WriteString(`,"_category":`)
+	writeJSONString(out, category)
+	out.WriteString(`,"_project":`)
+	writeJSONString(out, Project)
+	if rec.Source != "" {
+		file, line := splitSource(rec.Source)
+		out.WriteString(`,"_file":`)
+		writeJSONString(out, file)
+		if line != "" {
+			out.WriteString(`,"_line":`)
+			out.WriteString(line)
+		}
+	}
+	for _, field := range rec.Fields {
+		key := gelfFieldName(field.Key)
+		if gelfReserved[key] {
+			key = "fields." + key
+		}
+		out.WriteString(`,"_`)
+		out.WriteString(key)
+		out.WriteString(`":`)
+		writeJSONValue(out, field.Value)
+	}
+	out.WriteByte('}')
+
+	if w.streaming() {
+		out.WriteByte(0)
+		return out.Bytes()
+	}
+	msg := w.compress(out.Bytes())
+	if len(msg) > gelfMaxChunks*(w.chunkSize-gelfChunkHeader) {
+		return nil
+	}
+	return msg
+}
+
+// compress returns msg compressed as set by SetCompression.
+func (w *GELFWriter) compress(msg []byte) []byte {
+	var buf bytes.Buffer
+	switch w.compression {
+	case GELFGzip:
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(msg)
+		_ = zw.Close()
+	case GELFZlib:
+		zw := zlib.NewWriter(&buf)
+		_, _ = zw.Write(msg)
+		_ = zw.Close()
+	default:
+		return msg
+	}
+	return buf.Bytes()
+}
+
+// chunks splits msg into the datagrams to send.
+func (w *GELFWriter) chunks(msg []byte) [][]byte {
+	if len(msg) <= w.chunkSize {
+		return [][]byte{msg}
+	}
+	size := w.chunkSize - gelfChunkHeader
+	count := (len(msg) + size - 1) / size
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+
+	chunks := make([][]byte, 0, count)
+	for seq := 0; seq < count; seq++ {
+		data := msg[seq*size:]
+		if len(data) > size {
+			data = data[:size]
+		}
+		chunk := make([]byte, 0, gelfChunkHeader+len(data))
+		chunk = append(chunk, 0x1e, 0x0f)
+		chunk = append(chunk, id[:]...)
+		chunk = append(chunk, byte(seq), byte(count))
+		chunks = append(chunks, append(chunk, data...))
+	}
+	return chunks
+}
+
+// gelfFieldName returns key with the characters GELF does not allow in the
+// name of a field replaced by '_'.
+func gelfFieldName(key string) string {
+	if key == "" {
+		return "_"
+	}
+	b := []byte(key)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
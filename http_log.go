@@ -0,0 +1,515 @@
+package logs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPBatchFormat is how an HTTPWriter puts the records of a batch in the body
+// of a request.
+type HTTPBatchFormat int
+
+const (
+	// HTTPBatchJSON sends a JSON array of the records.  This is the default.
+	HTTPBatchJSON HTTPBatchFormat = iota
+	// HTTPBatchNDJSON sends the records one per line (newline-delimited JSON).
+	HTTPBatchNDJSON
+)
+
+// ParseHTTPBatchFormat maps "json" (or "") and "ndjson" to an HTTPBatchFormat.
+func ParseHTTPBatchFormat(s string) (HTTPBatchFormat, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "json":
+		return HTTPBatchJSON, nil
+	case "ndjson", "jsonl":
+		return HTTPBatchNDJSON, nil
+	}
+	return HTTPBatchJSON, fmt.Errorf("unknown batch format %q", s)
+}
+
+// Defaults of a new HTTPWriter, see SetBatchLimits, SetRetries,
+// SetRetryAfterLimit and SetTimeout.
+const (
+	DefaultHTTPBatchRecords    = 500
+	DefaultHTTPBatchBytes      = 1 << 20
+	DefaultHTTPBatchWait       = time.Second
+	DefaultHTTPRetries         = 5
+	DefaultHTTPBackoffMin      = 500 * time.Millisecond
+	DefaultHTTPBackoffMax      = 30 * time.Second
+	DefaultHTTPRetryAfterLimit = 5 * time.Minute
+	DefaultHTTPTimeout         = 10 * time.Second
+)
+
+// A DeliveryError reports a batch that an HTTPWriter gave up sending.
+type DeliveryError struct {
+	Records    int   // records in the batch
+	StatusCode int   // of the last response, 0 if there was none
+	Err        error // of the last attempt
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("%d records not delivered: %s", e.Records, e.Err)
+}
+
+// HTTPWriter POSTs records in batches to an HTTP collector.  A batch is sent
+// once it holds the maximum number of records or bytes, or once its first
+// record has waited the maximum latency; Flush and Close send it at once.
+//
+// Network errors and the responses 429 and 5xx are retried with exponential
+// backoff, waiting at least as long as a Retry-After header asks, even beyond
+// the maximum backoff.  A batch still failing after the last retry, asked to
+// wait longer than the Retry-After limit, or answered with another status, is
+// dropped: it is counted by Failed, passed to the error handler and reported
+// by the next Flush.  So is a batch waiting for a retry when the deadline of a
+// Flush or CloseContext passes.
+//
+// Each record is encoded by the layout, JSONLayout by default.  Sending is
+// done on the writer goroutine, so while the collector is slow the queue fills
+// up and its overflow policy applies.
+type HTTPWriter struct {
+	failed uint64 // records given up, atomic; first for alignment
+
+	*recordQueue
+	url    string
+	client *http.Client
+	Level  Level
+
+	mu         sync.Mutex // guards the settings below
+	layout     Layout
+	format     HTTPBatchFormat
+	gzip       bool
+	header     http.Header
+	maxRecords int
+	maxBytes   int
+	maxWait    time.Duration
+	retries    int
+	backoffMin time.Duration
+	backoffMax time.Duration
+	retryAfter time.Duration // limit on Retry-After
+	onError    func(*DeliveryError)
+
+	// For the writers speaking a protocol on top of HTTP: encode replaces the
+	// layout, marshal the batch format, and results picks out of a successful
+	// response the records to send again and the number rejected for good,
+	// with the error to report.
+	encode  func(rec *LogRecord) []byte
+	marshal func(batch [][]byte) (body []byte, contentType string)
+	results func(resp []byte, batch [][]byte) (retry [][]byte, rejected int, err error)
+
+	// The batch being collected, only used on the writer goroutine
+	batch     [][]byte
+	batchSize int
+	timer     *time.Timer
+	started   time.Time
+}
+
+// NewHTTPWriter returns an HTTPWriter posting JSON arrays of records to url.
+func NewHTTPWriter(url string, level Level) *HTTPWriter {
+	w := newHTTPWriter(url, level)
+	w.start(fmt.Sprintf("HTTPWriter(%s)", url), w.write, w.flushBatch, w.exit)
+	return w
+}
+
+// newHTTPWriter returns an HTTPWriter that is not started yet.
+func newHTTPWriter(url string, level Level) *HTTPWriter {
+	return &HTTPWriter{
+		recordQueue: newRecordQueue(),
+		url:         url,
+		client:      &http.Client{Timeout: DefaultHTTPTimeout},
+		Level:       level,
+		layout:      JSONLayout{},
+		header:      make(http.Header),
+		maxRecords:  DefaultHTTPBatchRecords,
+		maxBytes:    DefaultHTTPBatchBytes,
+		maxWait:     DefaultHTTPBatchWait,
+		retries:     DefaultHTTPRetries,
+		backoffMin:  DefaultHTTPBackoffMin,
+		backoffMax:  DefaultHTTPBackoffMax,
+		retryAfter:  DefaultHTTPRetryAfterLimit,
+	}
+}
+
+// SetFormat encodes each record with a %-pattern instead of JSONLayout; the
+// records are then best sent with HTTPBatchNDJSON.
+func (w *HTTPWriter) SetFormat(format string) {
+	w.SetLayout(PatternLayout(format))
+}
+
+// SetLayout sets the encoding of each record; with HTTPBatchJSON it must
+// produce JSON.
+func (w *HTTPWriter) SetLayout(layout Layout) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.layout = layout
+}
+
+// SetBatchFormat sets how the records of a batch are put in the body.
+func (w *HTTPWriter) SetBatchFormat(format HTTPBatchFormat) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.format = format
+}
+
+// SetGzip makes the writer gzip the bodies of its requests.
+func (w *HTTPWriter) SetGzip(enable bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.gzip = enable
+}
+
+// SetHeader sets a header sent with every request; an empty value removes it.
+func (w *HTTPWriter) SetHeader(key, value string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if value == "" {
+		w.header.Del(key)
+	} else {
+		w.header.Set(key, value)
+	}
+}
+
+// SetAuthToken sends token as a bearer token with every request.
+func (w *HTTPWriter) SetAuthToken(token string) {
+	if token != "" {
+		token = "Bearer " + token
+	}
+	w.SetHeader("Authorization", token)
+}
+
+// SetBasicAuth authenticates the requests with a username and password.
+func (w *HTTPWriter) SetBasicAuth(username, password string) {
+	w.SetHeader("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+}
+
+// SetBatchLimits sets when a batch is sent: once it holds records records or
+// bytes bytes (encoded, before compression), or once its first record has
+// waited for wait.  0 disables a limit; a record larger than bytes is sent
+// alone.
+func (w *HTTPWriter) SetBatchLimits(records, bytes int, wait time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.maxRecords, w.maxBytes, w.maxWait = records, bytes, wait
+}
+
+// SetRetries sets how many times a failed batch is sent again, and the delays
+// in between: the first is min, each further one doubles up to max, and each
+// is shortened by a random part of up to half.
+func (w *HTTPWriter) SetRetries(retries int, min, max time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if max < min {
+		max = min
+	}
+	w.retries, w.backoffMin, w.backoffMax = retries, min, max
+}
+
+// SetRetryAfterLimit sets the longest wait a Retry-After header may ask for; a
+// batch asked to wait longer is given up at once.  0 is for no limit.
+func (w *HTTPWriter) SetRetryAfterLimit(limit time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.retryAfter = limit
+}
+
+// SetTimeout bounds each request, 0 for no limit.
+func (w *HTTPWriter) SetTimeout(timeout time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	client := *w.client
+	client.Timeout = timeout
+	w.client = &client
+}
+
+// SetClient replaces the http.Client sending the requests, e.g. to set up TLS
+// or a proxy.
+func (w *HTTPWriter) SetClient(client *http.Client) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.client = client
+}
+
+// SetErrorHandler sets a function called on the writer goroutine with each
+// batch given up.
+func (w *HTTPWriter) SetErrorHandler(handler func(*DeliveryError)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onError = handler
+}
+
+// Failed returns the number of records given up since the writer started.
+func (w *HTTPWriter) Failed() uint64 {
+	return atomic.LoadUint64(&w.failed)
+}
+
+// Write sends p as the message of an INFO record of its own, encoded like the
+// others, in a request of its own.  The records queued before are sent first.
+func (w *HTTPWriter) Write(p []byte) (n int, err error) {
+	rec := &LogRecord{Level: INFO, Created: time.Now(), Message: strings.TrimRight(string(p), "\n")}
+	reply := make(chan error, 1)
+	if err := w.do(context.Background(), func() {
+		failed, _, err := w.send([][]byte{w.encodeRecord(rec)})
+		if failed == 0 {
+			err = nil
+		}
+		reply <- err
+	}); err != nil {
+		return 0, err
+	}
+	if err := <-reply; err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// encodeRecord returns the message of rec, as the records are put in batches.
+func (w *HTTPWriter) encodeRecord(rec *LogRecord) []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.encode != nil {
+		return w.encode(rec)
+	}
+	return []byte(w.layout.Format(rec))
+}
+
+// write adds rec to the batch, sending the batch if it is full.
+func (w *HTTPWriter) write(rec *LogRecord) error {
+	msg := w.encodeRecord(rec)
+	w.mu.Lock()
+	maxRecords, maxBytes, maxWait := w.maxRecords, w.maxBytes, w.maxWait
+	w.mu.Unlock()
+
+	var err error
+	if maxBytes > 0 && len(w.batch) > 0 && w.batchSize+len(msg) > maxBytes {
+		err = w.flushBatch()
+	}
+	if len(w.batch) == 0 {
+		w.started = time.Now()
+		if maxWait > 0 {
+			w.timer = time.AfterFunc(maxWait, func() {
+				_ = w.do(context.Background(), w.flushDue)
+			})
+		}
+	}
+	w.batch = append(w.batch, msg)
+	w.batchSize += len(msg)
+	if (maxRecords > 0 && len(w.batch) >= maxRecords) || (maxBytes > 0 && w.batchSize >= maxBytes) {
+		if ferr := w.flushBatch(); err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// flushDue sends the batch if its first record has waited long enough.
+func (w *HTTPWriter) flushDue() {
+	w.mu.Lock()
+	maxWait := w.maxWait
+	w.mu.Unlock()
+	if len(w.batch) > 0 && time.Since(w.started) >= maxWait {
+		if err := w.flushBatch(); err != nil && w.err == nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", w.name, err)
+			w.err = err
+		}
+	}
+}
+
+// flushBatch sends the batch collected so far.
+func (w *HTTPWriter) flushBatch() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if len(w.batch) == 0 {
+		return nil
+	}
+	batch := w.batch
+	w.batch, w.batchSize = nil, 0
+
+	failed, status, err := w.send(batch)
+	if failed == 0 {
+		return nil
+	}
+	return w.giveUp(failed, status, err)
+}
+
+// giveUp counts records that could not be delivered and passes them to the
+// error handler, returning the error to report.
+func (w *HTTPWriter) giveUp(records, status int, err error) error {
+	atomic.AddUint64(&w.failed, uint64(records))
+	derr := &DeliveryError{Records: records, StatusCode: status, Err: err}
+	w.mu.Lock()
+	onError := w.onError
+	w.mu.Unlock()
+	if onError != nil {
+		onError(derr)
+	}
+	return derr
+}
+
+// body puts the encoded records of a batch together, returning the content
+// type of the result.
+func (w *HTTPWriter) body(batch [][]byte, format HTTPBatchFormat) ([]byte, string) {
+	var buf bytes.Buffer
+	if format == HTTPBatchNDJSON {
+		for _, msg := range batch {
+			buf.Write(bytes.TrimRight(msg, "\r\n"))
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), "application/x-ndjson"
+	}
+	buf.WriteByte('[')
+	for i, msg := range batch {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(bytes.TrimRight(msg, "\r\n"))
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), "application/json"
+}
+
+// send posts batch, retrying as set by SetRetries.  It returns the number of
+// records given up, with the status of the last response and the error that
+// made them fail.
+func (w *HTTPWriter) send(batch [][]byte) (failed, status int, err error) {
+	w.mu.Lock()
+	retries, min, max, limit := w.retries, w.backoffMin, w.backoffMax, w.retryAfter
+	format, compress, marshal, results := w.format, w.gzip, w.marshal, w.results
+	w.mu.Unlock()
+
+	var lastErr error
+	delay := min
+	for attempt := 0; ; attempt++ {
+		var body []byte
+		var contentType string
+		if marshal != nil {
+			body, contentType = marshal(batch)
+		} else {
+			body, contentType = w.body(batch, format)
+		}
+		if compress {
+			body = gzipBytes(body)
+		}
+		var retryAfter time.Duration
+		var resp []byte
+		status, retryAfter, resp, err = w.attempt(body, contentType, compress)
+		if err == nil && results != nil {
+			// Some records may have failed on their own.
+			var rejected int
+			var rerr error
+			batch, rejected, rerr = results(resp, batch)
+			if failed += rejected; rejected > 0 {
+				lastErr = rerr
+			}
+			err = rerr
+		} else if err == nil {
+			batch = nil
+		}
+		if len(batch) == 0 {
+			return failed, status, lastErr
+		}
+		if retryAfter < 0 || attempt >= retries {
+			return failed + len(batch), status, err
+		}
+		if limit > 0 && retryAfter > limit {
+			return failed + len(batch), status, fmt.Errorf("%s (Retry-After %s over the limit)", err, retryAfter)
+		}
+
+		wait := delay
+		if half := int64(wait / 2); half > 0 {
+			wait -= time.Duration(rand.Int63n(half))
+		}
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if !w.sleep(wait) {
+			return failed + len(batch), status, fmt.Errorf("%s (gave up waiting to retry)", err)
+		}
+		if delay *= 2; delay > max {
+			delay = max
+		}
+	}
+}
+
+// attempt sends body once.  It returns the status and body of the response
+// and, if the request may be retried, how long the collector asked to wait (0
+// if it did not say); retryAfter is negative if the request must not be
+// retried.
+func (w *HTTPWriter) attempt(body []byte, contentType string, compressed bool) (status int, retryAfter time.Duration, resp []byte, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, -1, nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	w.mu.Lock()
+	for key, values := range w.header {
+		req.Header[key] = values
+	}
+	client := w.client
+	w.mu.Unlock()
+
+	r, err := client.Do(req)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode >= 200 && r.StatusCode < 300 {
+		resp, err = ioutil.ReadAll(r.Body)
+		return r.StatusCode, 0, resp, err
+	}
+	text, _ := ioutil.ReadAll(io.LimitReader(r.Body, 512))
+	_, _ = io.Copy(ioutil.Discard, r.Body)
+	if r.StatusCode == http.StatusTooManyRequests || r.StatusCode >= 500 {
+		retryAfter = parseRetryAfter(r.Header.Get("Retry-After"), time.Now())
+	} else {
+		retryAfter = -1
+	}
+	return r.StatusCode, retryAfter, nil, fmt.Errorf("%s: %s", r.Status, strings.TrimSpace(string(text)))
+}
+
+// parseRetryAfter returns the delay asked for by a Retry-After header, in
+// seconds or as a date, 0 if there is none.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// gzipBytes returns data gzipped.
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write(data)
+	_ = zw.Close()
+	return buf.Bytes()
+}
+
+// exit sends the last batch when the writer is closed.
+func (w *HTTPWriter) exit() {
+	if err := w.flushBatch(); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", w.name, err)
+	}
+}
@@ -0,0 +1,182 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// JSONTimeFormat is the layout used for the "time" key of JSON records.
+const JSONTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// jsonReserved are the keys written for every record; fields using one of
+// these names are emitted with a "fields." prefix instead of clobbering them.
+var jsonReserved = map[string]bool{
+	"time": true, "level": true, "category": true,
+	"source": true, "message": true, "project": true,
+}
+
+// JSONLayout renders each record as a single JSON object followed by a newline
+// (JSON Lines), e.g.
+//
+//	{"time":"2020-03-20T14:34:31.717+08:00","level":"INFO","category":"Test",
+//	 "source":"main.main:12","message":"hello","project":"App-Api","user_id":42}
+//
+// Messages are escaped so that newlines, quotes and invalid UTF-8 never break a
+// record across lines.
+type JSONLayout struct{}
+
+// Format implements Layout.
+func (JSONLayout) Format(rec *LogRecord) string {
+	if rec == nil {
+		return "null\n"
+	}
+	out := bytes.NewBuffer(make([]byte, 0, 256))
+
+	category := rec.Category
+	if len(category) == 0 {
+		category = "DEFAULT"
+	}
+
+	out.WriteString(`{"time":`)
+	writeJSONString(out, rec.Created.Format(JSONTimeFormat))
+	out.WriteString(`,"level":`)
+	writeJSONString(out, rec.Level.String())
+	out.WriteString(`,"category":`)
+	writeJSONString(out, category)
+	out.WriteString(`,"source":`)
+	writeJSONString(out, rec.Source)
+	out.WriteString(`,"message":`)
+	writeJSONString(out, rec.Message)
+	out.WriteString(`,"project":`)
+	writeJSONString(out, Project)
+
+	for _, field := range rec.Fields {
+		key := field.Key
+		if jsonReserved[key] {
+			key = "fields." + key
+		}
+		out.WriteByte(',')
+		writeJSONString(out, key)
+		out.WriteByte(':')
+		writeJSONValue(out, field.Value)
+	}
+	out.WriteString("}\n")
+
+	return out.String()
+}
+
+// writeJSONValue writes v as a JSON value.  Errors and Stringers are written as
+// their text, and anything encoding/json rejects falls back to %v.
+func writeJSONValue(out *bytes.Buffer, v interface{}) {
+	switch value := v.(type) {
+	case nil:
+		out.WriteString("null")
+	case string:
+		writeJSONString(out, value)
+	case bool:
+		out.WriteString(strconv.FormatBool(value))
+	case int:
+		out.WriteString(strconv.FormatInt(int64(value), 10))
+	case int8:
+		out.WriteString(strconv.FormatInt(int64(value), 10))
+	case int16:
+		out.WriteString(strconv.FormatInt(int64(value), 10))
+	case int32:
+		out.WriteString(strconv.FormatInt(int64(value), 10))
+	case int64:
+		out.WriteString(strconv.FormatInt(value, 10))
+	case uint:
+		out.WriteString(strconv.FormatUint(uint64(value), 10))
+	case uint8:
+		out.WriteString(strconv.FormatUint(uint64(value), 10))
+	case uint16:
+		out.WriteString(strconv.FormatUint(uint64(value), 10))
+	case uint32:
+		out.WriteString(strconv.FormatUint(uint64(value), 10))
+	case uint64:
+		out.WriteString(strconv.FormatUint(value, 10))
+	case float32:
+		writeJSONFloat(out, float64(value), 32)
+	case float64:
+		writeJSONFloat(out, value, 64)
+	case error:
+		writeJSONString(out, value.Error())
+	case fmt.Stringer:
+		writeJSONString(out, value.String())
+	default:
+		b, err := json.Marshal(value)
+		if err != nil {
+			writeJSONString(out, fmt.Sprint(value))
+			return
+		}
+		out.Write(b)
+	}
+}
+
+func writeJSONFloat(out *bytes.Buffer, f float64, bits int) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		writeJSONString(out, strconv.FormatFloat(f, 'g', -1, bits))
+		return
+	}
+	out.WriteString(strconv.FormatFloat(f, 'g', -1, bits))
+}
+
+const hexDigits = "0123456789abcdef"
+
+// writeJSONString writes s as a quoted JSON string.  Control characters are
+// escaped and invalid UTF-8 is replaced with U+FFFD.
+func writeJSONString(out *bytes.Buffer, s string) {
+	out.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' {
+				i++
+				continue
+			}
+			out.WriteString(s[start:i])
+			switch b {
+			case '"', '\\':
+				out.WriteByte('\\')
+				out.WriteByte(b)
+			case '\n':
+				out.WriteString(`\n`)
+			case '\r':
+				out.WriteString(`\r`)
+			case '\t':
+				out.WriteString(`\t`)
+			default:
+				out.WriteString(`\u00`)
+				out.WriteByte(hexDigits[b>>4])
+				out.WriteByte(hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			out.WriteString(s[start:i])
+			out.WriteString(`\ufffd`)
+			i += size
+			start = i
+			continue
+		}
+		// U+2028 and U+2029 are valid JSON but break JavaScript line parsers.
+		if r == '\u2028' || r == '\u2029' {
+			out.WriteString(s[start:i])
+			out.WriteString(`\u202`)
+			out.WriteByte(hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	out.WriteString(s[start:])
+	out.WriteByte('"')
+}
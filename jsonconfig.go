@@ -1,14 +1,31 @@
 package logs
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/toolkits/file"
-	"os"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
 )
 
+// QueueConfig sizes the queue between the loggers and a writer and says what
+// happens when it is full.
+type QueueConfig struct {
+	Overflow        string `json:"overflow"`        // block (default), drop-newest, drop-oldest or block-timeout
+	OverflowTimeout string `json:"overflowTimeout"` // how long block-timeout waits, e.g. "100ms"
+	QueueSize       string `json:"queueSize"`       // \d+[KMG]? records, suffixes in thousands; "0" for no limit
+	QueueBytes      string `json:"queueBytes"`      // \d+[KMG]? bytes, suffixes in 2**10; empty for no limit
+}
+
 type ConsoleConfig struct {
-	Enable bool   `json:"enable"`
-	Level  string `json:"level"`
+	Enable  bool   `json:"enable"`
+	Level   string `json:"level"`
+	Pattern string `json:"pattern"`
+	Format  string `json:"format"` // "json", "logfmt" or empty for Pattern
+	QueueConfig
 }
 
 type FileConfig struct {
@@ -25,15 +42,37 @@ type FileConfig struct {
 	// %S - Source
 	// %M - Message
 	// %C - Category
+	// %X - Fields
 	// It ignores unknown format strings (and removes them)
 	// Recommended: "[%D %T] [%C] [%L] (%S) %M"//
 	Pattern string `json:"pattern"`
+	Format  string `json:"format"` // "json", "logfmt" or empty for Pattern
 
 	Rotate   bool   `json:"rotate"`
 	Maxsize  string `json:"maxsize"`  // \d+[KMG]? Suffixes are in terms of 2**10
 	MaxLines string `json:"MaxLines"` //\d+[KMG]? Suffixes are in terms of thousands
 	Daily    bool   `json:"daily"`    //Automatically rotates by day
 	Sanitize bool   `json:"sanitize"` //Sanitize newlines to prevent log injection
+	Compress bool   `json:"compress"` //Gzip rotated files in the background
+
+	// Time-based rotation, see ParseSchedule: "@hourly", "@every 6h", "0 4 * * *"...
+	Schedule     string `json:"schedule"`
+	Timezone     string `json:"timezone"`     // of the schedule, e.g. "UTC"; local time if empty
+	Boundary     string `json:"boundary"`     // offset of @hourly, @daily, @weekly and @every, e.g. "4h"
+	NameTemplate string `json:"nameTemplate"` // backup names, e.g. "app-%Y%m%d%H.log"
+
+	ReopenCheck  string `json:"reopenCheck"`  // how often to look for the file being moved or removed, e.g. "10s"
+	CopyTruncate bool   `json:"copyTruncate"` // also notice the file being truncated in place
+	MultiProcess bool   `json:"multiProcess"` // the file is shared with other processes, see OpenSharedFileLogWriter
+
+	MaxAge       string `json:"maxAge"`       // remove backups older than this, e.g. "72h" or "30d"
+	MaxBackups   int    `json:"maxBackups"`   // keep at most this many backups
+	MaxTotalSize string `json:"maxTotalSize"` // \d+[KMG]? total size of the backups kept, suffixes in 2**10
+	QueueConfig
+
+	// Additivity controls whether records also reach the filters of the
+	// parent categories and the console.  Defaults to true.
+	Additivity *bool `json:"additivity"`
 }
 
 type SocketConfig struct {
@@ -41,38 +80,984 @@ type SocketConfig struct {
 	Category string `json:"category"`
 	Level    string `json:"level"`
 	Pattern  string `json:"pattern"`
+	Format   string `json:"format"` // "json", "logfmt", "gelf" (see GELFWriter) or empty for Pattern
 
 	Addr     string `json:"addr"`
-	Protocol string `json:"protocol"`
+	Protocol string `json:"protocol"` // tcp (udp for gelf), udp, unix..., or tcp+tls
+	QueueConfig
+	ConnConfig
+
+	Compression string `json:"compression"` // of gelf over udp: gzip (default), zlib or none
+	ChunkSize   int    `json:"chunkSize"`   // of gelf over udp, DefaultGELFChunkSize if 0
+
+	Additivity *bool `json:"additivity"` // see FileConfig
+}
+
+// ConnConfig holds the connection settings shared by the writers sending to a
+// collector over the network.
+type ConnConfig struct {
+	// TLS settings of the tcp+tls protocol
+	TLS *TLSConfig `json:"tls"`
+
+	// While the collector is down, see ConnWriter
+	BackoffMin    string `json:"backoffMin"`    // first delay before reconnecting, e.g. "100ms"
+	BackoffMax    string `json:"backoffMax"`    // longest delay before reconnecting, e.g. "30s"
+	Timeout       string `json:"timeout"`       // deadline of connecting and of each write, "0" for none
+	SpoolSize     string `json:"spoolSize"`     // \d+[KMG]? records kept in memory, suffixes in thousands
+	SpoolDir      string `json:"spoolDir"`      // directory of the spool file, none if empty
+	SpoolMaxBytes string `json:"spoolMaxBytes"` // \d+[KMG]? size limit of the spool file, suffixes in 2**10
+}
+
+// FilterConfig holds the settings of the filter around a writer, shared by
+// the writers registered under a category.
+type FilterConfig struct {
+	Enable   bool   `json:"enable"`
+	Category string `json:"category"`
+	Level    string `json:"level"`
+	Pattern  string `json:"pattern"`
+	Format   string `json:"format"` // "json", "logfmt" or empty for Pattern, unless noted otherwise
+
+	Additivity *bool `json:"additivity"` // see FileConfig
+}
+
+// SyslogConfig configures a SyslogWriter.  Pattern formats the message part,
+// "%M%X" if empty.
+type SyslogConfig struct {
+	FilterConfig
+
+	Addr     string `json:"addr"`     // e.g. "127.0.0.1:514" or "/dev/log"
+	Protocol string `json:"protocol"` // udp (default), tcp, tcp+tls or unix
+	RFC      string `json:"rfc"`      // "5424" (default) or "3164"
+	Facility string `json:"facility"` // user (default), daemon, local0..., see ParseFacility
+	AppName  string `json:"appName"`  // Project if empty
+	Hostname string `json:"hostname"` // os.Hostname() if empty
+	QueueConfig
+	ConnConfig
+}
+
+// HTTPConfig configures an HTTPWriter.  Format is of each record: "json"
+// (default), "logfmt" or "pattern" for Pattern.
+type HTTPConfig struct {
+	FilterConfig
+
+	URL         string `json:"url"`
+	BatchFormat string `json:"batchFormat"` // "json" (an array, default) or "ndjson"
+	Token       string `json:"token"`       // sent as "Authorization: Bearer <token>"
+	BatchConfig
+	QueueConfig
+}
+
+// BatchConfig holds the settings shared by the writers posting batches of
+// records to an HTTP collector, see HTTPWriter.
+type BatchConfig struct {
+	Gzip    bool              `json:"gzip"`    // gzip the bodies
+	Headers map[string]string `json:"headers"` // sent with every request
+
+	BatchSize  string `json:"batchSize"`  // \d+[KMG]? records per batch, suffixes in thousands
+	BatchBytes string `json:"batchBytes"` // \d+[KMG]? bytes per batch, suffixes in 2**10
+	BatchWait  string `json:"batchWait"`  // longest wait of a record for its batch, e.g. "1s"
+
+	Retries    *int   `json:"retries"`    // DefaultHTTPRetries if omitted
+	BackoffMin string `json:"backoffMin"` // first delay before retrying, e.g. "500ms"
+	BackoffMax string `json:"backoffMax"` // longest delay before retrying, e.g. "30s"
+	Timeout    string `json:"timeout"`    // of each request, "0" for none
+
+	RetryAfterLimit string `json:"retryAfterLimit"` // longest Retry-After obeyed, e.g. "5m"; "0" for none
+}
+
+// ElasticsearchConfig configures an ElasticsearchWriter.  The documents are
+// not made by a layout: Pattern and Format must be empty.
+type ElasticsearchConfig struct {
+	FilterConfig
+
+	URL      string `json:"url"`      // of the cluster, e.g. "http://localhost:9200"
+	Index    string `json:"index"`    // e.g. "app-%Y.%m.%d", dated in UTC; "logs-" + Project if empty
+	Username string `json:"username"` // for basic authentication
+	Password string `json:"password"`
+	APIKey   string `json:"apiKey"` // base64 API key, instead of a username
+	BatchConfig
+	QueueConfig
+}
+
+// LokiConfig configures a LokiWriter.  Pattern formats the lines, "(%S) %M%X"
+// if empty.
+type LokiConfig struct {
+	FilterConfig
+
+	URL       string            `json:"url"`       // of Loki, e.g. "http://localhost:3100"
+	Encoding  string            `json:"encoding"`  // "protobuf" (default) or "json"
+	Labels    map[string]string `json:"labels"`    // added to every stream, e.g. {"env": "prod"}
+	LabelKeys []string          `json:"labelKeys"` // project, category, level or field keys; DefaultLokiLabels if omitted
+	Tenant    string            `json:"tenant"`    // X-Scope-OrgID of a multi-tenant Loki
+	Username  string            `json:"username"`  // for basic authentication
+	Password  string            `json:"password"`
+	BatchConfig
+	QueueConfig
+}
+
+// SplunkConfig configures a SplunkWriter.  Format is of the event bodies:
+// "json" (default), "logfmt" or "pattern" for Pattern.
+type SplunkConfig struct {
+	FilterConfig
+
+	URL        string `json:"url"`        // of the HTTP Event Collector, e.g. "https://splunk:8088"
+	Token      string `json:"token"`      // HEC token
+	Host       string `json:"host"`       // os.Hostname() if empty
+	Source     string `json:"source"`     // the function of each record if empty
+	SourceType string `json:"sourcetype"` // "_json" if empty
+	Index      string `json:"index"`      // the default index of the token if empty
+	Ack        bool   `json:"ack"`        // wait for indexer acknowledgement, which the token must enable
+	AckTimeout string `json:"ackTimeout"` // before sending a batch again, e.g. "30s"
+	BatchConfig
+	QueueConfig
+}
+
+// OTLPConfig configures an OTLPWriter.  Pattern formats the bodies, "%M" if
+// empty.
+type OTLPConfig struct {
+	FilterConfig
+
+	URL        string            `json:"url"`        // of the OTLP/HTTP endpoint, e.g. "http://localhost:4318"
+	Encoding   string            `json:"encoding"`   // "protobuf" (default) or "json"
+	Attributes map[string]string `json:"attributes"` // of the resource, besides service.name
+	BatchConfig
+	QueueConfig
+}
+
+// FluentConfig configures a FluentWriter.  Pattern formats the messages, "%M"
+// if empty.
+type FluentConfig struct {
+	FilterConfig
+
+	Addr       string `json:"addr"`       // e.g. "127.0.0.1:24224" or "/var/run/fluent.sock"
+	Protocol   string `json:"protocol"`   // tcp (default), tcp+tls or unix
+	BatchSize  string `json:"batchSize"`  // \d+[KMG]? records per batch, suffixes in thousands
+	BatchBytes string `json:"batchBytes"` // \d+[KMG]? bytes per batch, suffixes in 2**10
+	BatchWait  string `json:"batchWait"`  // longest wait of a record for its batch, e.g. "1s"
+	Ack        bool   `json:"ack"`        // wait for the collector to acknowledge each batch
+	AckTimeout string `json:"ackTimeout"` // before sending a batch again, e.g. "30s"
+	Heartbeat  string `json:"heartbeat"`  // interval of the heartbeats over udp, none if empty
+	QueueConfig
+	ConnConfig
 }
 
 // LogConfig presents json log config struct
 type LogConfig struct {
-	Console *ConsoleConfig  `json:"console"`
-	Files   []*FileConfig   `json:"files"`
-	Sockets []*SocketConfig `json:"sockets"`
+	Console       *ConsoleConfig         `json:"console"`
+	Files         []*FileConfig          `json:"files"`
+	Sockets       []*SocketConfig        `json:"sockets"`
+	Syslog        []*SyslogConfig        `json:"syslog"`
+	HTTP          []*HTTPConfig          `json:"http"`
+	Elasticsearch []*ElasticsearchConfig `json:"elasticsearch"`
+	Loki          []*LokiConfig          `json:"loki"`
+	Splunk        []*SplunkConfig        `json:"splunk"`
+	OTLP          []*OTLPConfig          `json:"otlp"`
+	Fluent        []*FluentConfig        `json:"fluent"`
 }
 
-func getLogLevel(l string) Level {
+// parseLogLevel maps a configured level name to a Level.  The log4go names
+// FINEST, FINE and CRITICAL are accepted as aliases.
+func parseLogLevel(l string) (Level, error) {
 	var lvl Level
-	switch l {
-	case "DEBUG":
+	switch strings.ToUpper(strings.TrimSpace(l)) {
+	case "DEBUG", "FINE":
 		lvl = DEBUG
-	case "TRACE":
+	case "TRACE", "FINEST":
 		lvl = TRACE
 	case "INFO":
 		lvl = INFO
-	case "WARNING":
+	case "WARN", "WARNING":
 		lvl = WARN
 	case "ERROR":
 		lvl = ERROR
-	case "FATAL":
+	case "FATAL", "CRITICAL":
 		lvl = FATAL
 	default:
-		_, _ = fmt.Fprintf(os.Stderr, "LoadJsonConfiguration: Error: Required level <%s> for filter has unknown value: %s\n", "level", l)
-		os.Exit(1)
+		return lvl, fmt.Errorf("required level <%s> for filter has unknown value: %s", "level", l)
+	}
+	return lvl, nil
+}
+
+// newLayout picks the Layout for a config entry: "json" and "logfmt" select
+// the structured encoders, anything else uses pattern (or fallback if empty).
+func newLayout(format, pattern, fallback string) (Layout, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "json":
+		return JSONLayout{}, nil
+	case "logfmt":
+		return LogfmtLayout{}, nil
+	case "", "pattern":
+		if pattern == "" {
+			pattern = fallback
+		}
+		return PatternLayout(pattern), nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// NewConsoleFilter builds the console Filter described by config.
+func NewConsoleFilter(config ConsoleConfig) (*Filter, error) {
+	lvl, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, fmt.Errorf("console: %s", err)
+	}
+	layout, err := newLayout(config.Format, config.Pattern, FORMAT)
+	if err != nil {
+		return nil, fmt.Errorf("console: %s", err)
+	}
+	applyQueue, err := queueSettings(config.QueueConfig)
+	if err != nil {
+		return nil, fmt.Errorf("console: %s", err)
+	}
+	clw := NewConsoleLogWriter()
+	clw.SetLayout(layout)
+	applyQueue(clw)
+	return &Filter{Level: lvl, LogWriter: clw, Category: "DEFAULT"}, nil
+}
+
+// NewFileFilter builds the file Filter described by config, opening (and
+// creating if needed) its file.
+func NewFileFilter(config FileConfig) (*Filter, error) {
+	lvl, apply, err := fileSettings(config)
+	if err != nil {
+		return nil, err
+	}
+	// Applied before opening, the settings decide whether the file left by an
+	// earlier process is rotated or appended to.
+	flw, err := openFileLogWriter(config.Filename, config.Rotate, config.Daily, config.MultiProcess, apply)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{Level: lvl, LogWriter: flw, Category: categoryOrDefault(config.Category), detached: !additive(config.Additivity)}, nil
+}
+
+// fileSettings validates config and returns its level together with a
+// function applying the rest of it to a FileLogWriter.
+func fileSettings(config FileConfig) (Level, func(*FileLogWriter), error) {
+	lvl, err := parseLogLevel(config.Level)
+	if err != nil {
+		return lvl, nil, fmt.Errorf("file %q: %s", config.Filename, err)
+	}
+	layout, err := newLayout(config.Format, config.Pattern, FORMAT)
+	if err != nil {
+		return lvl, nil, fmt.Errorf("file %q: %s", config.Filename, err)
+	}
+	maxsize, maxLines := 0, 0
+	if config.Maxsize != "" {
+		if maxsize, err = strToNumSuffix(config.Maxsize, 1024); err != nil {
+			return lvl, nil, fmt.Errorf("file %q: bad maxsize %q: %s", config.Filename, config.Maxsize, err)
+		}
+	}
+	if config.MaxLines != "" {
+		if maxLines, err = strToNumSuffix(config.MaxLines, 1000); err != nil {
+			return lvl, nil, fmt.Errorf("file %q: bad MaxLines %q: %s", config.Filename, config.MaxLines, err)
+		}
+	}
+	var maxAge time.Duration
+	if config.MaxAge != "" {
+		if maxAge, err = strToDuration(config.MaxAge); err != nil {
+			return lvl, nil, fmt.Errorf("file %q: bad maxAge %q: %s", config.Filename, config.MaxAge, err)
+		}
+	}
+	maxTotalSize := 0
+	if config.MaxTotalSize != "" {
+		if maxTotalSize, err = strToNumSuffix(config.MaxTotalSize, 1024); err != nil {
+			return lvl, nil, fmt.Errorf("file %q: bad maxTotalSize %q: %s", config.Filename, config.MaxTotalSize, err)
+		}
+	}
+	if config.Filename == "" {
+		return lvl, nil, errors.New("file: filename is required")
+	}
+	schedule, err := rotationSchedule(config)
+	if err != nil {
+		return lvl, nil, fmt.Errorf("file %q: %s", config.Filename, err)
+	}
+	if config.NameTemplate != "" {
+		if _, err := parseNameTemplate(config.NameTemplate); err != nil {
+			return lvl, nil, fmt.Errorf("file %q: %s", config.Filename, err)
+		}
+	}
+	var reopenCheck time.Duration
+	if config.ReopenCheck != "" {
+		if reopenCheck, err = strToDuration(config.ReopenCheck); err != nil {
+			return lvl, nil, fmt.Errorf("file %q: bad reopenCheck %q: %s", config.Filename, config.ReopenCheck, err)
+		}
+	}
+	applyQueue, err := queueSettings(config.QueueConfig)
+	if err != nil {
+		return lvl, nil, fmt.Errorf("file %q: %s", config.Filename, err)
+	}
+
+	apply := func(w *FileLogWriter) {
+		applyQueue(w)
+		w.SetLayout(layout)
+		w.SetRotate(config.Rotate).SetRotateDaily(config.Daily)
+		if schedule != nil {
+			w.SetRotateSchedule(schedule)
+		}
+		_ = w.SetNameTemplate(config.NameTemplate)
+		w.SetReopenCheck(reopenCheck).SetCopyTruncate(config.CopyTruncate)
+		w.SetRotateSize(maxsize).SetRotateLines(maxLines).SetSanitize(config.Sanitize)
+		w.SetRotateCompress(config.Compress)
+		w.SetRetention(maxAge, config.MaxBackups, int64(maxTotalSize))
+	}
+	return lvl, apply, nil
+}
+
+// rotationSchedule returns the time-based rotation schedule of config, nil if
+// there is none.
+func rotationSchedule(config FileConfig) (Schedule, error) {
+	if config.Schedule == "" {
+		if config.Timezone != "" || config.Boundary != "" {
+			return nil, errors.New("timezone and boundary need a schedule")
+		}
+		return nil, nil
+	}
+	loc := time.Local
+	if config.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(config.Timezone); err != nil {
+			return nil, fmt.Errorf("bad timezone %q: %s", config.Timezone, err)
+		}
+	}
+	schedule, err := ParseSchedule(config.Schedule, loc)
+	if err != nil || config.Boundary == "" {
+		return schedule, err
+	}
+	e, ok := schedule.(every)
+	if !ok {
+		return nil, fmt.Errorf("boundary %q does not apply to schedule %q", config.Boundary, config.Schedule)
+	}
+	offset, err := strToDuration(config.Boundary)
+	if err != nil {
+		return nil, fmt.Errorf("bad boundary %q: %s", config.Boundary, err)
+	}
+	return Every(e.interval, offset, loc)
+}
+
+// NewSocketFilter builds the socket Filter described by config.
+func NewSocketFilter(config SocketConfig) (*Filter, error) {
+	lvl, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, fmt.Errorf("socket %q: %s", config.Addr, err)
+	}
+	gelf := strings.EqualFold(strings.TrimSpace(config.Format), "gelf")
+	var layout Layout
+	if !gelf {
+		if layout, err = newLayout(config.Format, config.Pattern, FORMAT); err != nil {
+			return nil, fmt.Errorf("socket %q: %s", config.Addr, err)
+		}
+		if config.Compression != "" || config.ChunkSize != 0 {
+			return nil, fmt.Errorf("socket %q: compression and chunkSize need the gelf format", config.Addr)
+		}
+	}
+	if config.Addr == "" {
+		return nil, errors.New("socket: addr is required")
+	}
+	compression, err := ParseGELFCompression(config.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("socket %q: %s", config.Addr, err)
+	}
+	if config.ChunkSize < 0 || config.ChunkSize > 0 && config.ChunkSize <= gelfChunkHeader {
+		return nil, fmt.Errorf("socket %q: bad chunkSize %d", config.Addr, config.ChunkSize)
+	}
+	defaultProtocol := "tcp"
+	if gelf {
+		defaultProtocol = "udp"
+	}
+	network, applyConn, err := connSettings(config.Protocol, defaultProtocol, config.ConnConfig)
+	if err != nil {
+		return nil, fmt.Errorf("socket %q: %s", config.Addr, err)
+	}
+	applyQueue, err := queueSettings(config.QueueConfig)
+	if err != nil {
+		return nil, fmt.Errorf("socket %q: %s", config.Addr, err)
+	}
+
+	var writer LogWriter
+	var clw *ConnWriter
+	if gelf {
+		gw := NewGELFWriter(network, config.Addr, lvl)
+		gw.SetCompression(compression)
+		gw.SetChunkSize(config.ChunkSize)
+		writer, clw = gw, gw.ConnWriter
+	} else {
+		clw = NewConn(network, config.Addr, "", lvl)
+		clw.SetLayout(layout)
+		writer = clw
+	}
+	if err := applyConn(clw); err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("socket %q: %s", config.Addr, err)
+	}
+	applyQueue(clw)
+	return &Filter{Level: lvl, LogWriter: writer, Category: categoryOrDefault(config.Category), detached: !additive(config.Additivity)}, nil
+}
+
+// NewSyslogFilter builds the syslog Filter described by config.
+func NewSyslogFilter(config SyslogConfig) (*Filter, error) {
+	lvl, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, fmt.Errorf("syslog %q: %s", config.Addr, err)
+	}
+	layout, err := newLayout(config.Format, config.Pattern, "%M%X")
+	if err != nil {
+		return nil, fmt.Errorf("syslog %q: %s", config.Addr, err)
+	}
+	if config.Addr == "" {
+		return nil, errors.New("syslog: addr is required")
+	}
+	rfc, err := ParseSyslogFormat(config.RFC)
+	if err != nil {
+		return nil, fmt.Errorf("syslog %q: %s", config.Addr, err)
+	}
+	facility, err := ParseFacility(config.Facility)
+	if err != nil {
+		return nil, fmt.Errorf("syslog %q: %s", config.Addr, err)
+	}
+	protocol := config.Protocol
+	if protocol == "unix" {
+		// Local syslog daemons listen on datagram sockets such as /dev/log.
+		protocol = "unixgram"
+	}
+	network, applyConn, err := connSettings(protocol, "udp", config.ConnConfig)
+	if err != nil {
+		return nil, fmt.Errorf("syslog %q: %s", config.Addr, err)
+	}
+	applyQueue, err := queueSettings(config.QueueConfig)
+	if err != nil {
+		return nil, fmt.Errorf("syslog %q: %s", config.Addr, err)
+	}
+
+	sw := NewSyslogWriter(network, config.Addr, lvl)
+	if err := applyConn(sw.ConnWriter); err != nil {
+		sw.Close()
+		return nil, fmt.Errorf("syslog %q: %s", config.Addr, err)
+	}
+	sw.SetLayout(layout)
+	sw.SetSyslogFormat(rfc)
+	sw.SetFacility(facility)
+	sw.SetAppName(config.AppName)
+	sw.SetHostname(config.Hostname)
+	applyQueue(sw)
+	return &Filter{Level: lvl, LogWriter: sw, Category: categoryOrDefault(config.Category), detached: !additive(config.Additivity)}, nil
+}
+
+// NewHTTPFilter builds the HTTP Filter described by config.
+func NewHTTPFilter(config HTTPConfig) (*Filter, error) {
+	lvl, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, fmt.Errorf("http %q: %s", config.URL, err)
+	}
+	format := config.Format
+	if format == "" {
+		format = "json"
+	}
+	layout, err := newLayout(format, config.Pattern, FORMAT)
+	if err != nil {
+		return nil, fmt.Errorf("http %q: %s", config.URL, err)
+	}
+	if config.URL == "" {
+		return nil, errors.New("http: url is required")
+	}
+	batchFormat, err := ParseHTTPBatchFormat(config.BatchFormat)
+	if err != nil {
+		return nil, fmt.Errorf("http %q: %s", config.URL, err)
+	}
+	applyBatch, err := batchSettings(config.BatchConfig)
+	if err != nil {
+		return nil, fmt.Errorf("http %q: %s", config.URL, err)
+	}
+	applyQueue, err := queueSettings(config.QueueConfig)
+	if err != nil {
+		return nil, fmt.Errorf("http %q: %s", config.URL, err)
+	}
+
+	hw := NewHTTPWriter(config.URL, lvl)
+	hw.SetLayout(layout)
+	hw.SetBatchFormat(batchFormat)
+	if config.Token != "" {
+		hw.SetAuthToken(config.Token)
+	}
+	applyBatch(hw)
+	applyQueue(hw)
+	return &Filter{Level: lvl, LogWriter: hw, Category: categoryOrDefault(config.Category), detached: !additive(config.Additivity)}, nil
+}
+
+// NewElasticsearchFilter builds the Elasticsearch Filter described by config.
+func NewElasticsearchFilter(config ElasticsearchConfig) (*Filter, error) {
+	lvl, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch %q: %s", config.URL, err)
+	}
+	if config.URL == "" {
+		return nil, errors.New("elasticsearch: url is required")
+	}
+	if config.APIKey != "" && config.Username != "" {
+		return nil, fmt.Errorf("elasticsearch %q: apiKey and username are exclusive", config.URL)
+	}
+	if config.Pattern != "" || config.Format != "" {
+		return nil, fmt.Errorf("elasticsearch %q: pattern and format are not used", config.URL)
+	}
+	if _, err := parseIndexTemplate(config.Index); err != nil {
+		return nil, fmt.Errorf("elasticsearch %q: %s", config.URL, err)
+	}
+	applyBatch, err := batchSettings(config.BatchConfig)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch %q: %s", config.URL, err)
+	}
+	applyQueue, err := queueSettings(config.QueueConfig)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch %q: %s", config.URL, err)
+	}
+
+	ew := NewElasticsearchWriter(config.URL, lvl)
+	_ = ew.SetIndex(config.Index)
+	if config.Username != "" {
+		ew.SetBasicAuth(config.Username, config.Password)
+	}
+	if config.APIKey != "" {
+		ew.SetAPIKey(config.APIKey)
+	}
+	applyBatch(ew.HTTPWriter)
+	applyQueue(ew)
+	return &Filter{Level: lvl, LogWriter: ew, Category: categoryOrDefault(config.Category), detached: !additive(config.Additivity)}, nil
+}
+
+// NewLokiFilter builds the Loki Filter described by config.
+func NewLokiFilter(config LokiConfig) (*Filter, error) {
+	lvl, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, fmt.Errorf("loki %q: %s", config.URL, err)
+	}
+	layout, err := newLayout(config.Format, config.Pattern, "(%S) %M%X")
+	if err != nil {
+		return nil, fmt.Errorf("loki %q: %s", config.URL, err)
+	}
+	if config.URL == "" {
+		return nil, errors.New("loki: url is required")
+	}
+	encoding, err := ParseLokiEncoding(config.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("loki %q: %s", config.URL, err)
+	}
+	applyBatch, err := batchSettings(config.BatchConfig)
+	if err != nil {
+		return nil, fmt.Errorf("loki %q: %s", config.URL, err)
+	}
+	applyQueue, err := queueSettings(config.QueueConfig)
+	if err != nil {
+		return nil, fmt.Errorf("loki %q: %s", config.URL, err)
+	}
+
+	lw := NewLokiWriter(config.URL, lvl)
+	lw.SetLayout(layout)
+	lw.SetEncoding(encoding)
+	lw.SetLabels(config.Labels)
+	if config.LabelKeys != nil {
+		lw.SetLabelKeys(config.LabelKeys...)
+	}
+	if config.Tenant != "" {
+		lw.SetTenant(config.Tenant)
+	}
+	if config.Username != "" {
+		lw.SetBasicAuth(config.Username, config.Password)
+	}
+	applyBatch(lw.HTTPWriter)
+	applyQueue(lw)
+	return &Filter{Level: lvl, LogWriter: lw, Category: categoryOrDefault(config.Category), detached: !additive(config.Additivity)}, nil
+}
+
+// NewSplunkFilter builds the Splunk Filter described by config.
+func NewSplunkFilter(config SplunkConfig) (*Filter, error) {
+	lvl, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, fmt.Errorf("splunk %q: %s", config.URL, err)
+	}
+	format := config.Format
+	if format == "" {
+		format = "json"
+	}
+	layout, err := newLayout(format, config.Pattern, FORMAT)
+	if err != nil {
+		return nil, fmt.Errorf("splunk %q: %s", config.URL, err)
+	}
+	if config.URL == "" {
+		return nil, errors.New("splunk: url is required")
+	}
+	if config.Token == "" {
+		return nil, fmt.Errorf("splunk %q: token is required", config.URL)
+	}
+	ackTimeout := DefaultSplunkAckTimeout
+	if config.AckTimeout != "" {
+		if ackTimeout, err = strToDuration(config.AckTimeout); err != nil || ackTimeout <= 0 {
+			return nil, fmt.Errorf("splunk %q: bad ackTimeout %q", config.URL, config.AckTimeout)
+		}
+	}
+	applyBatch, err := batchSettings(config.BatchConfig)
+	if err != nil {
+		return nil, fmt.Errorf("splunk %q: %s", config.URL, err)
+	}
+	applyQueue, err := queueSettings(config.QueueConfig)
+	if err != nil {
+		return nil, fmt.Errorf("splunk %q: %s", config.URL, err)
+	}
+
+	sw := NewSplunkWriter(config.URL, config.Token, lvl)
+	sw.SetLayout(layout)
+	sw.SetHost(config.Host)
+	sw.SetEventMetadata(config.Source, config.SourceType, config.Index)
+	if config.Ack {
+		sw.SetAcknowledgement(true, ackTimeout)
+	}
+	applyBatch(sw.HTTPWriter)
+	applyQueue(sw)
+	return &Filter{Level: lvl, LogWriter: sw, Category: categoryOrDefault(config.Category), detached: !additive(config.Additivity)}, nil
+}
+
+// NewOTLPFilter builds the OTLP Filter described by config.
+func NewOTLPFilter(config OTLPConfig) (*Filter, error) {
+	lvl, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, fmt.Errorf("otlp %q: %s", config.URL, err)
+	}
+	layout, err := newLayout(config.Format, config.Pattern, "%M")
+	if err != nil {
+		return nil, fmt.Errorf("otlp %q: %s", config.URL, err)
+	}
+	if config.URL == "" {
+		return nil, errors.New("otlp: url is required")
+	}
+	encoding, err := ParseOTLPEncoding(config.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("otlp %q: %s", config.URL, err)
+	}
+	applyBatch, err := batchSettings(config.BatchConfig)
+	if err != nil {
+		return nil, fmt.Errorf("otlp %q: %s", config.URL, err)
+	}
+	applyQueue, err := queueSettings(config.QueueConfig)
+	if err != nil {
+		return nil, fmt.Errorf("otlp %q: %s", config.URL, err)
+	}
+
+	ow := NewOTLPWriter(config.URL, lvl)
+	ow.SetLayout(layout)
+	ow.SetEncoding(encoding)
+	ow.SetResourceAttributes(config.Attributes)
+	applyBatch(ow.HTTPWriter)
+	applyQueue(ow)
+	return &Filter{Level: lvl, LogWriter: ow, Category: categoryOrDefault(config.Category), detached: !additive(config.Additivity)}, nil
+}
+
+// NewFluentFilter builds the Fluentd forward Filter described by config.
+func NewFluentFilter(config FluentConfig) (*Filter, error) {
+	lvl, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, fmt.Errorf("fluent %q: %s", config.Addr, err)
+	}
+	layout, err := newLayout(config.Format, config.Pattern, "%M")
+	if err != nil {
+		return nil, fmt.Errorf("fluent %q: %s", config.Addr, err)
+	}
+	if config.Addr == "" {
+		return nil, errors.New("fluent: addr is required")
+	}
+	records, bytes := DefaultFluentBatchRecords, DefaultFluentBatchBytes
+	if config.BatchSize != "" {
+		if records, err = strToNumSuffix(config.BatchSize, 1000); err != nil {
+			return nil, fmt.Errorf("fluent %q: bad batchSize %q: %s", config.Addr, config.BatchSize, err)
+		}
+	}
+	if config.BatchBytes != "" {
+		if bytes, err = strToNumSuffix(config.BatchBytes, 1024); err != nil {
+			return nil, fmt.Errorf("fluent %q: bad batchBytes %q: %s", config.Addr, config.BatchBytes, err)
+		}
+	}
+	durations := []struct {
+		name, value string
+		d           time.Duration
+	}{
+		{"batchWait", config.BatchWait, DefaultFluentBatchWait},
+		{"ackTimeout", config.AckTimeout, DefaultFluentAckTimeout},
+		{"heartbeat", config.Heartbeat, 0},
+	}
+	for i := range durations {
+		if durations[i].value == "" {
+			continue
+		}
+		if durations[i].d, err = strToDuration(durations[i].value); err != nil {
+			return nil, fmt.Errorf("fluent %q: bad %s %q: %s", config.Addr, durations[i].name, durations[i].value, err)
+		}
+	}
+	network, applyConn, err := connSettings(config.Protocol, "tcp", config.ConnConfig)
+	if err != nil {
+		return nil, fmt.Errorf("fluent %q: %s", config.Addr, err)
+	}
+	applyQueue, err := queueSettings(config.QueueConfig)
+	if err != nil {
+		return nil, fmt.Errorf("fluent %q: %s", config.Addr, err)
+	}
+
+	fw := NewFluentWriter(network, config.Addr, lvl)
+	if err := applyConn(fw.ConnWriter); err != nil {
+		fw.Close()
+		return nil, fmt.Errorf("fluent %q: %s", config.Addr, err)
+	}
+	fw.SetLayout(layout)
+	fw.SetBatchLimits(records, bytes, durations[0].d)
+	fw.SetAck(config.Ack, durations[1].d)
+	fw.SetHeartbeat(durations[2].d)
+	applyQueue(fw)
+	return &Filter{Level: lvl, LogWriter: fw, Category: categoryOrDefault(config.Category), detached: !additive(config.Additivity)}, nil
+}
+
+// batchSettings validates config and returns a function applying it to an
+// HTTPWriter.
+func batchSettings(config BatchConfig) (func(*HTTPWriter), error) {
+	records, bytes := DefaultHTTPBatchRecords, DefaultHTTPBatchBytes
+	var err error
+	if config.BatchSize != "" {
+		if records, err = strToNumSuffix(config.BatchSize, 1000); err != nil {
+			return nil, fmt.Errorf("bad batchSize %q: %s", config.BatchSize, err)
+		}
+	}
+	if config.BatchBytes != "" {
+		if bytes, err = strToNumSuffix(config.BatchBytes, 1024); err != nil {
+			return nil, fmt.Errorf("bad batchBytes %q: %s", config.BatchBytes, err)
+		}
+	}
+	durations := []struct {
+		name, value string
+		d           time.Duration
+	}{
+		{"batchWait", config.BatchWait, DefaultHTTPBatchWait},
+		{"backoffMin", config.BackoffMin, DefaultHTTPBackoffMin},
+		{"backoffMax", config.BackoffMax, DefaultHTTPBackoffMax},
+		{"timeout", config.Timeout, DefaultHTTPTimeout},
+		{"retryAfterLimit", config.RetryAfterLimit, DefaultHTTPRetryAfterLimit},
+	}
+	for i := range durations {
+		if durations[i].value == "" {
+			continue
+		}
+		if durations[i].d, err = strToDuration(durations[i].value); err != nil {
+			return nil, fmt.Errorf("bad %s %q: %s", durations[i].name, durations[i].value, err)
+		}
+	}
+	retries := DefaultHTTPRetries
+	if config.Retries != nil {
+		if retries = *config.Retries; retries < 0 {
+			return nil, fmt.Errorf("bad retries %d", retries)
+		}
+	}
+
+	return func(w *HTTPWriter) {
+		w.SetGzip(config.Gzip)
+		for key, value := range config.Headers {
+			w.SetHeader(key, value)
+		}
+		w.SetBatchLimits(records, bytes, durations[0].d)
+		w.SetRetries(retries, durations[1].d, durations[2].d)
+		w.SetTimeout(durations[3].d)
+		w.SetRetryAfterLimit(durations[4].d)
+	}, nil
+}
+
+// connSettings validates config and returns the network to dial for protocol
+// (defaultProtocol if empty), together with a function applying config to a
+// ConnWriter.  A protocol ending in "+tls", or "tls" alone, dials TLS over
+// TCP.
+func connSettings(protocol, defaultProtocol string, config ConnConfig) (string, func(*ConnWriter) error, error) {
+	secure := false
+	switch protocol {
+	case "":
+		protocol = defaultProtocol
+	case "tls":
+		protocol, secure = "tcp", true
+	default:
+		if strings.HasSuffix(protocol, "+tls") {
+			protocol, secure = strings.TrimSuffix(protocol, "+tls"), true
+		}
+	}
+	if config.TLS != nil && !secure {
+		return "", nil, errors.New("tls settings need the tcp+tls protocol")
+	}
+	tlsConfig := config.TLS
+	if secure && tlsConfig == nil {
+		tlsConfig = &TLSConfig{}
+	}
+
+	durations := []struct {
+		name, value string
+		d           time.Duration
+	}{
+		{"backoffMin", config.BackoffMin, DefaultBackoffMin},
+		{"backoffMax", config.BackoffMax, DefaultBackoffMax},
+		{"timeout", config.Timeout, DefaultConnTimeout},
+	}
+	var err error
+	for i := range durations {
+		if durations[i].value == "" {
+			continue
+		}
+		if durations[i].d, err = strToDuration(durations[i].value); err != nil {
+			return "", nil, fmt.Errorf("bad %s %q: %s", durations[i].name, durations[i].value, err)
+		}
+	}
+	spoolSize, spoolMaxBytes := DefaultSpoolRecords, 0
+	if config.SpoolSize != "" {
+		if spoolSize, err = strToNumSuffix(config.SpoolSize, 1000); err != nil {
+			return "", nil, fmt.Errorf("bad spoolSize %q: %s", config.SpoolSize, err)
+		}
+	}
+	if config.SpoolMaxBytes != "" {
+		if spoolMaxBytes, err = strToNumSuffix(config.SpoolMaxBytes, 1024); err != nil {
+			return "", nil, fmt.Errorf("bad spoolMaxBytes %q: %s", config.SpoolMaxBytes, err)
+		}
+	}
+
+	return protocol, func(c *ConnWriter) error {
+		if err := c.SetTLS(tlsConfig); err != nil {
+			return err
+		}
+		c.SetBackoff(durations[0].d, durations[1].d)
+		c.SetTimeout(durations[2].d)
+		c.SetSpool(spoolSize, config.SpoolDir, int64(spoolMaxBytes))
+		return nil
+	}, nil
+}
+
+func additive(additivity *bool) bool {
+	return additivity == nil || *additivity
+}
+
+// queueSettings validates config and returns a function applying it to the
+// queue of a writer.
+func queueSettings(config QueueConfig) (func(queueConfigurable), error) {
+	policy, err := ParseOverflowPolicy(config.Overflow)
+	if err != nil {
+		return nil, err
+	}
+	var timeout time.Duration
+	if config.OverflowTimeout != "" {
+		if timeout, err = strToDuration(config.OverflowTimeout); err != nil {
+			return nil, fmt.Errorf("bad overflowTimeout %q: %s", config.OverflowTimeout, err)
+		}
+	} else if policy == OverflowBlockTimeout {
+		return nil, errors.New("overflowTimeout is required for block-timeout")
+	}
+	records, bytes := LogBufferLength, 0
+	if config.QueueSize != "" {
+		if records, err = strToNumSuffix(config.QueueSize, 1000); err != nil {
+			return nil, fmt.Errorf("bad queueSize %q: %s", config.QueueSize, err)
+		}
+	}
+	if config.QueueBytes != "" {
+		if bytes, err = strToNumSuffix(config.QueueBytes, 1024); err != nil {
+			return nil, fmt.Errorf("bad queueBytes %q: %s", config.QueueBytes, err)
+		}
+	}
+
+	return func(w queueConfigurable) {
+		w.SetOverflowPolicy(policy, timeout)
+		w.SetQueueLimits(records, bytes)
+	}, nil
+}
+
+// queueConfigurable is implemented by the writers built on recordQueue.
+type queueConfigurable interface {
+	SetOverflowPolicy(policy OverflowPolicy, timeout time.Duration)
+	SetQueueLimits(records, bytes int)
+}
+
+func categoryOrDefault(category string) string {
+	if category == "" {
+		return "DEFAULT"
+	}
+	return category
+}
+
+// NewLogger builds a Logger holding one filter per enabled entry.  The console
+// is registered as both "stdout" and "default"; the other entries are
+// registered under their category, which must be unique (a "default" category
+// takes over the package-level functions from the console).  If any entry is
+// invalid, the writers already opened are closed and the error is returned.
+func (c *LogConfig) NewLogger() (Logger, error) {
+	log, _, err := c.newLogger(nil)
+	return log, err
+}
+
+// ParseJsonConfiguration decodes a JSON configuration such as the example in
+// log.go.  Trailing "//" comments are allowed.
+func ParseJsonConfiguration(data []byte) (*LogConfig, error) {
+	config := &LogConfig{}
+	if err := json.Unmarshal(stripJsonComments(data), config); err != nil {
+		return nil, fmt.Errorf("LoadJsonConfiguration: %s", err)
+	}
+	return config, nil
+}
+
+// LoadJsonConfiguration reads the configuration file at path and replaces the
+// filters in Global with the ones it describes.  On error Global is left
+// untouched.
+func LoadJsonConfiguration(path string) error {
+	content, err := ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("LoadJsonConfiguration: %s", err)
+	}
+	return LoadJsonConfigurationBytes([]byte(content))
+}
+
+// LoadJsonConfigurationReader is LoadJsonConfiguration reading from r.
+func LoadJsonConfigurationReader(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("LoadJsonConfiguration: %s", err)
+	}
+	return LoadJsonConfigurationBytes(data)
+}
+
+// LoadJsonConfigurationBytes is LoadJsonConfiguration reading from data.
+func LoadJsonConfigurationBytes(data []byte) error {
+	config, err := ParseJsonConfiguration(data)
+	if err != nil {
+		return err
+	}
+	if err := ApplyConfiguration(config); err != nil {
+		return fmt.Errorf("LoadJsonConfiguration: %s", err)
+	}
+	return nil
+}
+
+// stripJsonComments blanks out "//" comments that are not inside a string,
+// keeping line structure so json error offsets stay meaningful.
+func stripJsonComments(data []byte) []byte {
+	out := make([]byte, len(data))
+	copy(out, data)
+	inString, escaped := false, false
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		switch {
+		case inString:
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		}
 	}
-	return lvl
+	return out
 }
 
 func ReadFile(path string) (string, error) {
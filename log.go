@@ -1,5 +1,6 @@
 package logs
 
+// An example configuration for LoadJsonConfiguration:
 /**
 {
     "console": {
@@ -12,6 +13,12 @@ package logs
         "filename":"./test.log",
         "category": "Test",			// different category log to different files
         "pattern": "[%D %T] [%C] [%L] (%S) %M"	// log output formmat
+    },{
+        "enable": false,
+        "level": "INFO",
+        "filename":"./test.json.log",
+        "category": "TestJson",
+        "format": "json"			// "json" or "logfmt" instead of pattern
     },{
         "enable": false,
         "level": "DEBUG",
@@ -22,7 +29,19 @@ package logs
         "maxsize": "500M",
         "MaxLines": "10K",
         "daily": true,
-        "sanitize": true
+        "schedule": "@daily",			// or "@hourly", "@every 6h", a cron spec "0 4 * * *"; replaces daily
+        "timezone": "UTC",			// of the schedule, local time if omitted
+        "boundary": "4h",			// rotate at 04:00 instead of midnight
+        "nameTemplate": "rotate_test-%Y%m%d.log",	// backup names, "rotate_test.log.2006-01-02" if omitted
+        "sanitize": true,
+        "reopenCheck": "10s",			// reopen the file when logrotate moved it away
+        "copyTruncate": false,			// set when logrotate uses copytruncate
+        "multiProcess": false,			// set when several processes write the file
+        "compress": true,			// gzip rotated files (.1.gz, .2006-01-02.gz)
+        "maxAge": "30d",			// remove rotated files older than this
+        "maxBackups": 30,			// and all but the newest 30
+        "maxTotalSize": "10G",			// and those beyond 10G in total
+        "additivity": false			// do not also send TestRotate.* records to the console
     }],
     "sockets": [{
         "enable": false,
@@ -30,7 +49,127 @@ package logs
         "category": "socket",
         "pattern": "[%D %T] [%C] [%L] (%S) %M",
         "addr": "127.0.0.1:12124",
-        "protocol":"udp"
+        "protocol":"udp",
+        "overflow": "block-timeout",		// block, drop-newest, drop-oldest or block-timeout when the queue is full
+        "overflowTimeout": "50ms",
+        "queueSize": "10K",			// records, "0" for no limit
+        "queueBytes": "16M",			// estimated bytes, no limit if omitted
+        "backoffMin": "100ms",			// delays between attempts to reconnect
+        "backoffMax": "30s",
+        "timeout": "5s",			// deadline of connecting and of each write
+        "spoolSize": "1K",			// records kept in memory while the collector is down
+        "spoolDir": "/var/spool/app",		// and more in a file there, sent on reconnect
+        "spoolMaxBytes": "100M"
+    },{
+        "enable": false,
+        "level": "INFO",
+        "category": "secure",
+        "format": "json",
+        "addr": "logs.example.com:6514",
+        "protocol": "tcp+tls",			// TLS, files re-read on each reconnect
+        "tls": {
+            "ca": "/etc/ssl/collector-ca.pem",	// system CAs if omitted
+            "cert": "/etc/ssl/app.pem",		// client certificate for mutual TLS
+            "key": "/etc/ssl/app-key.pem",
+            "serverName": "logs.example.com",	// host of addr if omitted
+            "minVersion": "1.2"
+        }
+    },{
+        "enable": false,
+        "level": "INFO",
+        "category": "graylog",
+        "format": "gelf",			// GELF 1.1 for Graylog, pattern ignored
+        "addr": "graylog.example.com:12201",
+        "protocol": "udp",			// or tcp, null-byte framed and uncompressed
+        "compression": "gzip",			// gzip, zlib or none
+        "chunkSize": 1420			// bytes per datagram, larger messages are chunked
+    }],
+    "syslog": [{
+        "enable": false,
+        "level": "INFO",
+        "category": "syslog",
+        "addr": "127.0.0.1:514",		// or "/dev/log" with "protocol": "unix"
+        "protocol": "udp",			// udp, tcp (octet-counting), tcp+tls or unix
+        "rfc": "5424",				// or "3164"
+        "facility": "local0",
+        "appName": "api",			// Project if omitted
+        "hostname": "web-1",			// os.Hostname() if omitted
+        "pattern": "%M%X"			// of the message part
+    }],
+    "http": [{
+        "enable": false,
+        "level": "INFO",
+        "category": "http",
+        "url": "https://collector.example.com/logs",
+        "format": "json",			// of each record: json, logfmt or pattern
+        "batchFormat": "ndjson",		// "json" for an array of the records
+        "gzip": true,
+        "headers": {"X-Source": "api"},
+        "token": "secret",			// Authorization: Bearer secret
+        "batchSize": "500",			// send once a batch holds 500 records,
+        "batchBytes": "1M",			// or 1M,
+        "batchWait": "1s",			// or its first record has waited 1s
+        "retries": 5,				// on errors, 429 and 5xx, honouring Retry-After
+        "backoffMin": "500ms",
+        "backoffMax": "30s",
+        "timeout": "10s"
+    }],
+    "elasticsearch": [{
+        "enable": false,
+        "level": "INFO",
+        "category": "es",
+        "url": "http://localhost:9200",	// documents go to /_bulk
+        "index": "app-%Y.%m.%d",		// dated by the record in UTC; "<project>-%Y.%m.%d" if omitted
+        "username": "elastic",			// or "apiKey": "<base64 key>"
+        "password": "changeme",
+        "gzip": true,				// and batchSize, batchBytes, batchWait, retries... as for http
+        "batchSize": "1K"
+    }],
+    "loki": [{
+        "enable": false,
+        "level": "INFO",
+        "category": "loki",
+        "url": "http://localhost:3100",	// records go to /loki/api/v1/push
+        "encoding": "protobuf",			// snappy-compressed, or "json"
+        "labels": {"env": "prod"},		// added to every stream
+        "labelKeys": ["project", "category", "level"],	// taken from each record, or from its fields
+        "tenant": "team-a",			// X-Scope-OrgID
+        "pattern": "(%S) %M%X",			// of the lines
+        "batchWait": "2s"			// and the other settings of http
+    }],
+    "splunk": [{
+        "enable": false,
+        "level": "WARN",
+        "category": "splunk",
+        "url": "https://splunk:8088",		// events go to /services/collector/event
+        "token": "00000000-0000-0000-0000-000000000000",	// HEC token
+        "sourcetype": "_json",
+        "index": "main",			// the default index of the token if omitted
+        "ack": true,				// wait for indexer acknowledgement
+        "ackTimeout": "30s",			// then send the batch again
+        "batchSize": "100"			// and the other settings of http
+    }],
+    "otlp": [{
+        "enable": false,
+        "level": "INFO",
+        "category": "otlp",
+        "url": "http://localhost:4318",		// records go to /v1/logs
+        "encoding": "protobuf",			// or "json"
+        "attributes": {"deployment.environment": "prod"},	// of the resource, with service.name
+        "headers": {"Authorization": "Bearer xxx"}	// and the other settings of http
+    }],
+    "fluent": [{
+        "enable": false,
+        "level": "INFO",
+        "category": "fluent",
+        "addr": "127.0.0.1:24224",		// fluentd or fluent-bit in_forward, tag "<Project>.<category>"
+        "protocol": "tcp",			// or tcp+tls, unix
+        "batchSize": "500",
+        "batchWait": "1s",
+        "ack": true,				// wait for each batch to be acknowledged
+        "ackTimeout": "30s",
+        "heartbeat": "1s",			// over udp, as fluentd's in_forward answers
+        "spoolSize": "1000"			// batches, and the other settings of sockets
     }]
 }
 */
@@ -46,11 +46,15 @@
 package logs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -74,7 +78,7 @@ var (
 )
 
 func (l Level) String() string {
-	if l < 0 || int(l) > len(levelStrings) {
+	if l < 0 || int(l) >= len(levelStrings) {
 		return "UNKNOWN"
 	}
 	return levelStrings[int(l)]
@@ -96,6 +100,82 @@ type LogRecord struct {
 	Source   string    // The message source
 	Message  string    // The log message
 	Category string    // The log group
+	Fields   Fields    // The key/value context bound to the logger
+}
+
+/****** Fields ******/
+
+// A Field is a single key/value pair attached to a LogRecord.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Fields is an ordered collection of key/value pairs.  Order is preserved so
+// that every writer renders the same record identically.
+type Fields []Field
+
+// NewFields builds Fields from alternating keys and values, e.g.
+// NewFields("user_id", 42, "tenant", "acme").  Keys that are not strings are
+// formatted with %v, and a trailing key without a value is paired with
+// "(MISSING)".
+func NewFields(kv ...interface{}) Fields {
+	if len(kv) == 0 {
+		return nil
+	}
+	fields := make(Fields, 0, (len(kv)+1)/2)
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		var value interface{} = "(MISSING)"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		fields = append(fields, Field{Key: key, Value: value})
+	}
+	return fields
+}
+
+// With returns a new Fields holding the receiver's pairs followed by kv.  A key
+// that is already present is overridden in place.  The receiver is not modified.
+func (fs Fields) With(kv ...interface{}) Fields {
+	return fs.Merge(NewFields(kv...))
+}
+
+// Merge returns a new Fields holding the receiver's pairs followed by add,
+// with the same override rules as With.
+func (fs Fields) Merge(add Fields) Fields {
+	if len(add) == 0 {
+		return fs
+	}
+	out := make(Fields, len(fs), len(fs)+len(add))
+	copy(out, fs)
+	for _, field := range add {
+		replaced := false
+		for i := range out {
+			if out[i].Key == field.Key {
+				out[i].Value = field.Value
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			out = append(out, field)
+		}
+	}
+	return out
+}
+
+// Get returns the value bound to key and whether it was present.
+func (fs Fields) Get(key string) (interface{}, bool) {
+	for _, field := range fs {
+		if field.Key == key {
+			return field.Value, true
+		}
+	}
+	return nil, false
 }
 
 /****** LogWriter ******/
@@ -107,6 +187,7 @@ type LogWriter interface {
 
 	// This should clean up anything lingering about the LogWriter, as it is called before
 	// the LogWriter is removed.  LogWrite should not be called after Close.
+	// Records already passed to LogWrite must be written before Close returns.
 	Close()
 
 	SetFormat(format string)
@@ -114,6 +195,20 @@ type LogWriter interface {
 	Write(p []byte) (n int, err error)
 }
 
+// A Flusher is a LogWriter that can be waited for.  Every writer of this
+// package is one; for other writers, Filter and Logger have Flush do nothing
+// and CloseContext call Close.
+type Flusher interface {
+	// Flush blocks until every record passed to LogWrite before the call has
+	// been written, or ctx is done, and reports any write error since the
+	// previous Flush.
+	Flush(ctx context.Context) error
+
+	// CloseContext is Close, giving up waiting for queued records once ctx is
+	// done.
+	CloseContext(ctx context.Context) error
+}
+
 /****** Logger ******/
 
 // A Filter represents the log level below which no log records are written to
@@ -122,6 +217,10 @@ type Filter struct {
 	Level Level
 	LogWriter
 	Category string
+	Fields   Fields
+
+	origin   *Filter // the registered Filter a With child was derived from
+	detached bool    // records do not propagate to ancestor categories
 }
 
 // A Logger represents a collection of Filters through which log messages are
@@ -143,7 +242,7 @@ func NewLogger() Logger {
 func NewConsoleLogger(lvl Level) Logger {
 	os.Stderr.WriteString("warning: use of deprecated NewConsoleLogger\n")
 	return Logger{
-		"stdout": &Filter{lvl, NewConsoleLogWriter(), "DEFAULT"},
+		"stdout": &Filter{Level: lvl, LogWriter: NewConsoleLogWriter(), Category: "DEFAULT"},
 	}
 }
 
@@ -151,7 +250,7 @@ func NewConsoleLogger(lvl Level) Logger {
 // or above lvl to standard output.
 func NewDefaultLogger(lvl Level) Logger {
 	return Logger{
-		"default": &Filter{lvl, NewConsoleLogWriter(), "DEFAULT"},
+		"default": &Filter{Level: lvl, LogWriter: NewConsoleLogWriter(), Category: "DEFAULT"},
 	}
 }
 
@@ -160,11 +259,83 @@ func NewDefaultLogger(lvl Level) Logger {
 // you want to guarantee that all log messages are written.  Close removes
 // all filters (and thus all LogWriters) from the logger.
 func (log Logger) Close() {
-	// Close all open loggers
+	// Close all open loggers, once each even if registered under several names
+	closed := make(map[interface{}]bool, len(log))
 	for name, filt := range log {
-		filt.Close()
+		if key := writerKey(filt); !closed[key] {
+			closed[key] = true
+			filt.Close()
+		}
+		delete(log, name)
+	}
+}
+
+// writerKey identifies the LogWriter behind filt, so that a writer shared by
+// several filters can be recognised.  Writers that cannot be compared are
+// identified by their filter instead.
+func writerKey(filt *Filter) interface{} {
+	if filt.LogWriter != nil && reflect.TypeOf(filt.LogWriter).Comparable() {
+		return filt.LogWriter
+	}
+	return filt
+}
+
+// Flush flushes every writer of the logger, waiting until ctx is done at the
+// latest.  Failing writers are reported in a WriterErrors keyed by filter
+// name.
+func (log Logger) Flush(ctx context.Context) error {
+	return log.eachWriter(func(filt *Filter) error {
+		return filt.Flush(ctx)
+	})
+}
+
+// CloseContext is Close, waiting until ctx is done at the latest for the
+// writers to write their queued records.  Failing writers are reported in a
+// WriterErrors keyed by filter name.
+func (log Logger) CloseContext(ctx context.Context) error {
+	err := log.eachWriter(func(filt *Filter) error {
+		return filt.CloseContext(ctx)
+	})
+	for name := range log {
 		delete(log, name)
 	}
+	return err
+}
+
+// eachWriter calls fn concurrently for one filter of each distinct writer.
+func (log Logger) eachWriter(fn func(filt *Filter) error) error {
+	names := make([]string, 0, len(log))
+	for name := range log {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(WriterErrors)
+	seen := make(map[interface{}]bool, len(log))
+	for _, name := range names {
+		filt := log[name]
+		if filt == nil || filt.LogWriter == nil || seen[writerKey(filt)] {
+			continue
+		}
+		seen[writerKey(filt)] = true
+		wg.Add(1)
+		go func(name string, filt *Filter) {
+			defer wg.Done()
+			if err := fn(filt); err != nil {
+				mu.Lock()
+				errs[name] = err
+				mu.Unlock()
+			}
+		}(name, filt)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
 func (log Logger) GetDefaultFilter() *Filter {
@@ -182,20 +353,39 @@ func (log Logger) AddFilter(name string, lvl Level, writer LogWriter, categorys
 		c = "DEFAULT"
 	}
 
-	log[name] = &Filter{lvl, writer, c}
+	log[name] = &Filter{Level: lvl, LogWriter: writer, Category: c}
 	return log
 }
 
-/******* Logging *******/
-// Send a formatted log message internally
-func (log Logger) intLogf(lvl Level, format string, args... interface{}) {
+// With returns a child Logger whose filters share the receiver's writers but
+// attach the given key/value pairs to every record they log.  See NewFields
+// for how kv is interpreted.
+func (log Logger) With(kv ...interface{}) Logger {
+	child := make(Logger, len(log))
+	for name, filt := range log {
+		child[name] = filt.With(kv...)
+	}
+	return child
+}
 
+/******* Logging *******/
+// defaultFilter returns the writer and level of the "default" filter of log,
+// and the fields bound to it.  The writer is nil if there is none.
+func (log Logger) defaultFilter() (target, Fields) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	filter, ok := log["default"]
 	if !ok {
-		return
+		return target{}, nil
 	}
+	base := filter.base()
+	return target{level: base.Level, writer: base.LogWriter}, filter.Fields
+}
 
-	if lvl < filter.Level {
+// Send a formatted log message internally
+func (log Logger) intLogf(lvl Level, format string, args... interface{}) {
+	filter, fields := log.defaultFilter()
+	if filter.writer == nil || lvl < filter.level {
 		return
 	}
 	// Determine caller func
@@ -220,19 +410,16 @@ func (log Logger) intLogf(lvl Level, format string, args... interface{}) {
 		Created: time.Now(),
 		Source:  src,
 		Message: msg,
+		Fields:  fields,
 	}
 
-	filter.LogWrite(rec)
+	filter.writer.LogWrite(rec)
 }
 
 // Send a closure log message internally
 func (log Logger) intLogc(lvl Level, closure func() string) {
-	filter, ok := log["default"]
-	if !ok {
-		return
-	}
-
-	if lvl < filter.Level {
+	filter, fields := log.defaultFilter()
+	if filter.writer == nil || lvl < filter.level {
 		return
 	}
 
@@ -249,20 +436,17 @@ func (log Logger) intLogc(lvl Level, closure func() string) {
 		Created: time.Now(),
 		Source:  src,
 		Message: closure(),
+		Fields:  fields,
 	}
 
 	// Dispatch the logs
-	filter.LogWrite(rec)
+	filter.writer.LogWrite(rec)
 }
 
 // Send a log message with manual level, source, and message.
 func (log Logger) Log(lvl Level, source, message string) {
-	filter, ok := log["default"]
-	if !ok {
-		return
-	}
-
-	if lvl < filter.Level {
+	filter, fields := log.defaultFilter()
+	if filter.writer == nil || lvl < filter.level {
 		return
 	}
 
@@ -272,9 +456,10 @@ func (log Logger) Log(lvl Level, source, message string) {
 		Created: time.Now(),
 		Source:  source,
 		Message: message,
+		Fields:  fields,
 	}
 
-	filter.LogWrite(rec)
+	filter.writer.LogWrite(rec)
 
 }
 
@@ -303,21 +488,21 @@ func (log Logger) Logc(lvl Level, closure func() string) {
 //   When given anything else, the log message will be each of the arguments
 //   formatted with %v and separated by spaces (ala Sprint).
 func (log Logger) Debug(arg0 interface{}, args ...interface{}) {
-	msg := log.getMsg(arg0, args)
+	msg := log.getMsg(arg0, args...)
 	log.intLogf(DEBUG, msg)
 }
 
 // Trace logs a message at the trace log level.
 // See Debug for an explanation of the arguments.
 func (log Logger) Trace(arg0 interface{}, args ...interface{}) {
-	msg := log.getMsg(arg0, args)
+	msg := log.getMsg(arg0, args...)
 	log.intLogf(TRACE, msg)
 }
 
 // Info logs a message at the info log level.
 // See Debug for an explanation of the arguments.
 func (log Logger) Info(arg0 interface{}, args ...interface{}) {
-	msg := log.getMsg(arg0, args)
+	msg := log.getMsg(arg0, args...)
 	log.intLogf(INFO, msg)
 }
 
@@ -327,7 +512,7 @@ func (log Logger) Info(arg0 interface{}, args ...interface{}) {
 // closures are executed to format the error message.
 // See Debug for further explanation of the arguments.
 func (log Logger) Warn(arg0 interface{}, args ...interface{}) error {
-	msg := log.getMsg(arg0, args)
+	msg := log.getMsg(arg0, args...)
 	log.intLogf(WARN, msg)
 	return errors.New(msg)
 }
@@ -336,7 +521,7 @@ func (log Logger) Warn(arg0 interface{}, args ...interface{}) error {
 // See Warn for an explanation of the performance and Debug for an explanation
 // of the parameters.
 func (log Logger) Error(arg0 interface{}, args ...interface{}) error {
-	msg := log.getMsg(arg0, args)
+	msg := log.getMsg(arg0, args...)
 	log.intLogf(ERROR, msg)
 	return errors.New(msg)
 }
@@ -345,7 +530,7 @@ func (log Logger) Error(arg0 interface{}, args ...interface{}) error {
 // See Warn for an explanation of the performance and Debug for an explanation
 // of the parameters.
 func (log Logger) FATAL(arg0 interface{}, args ...interface{}) error {
-	msg := log.getMsg(arg0, args)
+	msg := log.getMsg(arg0, args...)
 	log.intLogf(FATAL, msg)
 	return errors.New(msg)
 }
@@ -1,7 +1,29 @@
 package logs
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -26,4 +48,2234 @@ func TestError(t *testing.T) {
 	Info("%s %s %s", "1", " 2222", "  333333   !!!")
 
 	time.Sleep(time.Second)
-}
\ No newline at end of file
+}
+
+func TestWithFields(t *testing.T) {
+	parent := &Filter{Level: TRACE, Category: "Test"}
+	child := parent.With("user_id", 42, "tenant", "acme corp")
+	grandchild := child.With("user_id", 7, "dangling")
+
+	if len(parent.Fields) != 0 {
+		t.Fatalf("parent fields modified: %v", parent.Fields)
+	}
+	if v, _ := child.Fields.Get("user_id"); v != 42 {
+		t.Errorf("child user_id = %v, want 42", v)
+	}
+
+	rec := &LogRecord{Level: INFO, Message: "hello", Fields: grandchild.Fields}
+	got := FormatLogRecord("%M%X", rec)
+	want := "hello user_id=7 tenant=\"acme corp\" dangling=(MISSING)\n"
+	if got != want {
+		t.Errorf("FormatLogRecord = %q, want %q", got, want)
+	}
+}
+
+func TestJSONLayout(t *testing.T) {
+	rec := &LogRecord{
+		Level:    ERROR,
+		Created:  time.Date(2020, 3, 20, 14, 34, 31, 717e6, time.UTC),
+		Source:   "main.main:12",
+		Message:  "line one\nsaid \"two\"\xff",
+		Category: "Test",
+		Fields:   NewFields("user_id", 42, "message", "dup"),
+	}
+	got := JSONLayout{}.Format(rec)
+	if strings.Count(got, "\n") != 1 || !strings.HasSuffix(got, "\n") {
+		t.Fatalf("record spans lines: %q", got)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &decoded); err != nil {
+		t.Fatalf("invalid JSON %q: %s", got, err)
+	}
+	if decoded["message"] != "line one\nsaid \"two\"\ufffd" {
+		t.Errorf("message = %q", decoded["message"])
+	}
+	if decoded["user_id"] != float64(42) || decoded["fields.message"] != "dup" {
+		t.Errorf("fields not rendered: %v", decoded)
+	}
+	if decoded["time"] != "2020-03-20T14:34:31.717Z" || decoded["level"] != "ERROR" {
+		t.Errorf("time/level = %v/%v", decoded["time"], decoded["level"])
+	}
+}
+
+func TestLogfmtLayout(t *testing.T) {
+	rec := &LogRecord{
+		Level:    INFO,
+		Created:  time.Date(2020, 3, 20, 14, 34, 31, 717e6, time.UTC),
+		Source:   "main.main:12",
+		Message:  `a=b "quoted" two words`,
+		Category: "Test",
+		Fields:   NewFields("user id", "", "count", 3),
+	}
+	got := LogfmtLayout{}.Format(rec)
+	want := `time=2020-03-20T14:34:31.717Z level=INFO category=Test source=main.main:12 ` +
+		`msg="a=b \"quoted\" two words" project=` + Project + ` user_id="" count=3` + "\n"
+	if got != want {
+		t.Errorf("LogfmtLayout = %q, want %q", got, want)
+	}
+}
+
+func TestLoadJsonConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "test.log")
+	config := `{
+		"console": {"enable": true, "level": "FINE"},	// comment
+		"files": [{
+			"enable": true,
+			"level": "DEBUG",
+			"filename": "` + filepath.ToSlash(filename) + `",
+			"category": "Test",
+			"pattern": "[%C] [%L] %M // not a comment",
+			"rotate": true,
+			"maxsize": "500M",
+			"MaxLines": "10K"
+		}, {
+			"enable": false,
+			"level": "NOPE"
+		}]
+	}`
+
+	saved := Global
+	defer func() { Global = saved }()
+	Global = make(Logger)
+
+	if err := LoadJsonConfigurationBytes([]byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	defer Global.Close()
+
+	filt := Global["Test"]
+	if filt == nil || filt.Level != DEBUG || Global["stdout"] == nil {
+		t.Fatalf("filters not registered: %v", Global)
+	}
+	flw := filt.LogWriter.(*FileLogWriter)
+	if flw.maxsize != 500*1024*1024 || flw.MaxLines != 10000 {
+		t.Errorf("maxsize/MaxLines = %d/%d", flw.maxsize, flw.MaxLines)
+	}
+	if got := flw.layout.Format(&LogRecord{Level: INFO, Message: "hi", Category: "Test"}); got != "[Test] [INFO] hi // not a comment\n" {
+		t.Errorf("pattern not applied: %q", got)
+	}
+
+	if err := LoadJsonConfigurationBytes([]byte(`{"console": {"enable": true, "level": "LOUD"}}`)); err == nil {
+		t.Error("expected error for unknown level")
+	}
+	if Global["Test"] != filt {
+		t.Error("Global replaced by invalid configuration")
+	}
+}
+
+func TestApplyConfigurationReusesFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := Global
+	defer func() { Global = saved }()
+	Global = make(Logger)
+
+	filename := filepath.Join(dir, "reload.log")
+	config := func(level string) *LogConfig {
+		return &LogConfig{Files: []*FileConfig{{
+			Enable: true, Level: level, Filename: filename, Category: "Reload",
+		}}}
+	}
+
+	if err := ApplyConfiguration(config("DEBUG")); err != nil {
+		t.Fatal(err)
+	}
+	cached := GetLogger("Reload")
+	child := cached.With("request_id", "r1")
+	writer := cached.base().LogWriter
+
+	if err := ApplyConfiguration(config("ERROR")); err != nil {
+		t.Fatal(err)
+	}
+	if cached.base().LogWriter != writer {
+		t.Error("FileLogWriter for unchanged filename was reopened")
+	}
+	if cached.base().Level != ERROR || child.base().Level != ERROR {
+		t.Errorf("level not reloaded: %v / %v", cached.base().Level, child.base().Level)
+	}
+
+	if err := ApplyConfiguration(config("LOUD")); err == nil {
+		t.Error("expected error for invalid configuration")
+	}
+	if cached.base().Level != ERROR || currentGlobal()["Reload"] != cached.base() {
+		t.Error("invalid configuration replaced the working one")
+	}
+	Close()
+}
+
+func TestConfigWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := Global
+	defer func() { Global = saved }()
+	Global = make(Logger)
+	defer Close()
+
+	path := filepath.Join(dir, "logs.json")
+	writeConfig := func(level string) {
+		config := `{"files": [{"enable": true, "level": "` + level + `", "category": "Watch",
+			"filename": "` + filepath.ToSlash(filepath.Join(dir, "watch.log")) + `"}]}`
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitLevel := func(want Level) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			globalMu.RLock()
+			got := Global["Watch"].Level
+			globalMu.RUnlock()
+			if got == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("level = %v, want %v", got, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A change of the file is picked up by polling.
+	writeConfig("DEBUG")
+	cw, err := WatchJsonConfiguration(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitLevel(DEBUG)
+	writeConfig("WARN")
+	waitLevel(WARN)
+	writeConfig("LOUD")
+	time.Sleep(100 * time.Millisecond)
+	waitLevel(WARN)
+	cw.Stop()
+
+	// Without polling, the file is only read again on SIGHUP.
+	writeConfig("ERROR")
+	cw, err = WatchJsonConfiguration(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cw.Stop()
+	waitLevel(ERROR)
+	writeConfig("INFO")
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := self.Signal(syscall.SIGHUP); err != nil {
+		t.Skipf("cannot send SIGHUP: %s", err)
+	}
+	waitLevel(INFO)
+}
+
+// recordingWriter is a LogWriter keeping the records it is given.
+type recordingWriter struct {
+	mu   sync.Mutex
+	recs []*LogRecord
+}
+
+func (w *recordingWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.recs = append(w.recs, rec)
+}
+func (w *recordingWriter) Close()                                 {}
+func (w *recordingWriter) Flush(ctx context.Context) error        { return nil }
+func (w *recordingWriter) CloseContext(ctx context.Context) error { return nil }
+func (w *recordingWriter) SetFormat(format string)                {}
+func (w *recordingWriter) Write(p []byte) (n int, err error)      { return len(p), nil }
+
+func (w *recordingWriter) messages() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var msgs []string
+	for _, rec := range w.recs {
+		msgs = append(msgs, rec.Category+":"+rec.Message)
+	}
+	return msgs
+}
+
+func TestCategoryHierarchy(t *testing.T) {
+	saved := Global
+	defer func() { Global = saved }()
+
+	root, app, db := &recordingWriter{}, &recordingWriter{}, &recordingWriter{}
+	Global = make(Logger)
+	Global.AddFilter("stdout", WARN, root)
+	Global.AddFilter("app", INFO, app, "app")
+	Global.AddFilter("app.db", DEBUG, db, "app.db")
+
+	query := GetLogger("app.db.query")
+	query.Debug("debug")
+	query.Warn("warn")
+	GetLogger("app.http").Info("info")
+	GetLogger("other").Info("dropped")
+
+	GetLogger("app.db").SetAdditivity(false)
+	query.Error("error")
+
+	if got := fmt.Sprint(db.messages()); got != "[app.db.query:debug app.db.query:warn app.db.query:error]" {
+		t.Errorf("app.db got %s", got)
+	}
+	if got := fmt.Sprint(app.messages()); got != "[app.db.query:warn app.http:info]" {
+		t.Errorf("app got %s", got)
+	}
+	if got := fmt.Sprint(root.messages()); got != "[app.db.query:warn]" {
+		t.Errorf("root got %s", got)
+	}
+}
+
+func TestUnconfiguredCategory(t *testing.T) {
+	saved := Global
+	defer func() { Global = saved }()
+
+	root := &recordingWriter{}
+	Global = make(Logger)
+	Global.AddFilter("stdout", INFO, root)
+	Global["default"] = Global["stdout"]
+
+	// Managing the writer of a category without one is a no-op.
+	worker := GetLogger("app.worker")
+	worker.SetFormat("%M")
+	if err := worker.Flush(context.Background()); err != nil {
+		t.Errorf("Flush: %s", err)
+	}
+	if err := worker.CloseContext(context.Background()); err != nil {
+		t.Errorf("CloseContext: %s", err)
+	}
+	worker.Close()
+
+	worker.LogWrite(&LogRecord{Level: INFO, Message: "direct", Category: "app.worker"})
+	worker.Info("logged")
+	GetLogger("default").Info("default")
+
+	if got := fmt.Sprint(root.messages()); got != "[app.worker:direct app.worker:logged default:default]" {
+		t.Errorf("root got %s", got)
+	}
+	if got := Global["stdout"].Category; got != "DEFAULT" {
+		t.Errorf("GetLogger renamed the root filter to %q", got)
+	}
+}
+
+func TestContextFields(t *testing.T) {
+	saved := Global
+	defer func() { Global = saved }()
+
+	w := &recordingWriter{}
+	Global = make(Logger)
+	Global.AddFilter("default", TRACE, w)
+	Global.AddFilter("ctx", TRACE, w, "ctx")
+
+	unregister := RegisterContextExtractor(func(ctx context.Context) Fields {
+		if span, ok := ctx.Value(spanKey{}).(string); ok {
+			return NewFields(SpanIDKey, span)
+		}
+		return nil
+	})
+	defer unregister()
+
+	ctx := NewContext(nil, RequestIDKey, "r1", TenantKey, "acme")
+	ctx = NewContext(context.WithValue(ctx, spanKey{}, "s1"), TraceIDKey, "t1")
+
+	GetLogger("ctx").InfoCtx(ctx, "hello %s", "ctx")
+	_ = ErrorCtx(ctx, "failed")
+	FromContext(ctx).Debug("from")
+
+	if len(w.recs) != 3 {
+		t.Fatalf("got %d records", len(w.recs))
+	}
+	for _, rec := range w.recs {
+		got := FormatLogRecord("%M%X", rec)
+		if !strings.HasSuffix(got, " request_id=r1 tenant=acme trace_id=t1 span_id=s1\n") {
+			t.Errorf("fields missing: %q", got)
+		}
+		if !strings.Contains(rec.Source, "TestContextFields") {
+			t.Errorf("source = %q", rec.Source)
+		}
+	}
+
+	unregister()
+	if got := FormatLogRecord("%X", &LogRecord{Fields: ContextFields(ctx)}); got != " request_id=r1 tenant=acme trace_id=t1\n" {
+		t.Errorf("fields after unregister = %q", got)
+	}
+}
+
+// spanKey is the context key of the span ID in TestContextFields.
+type spanKey struct{}
+
+func TestFlushDrainsQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "flush.log")
+	w, err := OpenFileLogWriter(filename, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetFormat("%M")
+	log := Logger{"file": &Filter{Level: TRACE, LogWriter: w, Category: "flush"}}
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		w.LogWrite(&LogRecord{Level: INFO, Message: fmt.Sprint(i)})
+	}
+	if err := log.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(filename)
+	if lines := strings.Count(string(data), "\n"); lines != n {
+		t.Errorf("after Flush: %d lines written, want %d", lines, n)
+	}
+
+	w.LogWrite(&LogRecord{Level: INFO, Message: "last"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := log.CloseContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(filename)
+	if !strings.HasSuffix(string(data), "last\n") {
+		t.Errorf("record queued before Close was lost")
+	}
+	if len(log) != 0 {
+		t.Errorf("CloseContext left filters: %v", log)
+	}
+
+	// A writer that is not a Flusher is closed with Close.
+	plain := &plainWriter{}
+	log = Logger{"plain": &Filter{Level: TRACE, LogWriter: plain, Category: "plain"}}
+	if err := log.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.CloseContext(ctx); err != nil || !plain.closed {
+		t.Errorf("CloseContext = %v, closed %t", err, plain.closed)
+	}
+}
+
+// plainWriter is a LogWriter that is not a Flusher.
+type plainWriter struct{ closed bool }
+
+func (w *plainWriter) LogWrite(rec *LogRecord)           {}
+func (w *plainWriter) Close()                            { w.closed = true }
+func (w *plainWriter) SetFormat(format string)           {}
+func (w *plainWriter) Write(p []byte) (n int, err error) { return len(p), nil }
+
+// gatedWriter blocks every Write until open is closed.
+type gatedWriter struct {
+	open chan struct{}
+	mu   sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.open
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	out := &gatedWriter{open: make(chan struct{})}
+	w := NewFormatLogWriter(out, "%L %M")
+	w.SetOverflowPolicy(OverflowDropNewest, 0)
+	w.SetQueueLimits(2, 0)
+
+	// The records held by the blocked writer count against the limit.
+	const n = 10
+	for i := 0; i < n; i++ {
+		w.LogWrite(&LogRecord{Level: INFO, Message: fmt.Sprint(i)})
+	}
+	if dropped := w.Dropped(); dropped != n-2 {
+		t.Errorf("Dropped() = %d, want %d", dropped, n-2)
+	}
+
+	close(out.open)
+	w.Close()
+	if got := out.buf.String(); !strings.Contains(got, "WARN ") || !strings.Contains(got, "log records dropped") {
+		t.Errorf("no drop report written: %q", got)
+	}
+
+	if _, err := queueSettings(QueueConfig{Overflow: "spill"}); err == nil {
+		t.Error("unknown overflow policy accepted")
+	}
+	if _, err := queueSettings(QueueConfig{Overflow: "block-timeout"}); err == nil {
+		t.Error("block-timeout without overflowTimeout accepted")
+	}
+	// overflowTimeout is read like the other durations of the config.
+	if _, err := queueSettings(QueueConfig{Overflow: "block-timeout", OverflowTimeout: " 1d"}); err != nil {
+		t.Errorf("overflowTimeout in days: %s", err)
+	}
+}
+
+func TestRotateCompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "gz.log")
+	w, err := OpenFileLogWriter(filename, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetFormat("%M")
+
+	// Left behind by a process that died while compressing backup 2.
+	_ = ioutil.WriteFile(filename+".2", []byte("old\n"), 0660)
+	_ = ioutil.WriteFile(filename+".2.gz.tmp", []byte("partial"), 0660)
+	w.SetRotateCompress(true)
+
+	w.LogWrite(&LogRecord{Level: INFO, Message: "rotated"})
+	w.Rotate()
+	w.Close()
+
+	for name, want := range map[string]string{".1.gz": "rotated\n", ".3.gz": "old\n"} {
+		f, err := os.Open(filename + name)
+		if err != nil {
+			t.Errorf("backup %s: %s", name, err)
+			continue
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(zr)
+		f.Close()
+		if string(data) != want {
+			t.Errorf("backup %s = %q, want %q", name, data, want)
+		}
+	}
+	for _, name := range []string{".1", ".2", ".2.gz", ".2.gz.tmp", ".3"} {
+		if _, err := os.Stat(filename + name); err == nil {
+			t.Errorf("%s left behind", name)
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "kept.log")
+	now := time.Now()
+	for name, age := range map[string]time.Duration{
+		".2026-01-01":    40 * 24 * time.Hour,
+		".2026-01-02.gz": 48 * time.Hour,
+		".3":             24 * time.Hour,
+		".4":             3 * time.Hour,
+		".bak":           50 * 24 * time.Hour,
+	} {
+		_ = ioutil.WriteFile(filename+name, []byte("old\n"), 0660)
+		_ = os.Chtimes(filename+name, now.Add(-age), now.Add(-age))
+	}
+
+	w, err := OpenFileLogWriter(filename, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetRetention(30*24*time.Hour, 2, 0)
+	w.Close()
+
+	for name, kept := range map[string]bool{
+		".2026-01-01": false, ".2026-01-02.gz": false, ".3": true, ".4": true, ".bak": true,
+	} {
+		if _, err := os.Stat(filename + name); (err == nil) != kept {
+			t.Errorf("%s: kept = %v, want %v", name, err == nil, kept)
+		}
+	}
+
+	backups := []backup{{"a", now, 600}, {"b", now.Add(-time.Hour), 600}}
+	if got := (retention{maxTotalSize: 1000}).expired(backups, now); len(got) != 1 || got[0] != "b" {
+		t.Errorf("expired by size = %v, want [b]", got)
+	}
+}
+
+func TestRotateSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	hourly, _ := ParseSchedule("@hourly", time.UTC)
+	daily4, _ := Every(24*time.Hour, 4*time.Hour, time.UTC)
+	weekly, _ := ParseSchedule("@weekly", time.UTC)
+	weekdays, err := ParseSchedule("30 4 * * 1-5", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		schedule Schedule
+		from     string
+		want     string
+	}{
+		{hourly, "2026-01-31 23:30", "2026-02-01 00:00"},
+		{daily4, "2026-03-01 03:00", "2026-03-01 04:00"},
+		{daily4, "2026-03-01 04:00", "2026-03-02 04:00"},
+		{weekly, "2026-10-14 12:00", "2026-10-19 00:00"},
+		{weekdays, "2026-10-16 05:00", "2026-10-19 04:30"},
+	} {
+		if got := tt.schedule.Next(at(tt.from)); !got.Equal(at(tt.want)) {
+			t.Errorf("Next(%s) = %s, want %s", tt.from, got, tt.want)
+		}
+	}
+	if _, err := ParseSchedule("0 0 31 2 *", time.UTC); err == nil {
+		t.Error("schedule never firing accepted")
+	}
+
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The clock stands still so that no hour starts during the test, and the
+	// file is dated in that hour before each rotation.
+	now := at("2026-10-16 14:20")
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now }
+
+	filename := filepath.Join(dir, "app.log")
+	w, err := OpenFileLogWriter(filename, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetFormat("%M")
+	w.SetRotateSchedule(hourly)
+	if err := w.SetNameTemplate("app-%Y%m%d%H.log"); err != nil {
+		t.Fatal(err)
+	}
+	flush := func() {
+		if err := w.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, msg := range []string{"first", "second"} {
+		w.LogWrite(&LogRecord{Level: INFO, Message: msg})
+		flush()
+		if err := os.Chtimes(filename, now, now); err != nil {
+			t.Fatal(err)
+		}
+		w.Rotate()
+		flush()
+	}
+	w.Close()
+
+	backup := filepath.Join(dir, "app-"+now.Format("2006010215")+".log")
+	for name, want := range map[string]string{backup: "first\n", backup + ".1": "second\n"} {
+		if data, _ := ioutil.ReadFile(name); string(data) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), data, want)
+		}
+	}
+	if !w.backupMatcher()(filepath.Base(backup) + ".1") {
+		t.Error("backup not recognised for retention")
+	}
+
+	// On opening, a file of the current period is appended to, and one of an
+	// earlier period is named after the template.
+	config := FileConfig{Level: "DEBUG", Filename: filepath.Join(dir, "daily.log"), Pattern: "%M", Rotate: true,
+		Schedule: "@daily", Timezone: "UTC", NameTemplate: "daily-%Y%m%d.log"}
+	for _, tt := range []struct {
+		modified   time.Time
+		want, keep string
+	}{
+		{now.Add(-time.Hour), "old\nnew\n", ""},
+		{now.Add(-24 * time.Hour), "new\n", "daily-20261015.log"},
+	} {
+		if err := ioutil.WriteFile(config.Filename, []byte("old\n"), 0660); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(config.Filename, tt.modified, tt.modified); err != nil {
+			t.Fatal(err)
+		}
+		filt, err := NewFileFilter(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filt.LogWrite(&LogRecord{Level: INFO, Message: "new"})
+		filt.Close()
+		if data, _ := ioutil.ReadFile(config.Filename); string(data) != tt.want {
+			t.Errorf("file modified %s = %q, want %q", tt.modified, data, tt.want)
+		}
+		backups, _ := filepath.Glob(filepath.Join(dir, "daily-*"))
+		if got := strings.Join(backups, " "); tt.keep == "" && got != "" || tt.keep != "" && got != filepath.Join(dir, tt.keep) {
+			t.Errorf("backups %q, want %q", got, tt.keep)
+		}
+	}
+}
+
+// rotateEvery is a RotationPolicy rotating after every n records.
+type rotateEvery struct{ n, seen int }
+
+func (p *rotateEvery) ShouldRotate(state FileState, now time.Time) bool {
+	p.seen++
+	return p.seen%p.n == 1 && p.seen > 1
+}
+
+func TestRotationPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The clock stands still so that no day starts during the test.
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.Local)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now }
+
+	// A file of today left by an earlier process is appended to, and its
+	// lines count towards the limit.
+	filename := filepath.Join(dir, "seeded.log")
+	_ = ioutil.WriteFile(filename, []byte("a\nb\nc\n"), 0660)
+	_ = os.Chtimes(filename, now.Add(-time.Hour), now.Add(-time.Hour))
+	w, err := OpenFileLogWriter(filename, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetFormat("%M")
+	w.SetRotateLines(5)
+	if state := w.fileState(); state.Lines != 3 || state.Size != 6 {
+		t.Errorf("seeded state = %+v, want 3 lines of 6 bytes", state)
+	}
+	for _, msg := range []string{"d", "e", "f"} {
+		w.LogWrite(&LogRecord{Level: INFO, Message: msg})
+	}
+	w.Close()
+
+	// The backup is named after the last write to it, as the file system
+	// dated it.
+	backups, _ := filepath.Glob(filename + ".*")
+	if len(backups) != 1 {
+		t.Fatalf("backups = %v", backups)
+	}
+	info, err := os.Stat(backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup := filename + "." + info.ModTime().Format("2006-01-02"); backups[0] != backup {
+		t.Errorf("backup = %s, want %s", backups[0], backup)
+	}
+	backup := backups[0]
+	if data, _ := ioutil.ReadFile(backup); string(data) != "a\nb\nc\nd\ne\n" {
+		t.Errorf("backup = %q", data)
+	}
+	if data, _ := ioutil.ReadFile(filename); string(data) != "f\n" {
+		t.Errorf("log = %q", data)
+	}
+
+	// A policy of our own, combined with the built-in ones.
+	filename = filepath.Join(dir, "custom.log")
+	if w, err = OpenFileLogWriter(filename, true, false); err != nil {
+		t.Fatal(err)
+	}
+	w.SetFormat("%M")
+	w.SetRotateSize(1024).SetRotationPolicy(&rotateEvery{n: 2})
+	for i := 0; i < 4; i++ {
+		w.LogWrite(&LogRecord{Level: INFO, Message: fmt.Sprint(i)})
+	}
+	w.Close()
+	for name, want := range map[string]string{".1": "0\n1\n", "": "2\n3\n"} {
+		if data, _ := ioutil.ReadFile(filename + name); string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "moved.log")
+	w, err := OpenFileLogWriter(filename, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetFormat("%M")
+	w.SetReopenCheck(10 * time.Millisecond).SetCopyTruncate(true)
+	state := func() FileState {
+		reply := make(chan FileState, 1)
+		_ = w.do(context.Background(), func() { reply <- w.fileState() })
+		return <-reply
+	}
+	waitFor := func(what string, cond func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	// Moved away, as logrotate does: noticed by the check.
+	w.LogWrite(&LogRecord{Level: INFO, Message: "a"})
+	_ = w.Flush(context.Background())
+	if err := os.Rename(filename, filename+".1"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("reopen", func() bool { _, err := os.Stat(filename); return err == nil })
+	w.LogWrite(&LogRecord{Level: INFO, Message: "b"})
+
+	// Truncated in place, as copytruncate does.
+	_ = w.Flush(context.Background())
+	if err := os.Truncate(filename, 0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("truncation", func() bool { return state().Size == 0 })
+
+	// Moved away and reopened on request.
+	if err := os.Rename(filename, filename+".2"); err != nil {
+		t.Fatal(err)
+	}
+	w.SetReopenCheck(0)
+	if err := w.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	w.LogWrite(&LogRecord{Level: INFO, Message: "c"})
+	w.Close()
+
+	for name, want := range map[string]string{".1": "a\n", ".2": "", "": "c\n"} {
+		if data, _ := ioutil.ReadFile(filename + name); string(data) != want {
+			t.Errorf("%q = %q, want %q", "moved.log"+name, data, want)
+		}
+	}
+}
+
+func TestSharedFileLogWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Two writers on one file stand for two processes: their flocks are
+	// taken on separate open files, so they exclude each other all the same.
+	filename := filepath.Join(dir, "shared.log")
+	var writers []*FileLogWriter
+	for i := 0; i < 2; i++ {
+		w, err := OpenSharedFileLogWriter(filename, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.SetFormat("%M")
+		w.SetRotateSize(64)
+		writers = append(writers, w)
+	}
+
+	const n = 100
+	var wg sync.WaitGroup
+	for i, w := range writers {
+		wg.Add(1)
+		go func(i int, w *FileLogWriter) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				w.LogWrite(&LogRecord{Level: INFO, Message: fmt.Sprintf("w%d-%03d", i, j)})
+			}
+			w.Close()
+		}(i, w)
+	}
+	wg.Wait()
+
+	files, _ := filepath.Glob(filename + "*")
+	lines := 0
+	for _, name := range files {
+		if strings.HasSuffix(name, ".lock") {
+			continue
+		}
+		data, _ := ioutil.ReadFile(name)
+		if len(data) > 64+7 {
+			t.Errorf("%s holds %d bytes: rotated too late", filepath.Base(name), len(data))
+		}
+		lines += strings.Count(string(data), "\n")
+	}
+	if lines != 2*n {
+		t.Errorf("%d lines in %d files, want %d", lines, len(files), 2*n)
+	}
+}
+
+func TestConnWriterSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Reserve an address, then leave it unserved: the collector is down.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	w := NewConn("tcp", addr, "%M", INFO)
+	w.SetBackoff(10*time.Millisecond, 20*time.Millisecond)
+	w.SetSpool(2, dir, 0)
+	for i := 0; i < 5; i++ {
+		w.LogWrite(&LogRecord{Level: INFO, Message: fmt.Sprint(i)})
+	}
+	_ = w.Flush(context.Background())
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.spool")); len(files) != 1 {
+		t.Fatalf("spool files: %v", files)
+	}
+
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Skipf("cannot listen on %s again: %s", addr, err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	w.LogWrite(&LogRecord{Level: INFO, Message: "5"})
+	w.Close()
+
+	select {
+	case got := <-received:
+		if got := strings.Join(strings.Fields(got), " "); got != "0 1 2 3 4 5" {
+			t.Errorf("received %q, want the records in order", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.spool")); len(files) != 0 {
+		t.Errorf("spool left after replay: %v", files)
+	}
+}
+
+func TestSpoolClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "conn.spool")
+	s := newSpool(0, path, 0)
+	for _, msg := range []string{"0", "1", "2", "3"} {
+		if !s.push([]byte(msg)) {
+			t.Fatalf("push %s failed", msg)
+		}
+	}
+
+	// The collector goes down again after two messages of the file.
+	var sent []string
+	down := errors.New("down")
+	_ = s.replay(func(msg []byte) error {
+		if len(sent) == 2 {
+			return down
+		}
+		sent = append(sent, string(msg))
+		return nil
+	})
+	if lost := s.close(); lost != 0 {
+		t.Errorf("close lost %d messages", lost)
+	}
+
+	// The next process only sends what was not delivered.
+	s = newSpool(0, path, 0)
+	if err := s.replay(func(msg []byte) error {
+		sent = append(sent, string(msg))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(sent, " "); got != "0 1 2 3" {
+		t.Errorf("sent %q, want each message once", got)
+	}
+
+	// A garbled header ends the file without allocating what it claims.
+	s = newSpool(0, path, 0)
+	s.push([]byte("4"))
+	s.close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 'x'})
+	_ = f.Close()
+	s = newSpool(0, path, 0)
+	sent = nil
+	if err := s.replay(func(msg []byte) error {
+		sent = append(sent, string(msg))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(sent, " "); got != "4" || !s.empty() {
+		t.Errorf("sent %q from a garbled file", got)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("garbled file kept: %v", err)
+	}
+}
+
+func TestConnWriterTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Borrow the test certificate of net/http/httptest, valid for 127.0.0.1,
+	// as the CA, the server and the client certificate.
+	s := httptest.NewTLSServer(nil)
+	s.Close()
+	cert := s.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	_ = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	_ = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		if len(conn.(*tls.Conn).ConnectionState().PeerCertificates) == 0 {
+			data = []byte("no client certificate")
+		}
+		received <- string(data)
+	}()
+
+	w := NewConn("tcp", ln.Addr().String(), "%M", INFO)
+	if err := w.SetTLS(&TLSConfig{CA: certFile, MinVersion: "1.4"}); err == nil {
+		t.Error("SetTLS accepted TLS 1.4")
+	}
+	if err := w.SetTLS(&TLSConfig{CA: certFile, Cert: certFile, Key: keyFile}); err != nil {
+		t.Fatal(err)
+	}
+	w.LogWrite(&LogRecord{Level: INFO, Message: "secret"})
+	w.Close()
+
+	select {
+	case got := <-received:
+		if strings.TrimSpace(got) != "secret" {
+			t.Errorf("received %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+	}
+}
+
+func TestSyslogWriter(t *testing.T) {
+	created := time.Date(2020, 3, 20, 14, 34, 31, 5000, time.UTC)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	filt, err := NewSyslogFilter(SyslogConfig{
+		FilterConfig: FilterConfig{Level: "DEBUG"},
+		Addr:         pc.LocalAddr().String(),
+		Facility:     "local0",
+		Hostname:     "web 1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filt.LogWrite(&LogRecord{Level: WARN, Created: created, Category: "db", Message: "slow query"})
+	filt.Close()
+
+	buf := make([]byte, 1024)
+	_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("<132>1 2020-03-20T14:34:31.000005Z web_1 %s %d db - slow query", Project, os.Getpid())
+	if got := string(buf[:n]); got != want {
+		t.Errorf("udp message\n got %q\nwant %q", got, want)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	w := NewSyslogWriter("tcp", ln.Addr().String(), DEBUG)
+	w.SetSyslogFormat(RFC3164)
+	w.SetHostname("web1")
+	w.SetAppName("api")
+	w.LogWrite(&LogRecord{Level: ERROR, Created: created, Message: "a"})
+	w.LogWrite(&LogRecord{Level: INFO, Created: created, Message: "b"})
+	w.Close()
+
+	msg := func(pri int, text string) string {
+		m := fmt.Sprintf("<%d>Mar 20 14:34:31 web1 api[%d]: %s", pri, os.Getpid(), text)
+		return fmt.Sprintf("%d %s", len(m), m)
+	}
+	select {
+	case got := <-received:
+		if want := msg(11, "a") + msg(14, "b"); got != want {
+			t.Errorf("tcp stream\n got %q\nwant %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+	}
+}
+
+func TestGELFWriter(t *testing.T) {
+	created := time.Date(2020, 3, 20, 14, 34, 31, 5000, time.UTC)
+	rec := &LogRecord{
+		Level:    ERROR,
+		Created:  created,
+		Source:   "main.main:12",
+		Category: "db",
+		Message:  "query failed\n" + strings.Repeat("stack ", 100),
+		Fields:   Fields{{Key: "user id", Value: 42}, {Key: "id", Value: "x"}},
+	}
+	check := func(data []byte) {
+		t.Helper()
+		var got map[string]interface{}
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: %q", err, data)
+		}
+		want := map[string]interface{}{
+			"version": "1.1", "short_message": "query failed", "full_message": rec.Message,
+			"timestamp": 1584714871.000005, "level": 3.0, "_category": "db", "_project": Project,
+			"_file": "main.main", "_line": 12.0, "_user_id": 42.0, "_fields.id": "x",
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%s = %v, want %v", k, got[k], v)
+			}
+		}
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	filt, err := NewSocketFilter(SocketConfig{
+		Level:       "DEBUG",
+		Format:      "gelf",
+		Addr:        pc.LocalAddr().String(),
+		Compression: "zlib",
+		ChunkSize:   64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filt.LogWrite(rec)
+	filt.Close()
+
+	var chunks [][]byte
+	buf := make([]byte, 1024)
+	for count := 1; len(chunks) < count; {
+		_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 64 || buf[0] != 0x1e || buf[1] != 0x0f {
+			t.Fatalf("not a chunk of at most 64 bytes: %q", buf[:n])
+		}
+		count = int(buf[11])
+		chunks = append(chunks, append([]byte(nil), buf[:n]...))
+	}
+	var payload []byte
+	for seq, chunk := range chunks {
+		if int(chunk[10]) != seq || !bytes.Equal(chunk[2:10], chunks[0][2:10]) {
+			t.Fatalf("chunk %d out of sequence", seq)
+		}
+		payload = append(payload, chunk[12:]...)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(data)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	}()
+	w := NewGELFWriter("tcp", ln.Addr().String(), DEBUG)
+	w.LogWrite(rec)
+	w.LogWrite(rec)
+	w.Close()
+	select {
+	case data := <-received:
+		messages := bytes.Split(data, []byte{0})
+		if len(messages) != 3 || len(messages[2]) != 0 {
+			t.Fatalf("want 2 null-terminated messages, got %q", data)
+		}
+		check(messages[0])
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+	}
+}
+
+func TestHTTPWriter(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	calls := 0
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("X-Source") != "test" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if calls == 1 {
+			rw.Header().Set("Retry-After", "1")
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		body := r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		data, _ := ioutil.ReadAll(body)
+		bodies = append(bodies, r.Header.Get("Content-Type")+" "+string(data))
+	}))
+	defer s.Close()
+
+	w := NewHTTPWriter(s.URL, DEBUG)
+	w.SetFormat("%M")
+	w.SetBatchFormat(HTTPBatchNDJSON)
+	w.SetGzip(true)
+	w.SetHeader("X-Source", "test")
+	w.SetAuthToken("secret")
+	w.SetBatchLimits(2, 0, 20*time.Millisecond)
+	w.SetRetries(3, time.Millisecond, 10*time.Millisecond)
+	start := time.Now()
+	for _, msg := range []string{"a", "b", "c"} {
+		w.LogWrite(&LogRecord{Level: INFO, Message: msg})
+	}
+	// "c" goes after batchWait without a Flush.
+	var got string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		got = strings.Join(bodies, "|")
+		mu.Unlock()
+		if strings.Count(got, "|") == 1 {
+			break
+		}
+	}
+	if want := "application/x-ndjson a\nb\n|application/x-ndjson c\n"; got != want {
+		t.Errorf("bodies %q, want %q", got, want)
+	}
+	// Retry-After asked for longer than the maximum backoff.
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want Retry-After: 1 obeyed", elapsed)
+	}
+	// Write sends the bytes as the message of a record, laid out like the others.
+	w.SetFormat("[%L] %M")
+	if n, err := w.Write([]byte("raw\n")); n != 4 || err != nil {
+		t.Errorf("Write = %d, %v", n, err)
+	}
+	mu.Lock()
+	got = bodies[len(bodies)-1]
+	mu.Unlock()
+	if want := "application/x-ndjson [INFO] raw\n"; got != want {
+		t.Errorf("Write body %q, want %q", got, want)
+	}
+	w.Close()
+
+	// A Retry-After over the limit gives the batch up at once.
+	mu.Lock()
+	calls = 0
+	mu.Unlock()
+	w = NewHTTPWriter(s.URL, DEBUG)
+	w.SetHeader("X-Source", "test")
+	w.SetAuthToken("secret")
+	w.SetRetryAfterLimit(500 * time.Millisecond)
+	start = time.Now()
+	w.LogWrite(&LogRecord{Level: INFO, Message: "limited"})
+	if err := w.Flush(context.Background()); err == nil || !strings.Contains(err.Error(), "over the limit") {
+		t.Errorf("Flush = %v, want the batch given up", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("gave up after %s", elapsed)
+	}
+	w.Close()
+
+	// The deadline of CloseContext cuts the wait for a retry short.
+	mu.Lock()
+	calls = 0
+	mu.Unlock()
+	w = NewHTTPWriter(s.URL, DEBUG)
+	w.SetHeader("X-Source", "test")
+	w.SetAuthToken("secret")
+	w.LogWrite(&LogRecord{Level: INFO, Message: "closing"})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := w.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("CloseContext = %v", err)
+	}
+	select {
+	case <-w.done:
+		if elapsed := time.Since(start); elapsed >= time.Second {
+			t.Errorf("writer stopped after %s", elapsed)
+		}
+	case <-time.After(900 * time.Millisecond):
+		t.Error("writer still waiting to retry after CloseContext gave up")
+	}
+
+	var failures []*DeliveryError
+	w = NewHTTPWriter(s.URL, DEBUG)
+	w.SetErrorHandler(func(err *DeliveryError) { failures = append(failures, err) })
+	w.LogWrite(&LogRecord{Level: INFO, Message: "unauthorized"})
+	if err := w.Flush(context.Background()); err == nil {
+		t.Error("Flush did not report the failed batch")
+	}
+	w.Close()
+	if w.Failed() != 1 || len(failures) != 1 || failures[0].StatusCode != http.StatusUnauthorized {
+		t.Errorf("failures %d %v", w.Failed(), failures)
+	}
+
+	if d := parseRetryAfter("Wed, 21 Oct 2015 07:28:30 GMT", time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)); d != 30*time.Second {
+		t.Errorf("Retry-After date = %s", d)
+	}
+}
+
+func TestElasticsearchWriter(t *testing.T) {
+	var mu sync.Mutex
+	var requests [][]string
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if user, pass, _ := r.BasicAuth(); r.URL.Path != "/_bulk" || user != "elastic" || pass != "pw" {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		requests = append(requests, lines)
+		if len(requests) == 1 {
+			_, _ = rw.Write([]byte(`{"errors":true,"items":[
+				{"create":{"status":201}},
+				{"create":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}},
+				{"create":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"bad field"}}}]}`))
+			return
+		}
+		_, _ = rw.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+	}))
+	defer s.Close()
+
+	if _, err := NewElasticsearchFilter(ElasticsearchConfig{FilterConfig: FilterConfig{Level: "DEBUG", Pattern: "%M"}, URL: s.URL}); err == nil || !strings.Contains(err.Error(), "not used") {
+		t.Errorf("pattern without a layout to use it: %v", err)
+	}
+	filt, err := NewElasticsearchFilter(ElasticsearchConfig{
+		FilterConfig: FilterConfig{Level: "DEBUG"},
+		URL:          s.URL + "/",
+		Index:        "app-%Y.%m.%d",
+		Username:     "elastic",
+		Password:     "pw",
+		BatchConfig:  BatchConfig{BackoffMin: "1ms", BackoffMax: "1ms"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2020, 3, 20, 23, 30, 0, 0, time.FixedZone("", -2*3600))
+	for _, msg := range []string{"ok", "busy", "bad"} {
+		filt.LogWrite(&LogRecord{Level: INFO, Created: created, Source: "main.main:12", Category: "db", Message: msg, Fields: Fields{{Key: "user", Value: 42}}})
+	}
+	if err := filt.Flush(context.Background()); err == nil || !strings.Contains(err.Error(), "mapper_parsing_exception") {
+		t.Errorf("Flush = %v, want the rejected document", err)
+	}
+	filt.Close()
+
+	if len(requests) != 2 || len(requests[0]) != 6 || len(requests[1]) != 2 {
+		t.Fatalf("requests %q", requests)
+	}
+	if want := `{"create":{"_index":"app-2020.03.21"}}`; requests[0][0] != want {
+		t.Errorf("action %s, want %s", requests[0][0], want)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(requests[1][1]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"@timestamp": "2020-03-21T01:30:00.000Z", "log.level": "INFO", "log.logger": "db",
+		"log.origin.function": "main.main", "log.origin.file.line": 12.0, "message": "busy",
+		"service.name": Project, "fields": map[string]interface{}{"user": 42.0},
+	}
+	if fmt.Sprint(doc) != fmt.Sprint(want) {
+		t.Errorf("retried document %v, want %v", doc, want)
+	}
+	if failed := filt.LogWriter.(*ElasticsearchWriter).Failed(); failed != 1 {
+		t.Errorf("Failed() = %d, want 1", failed)
+	}
+
+	// A response that does not tell about every document has the batch sent
+	// again; Write indexes the bytes as the message of a document.
+	var bodies []string
+	s = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		data, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(data))
+		switch len(bodies) {
+		case 1:
+			_, _ = rw.Write([]byte(`<html>proxy error</html>`))
+		case 2:
+			_, _ = rw.Write([]byte(`{"errors":false,"items":[]}`))
+		default:
+			_, _ = rw.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+		}
+	}))
+	defer s.Close()
+	w := NewElasticsearchWriter(s.URL, DEBUG)
+	if err := w.SetIndex("app"); err != nil {
+		t.Fatal(err)
+	}
+	w.SetRetries(3, time.Millisecond, time.Millisecond)
+	if n, err := w.Write([]byte("raw\n")); n != 4 || err != nil {
+		t.Errorf("Write = %d, %v", n, err)
+	}
+	w.Close()
+	if len(bodies) != 3 || bodies[1] != bodies[0] || bodies[2] != bodies[0] {
+		t.Fatalf("bodies %q", bodies)
+	}
+	lines := strings.Split(strings.TrimSuffix(bodies[0], "\n"), "\n")
+	doc = nil
+	if len(lines) != 2 || lines[0] != `{"create":{"_index":"app"}}` || json.Unmarshal([]byte(lines[1]), &doc) != nil {
+		t.Fatalf("written document %q", lines)
+	}
+	if doc["message"] != "raw" || doc["log.level"] != "INFO" {
+		t.Errorf("written document %v", doc)
+	}
+	if failed := w.Failed(); failed != 0 {
+		t.Errorf("Failed() = %d, want 0", failed)
+	}
+}
+
+func TestLokiWriter(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	var types []string
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/loki/api/v1/push" || r.Header.Get("X-Scope-OrgID") != "team" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, data)
+		types = append(types, r.Header.Get("Content-Type"))
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	created := time.Unix(1584714871, 5)
+	records := []*LogRecord{
+		{Level: INFO, Created: created, Category: "db", Message: "a", Fields: Fields{{Key: "user", Value: 1}}},
+		{Level: INFO, Created: created, Category: "db", Message: "b"},
+		{Level: WARN, Created: created.Add(-time.Second), Category: "db", Message: "c"},
+		{Level: INFO, Created: created.Add(-time.Second), Category: "db", Message: "d"},
+	}
+	log := func(encoding string) {
+		filt, err := NewLokiFilter(LokiConfig{
+			FilterConfig: FilterConfig{Level: "DEBUG", Pattern: "%M"},
+			URL:          s.URL,
+			Encoding:     encoding,
+			Labels:       map[string]string{"env": "test", "level": "overridden"},
+			LabelKeys:    []string{"category", "level"},
+			Tenant:       "team",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range records {
+			filt.LogWrite(rec)
+		}
+		if err := filt.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		filt.Close()
+	}
+
+	log("json")
+	want := `{"streams":[` +
+		`{"stream":{"category":"db","env":"test","level":"INFO"},"values":[["1584714871000000005","a"],["1584714871000000006","b"],["1584714871000000007","d"]]},` +
+		`{"stream":{"category":"db","env":"test","level":"WARN"},"values":[["1584714870000000005","c"]]}]}`
+	if len(bodies) != 1 || string(bodies[0]) != want || types[0] != "application/json" {
+		t.Fatalf("json push %s %q\nwant %s", types, bodies, want)
+	}
+
+	log("protobuf")
+	if len(bodies) != 2 || types[1] != "application/x-protobuf" {
+		t.Fatalf("protobuf push %s", types)
+	}
+	req, err := snappyDecode(bodies[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, stream := range protoFields(req) {
+		fields := protoFields(stream.data)
+		labels := string(fields[0].data)
+		for _, entry := range fields[1:] {
+			e := protoFields(entry.data)
+			ts := protoFields(e[0].data)
+			got = append(got, fmt.Sprintf("%s %d.%d %s", labels, ts[0].varint, ts[1].varint, e[1].data))
+		}
+	}
+	wantEntries := []string{
+		`{category="db", env="test", level="INFO"} 1584714871.5 a`,
+		`{category="db", env="test", level="INFO"} 1584714871.6 b`,
+		`{category="db", env="test", level="INFO"} 1584714871.7 d`,
+		`{category="db", env="test", level="WARN"} 1584714870.5 c`,
+	}
+	if strings.Join(got, "\n") != strings.Join(wantEntries, "\n") {
+		t.Errorf("protobuf entries\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(wantEntries, "\n"))
+	}
+
+	// Write pushes the bytes as the line of an entry; the streams of the
+	// entries pushed long ago are forgotten.
+	w := NewLokiWriter(s.URL, DEBUG)
+	w.SetTenant("team")
+	w.SetEncoding(LokiJSON)
+	w.SetFormat("%M")
+	w.SetLabelKeys(LokiLabelLevel)
+	w.LogWrite(&LogRecord{Level: WARN, Created: created, Message: "old"})
+	if err := w.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := w.Write([]byte("raw\n")); n != 4 || err != nil {
+		t.Errorf("Write = %d, %v", n, err)
+	}
+	w.Close()
+	if len(bodies) != 4 || !strings.HasPrefix(string(bodies[3]), `{"streams":[{"stream":{"level":"INFO"},"values":[["`) ||
+		!strings.HasSuffix(string(bodies[3]), `","raw"]]}]}`) {
+		t.Errorf("written push %q", bodies[2:])
+	}
+	w.mu.Lock()
+	streams := len(w.last)
+	w.mu.Unlock()
+	if streams != 1 {
+		t.Errorf("%d streams remembered, want 1", streams)
+	}
+
+	// Without a batch wait, the entries of the next batches still come after
+	// the last one of their stream.
+	w = NewLokiWriter(s.URL, DEBUG)
+	w.SetTenant("team")
+	w.SetEncoding(LokiJSON)
+	w.SetFormat("%M")
+	w.SetLabelKeys(LokiLabelLevel)
+	w.SetBatchLimits(1, 0, 0)
+	recent := time.Now()
+	for _, msg := range []string{"x", "y"} {
+		w.LogWrite(&LogRecord{Level: INFO, Created: recent, Message: msg})
+	}
+	w.Close()
+	var ts []string
+	for _, body := range bodies[4:] {
+		var req struct{ Streams []struct{ Values [][2]string } }
+		if err := json.Unmarshal(body, &req); err != nil || len(req.Streams) != 1 || len(req.Streams[0].Values) != 1 {
+			t.Fatalf("push %s: %v", body, err)
+		}
+		ts = append(ts, req.Streams[0].Values[0][0])
+	}
+	if want := []string{fmt.Sprint(recent.UnixNano()), fmt.Sprint(recent.UnixNano() + 1)}; fmt.Sprint(ts) != fmt.Sprint(want) {
+		t.Errorf("timestamps %v, want %v", ts, want)
+	}
+
+	data := []byte(strings.Repeat("a repeated line of log, ", 1000) + "end")
+	encoded := snappyEncode(data)
+	if decoded, err := snappyDecode(encoded); err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("snappy round trip failed: %v", err)
+	}
+	if len(encoded) > len(data)/10 {
+		t.Errorf("snappy did not compress: %d bytes for %d", len(encoded), len(data))
+	}
+}
+
+func TestSplunkWriter(t *testing.T) {
+	defer func(interval time.Duration) { splunkAckInterval = interval }(splunkAckInterval)
+	splunkAckInterval = 20 * time.Millisecond
+
+	var mu sync.Mutex
+	var events []string
+	var nextAck int64
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Splunk tok" || r.Header.Get("X-Splunk-Request-Channel") == "" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/services/collector/event":
+			data, _ := ioutil.ReadAll(r.Body)
+			events = append(events, string(data))
+			fmt.Fprintf(rw, `{"text":"Success","code":0,"ackId":%d}`, nextAck)
+			nextAck++
+		case "/services/collector/ack":
+			var req struct{ Acks []int64 }
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			acks := make(map[string]bool)
+			for _, id := range req.Acks {
+				// The first sending of the second batch is lost.
+				acks[fmt.Sprint(id)] = id != 1
+			}
+			_ = json.NewEncoder(rw).Encode(map[string]interface{}{"acks": acks})
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	w := NewSplunkWriter(s.URL, "tok", DEBUG)
+	w.SetFormat("%M")
+	w.SetHost("web1")
+	w.SetEventMetadata("", "", "main")
+	w.SetAcknowledgement(true, 100*time.Millisecond)
+	created := time.Unix(1584714871, 250e6)
+	w.LogWrite(&LogRecord{Level: INFO, Created: created, Source: "main.serve:12", Message: "first"})
+	if err := w.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w.LogWrite(&LogRecord{Level: INFO, Created: created, Source: "main.serve:13", Message: "second"})
+	if err := w.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	mu.Lock()
+	got := append([]string(nil), events...)
+	events = nil
+	mu.Unlock()
+	want := []string{
+		`{"time":1584714871.250,"host":"web1","source":"main.serve","sourcetype":"_json","index":"main","event":"first"}` + "\n",
+		`{"time":1584714871.250,"host":"web1","source":"main.serve","sourcetype":"_json","index":"main","event":"second"}` + "\n",
+	}
+	if len(got) != 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[1] {
+		t.Fatalf("events %q\nwant %q then the second again", got, want)
+	}
+	if n := w.Failed(); n != 0 {
+		t.Errorf("%d records failed", n)
+	}
+
+	// Only JSONLayout makes objects of the events; any other layout makes
+	// strings, even of messages that read as JSON.  Write sends the bytes as
+	// the message of a record.
+	w = NewSplunkWriter(s.URL, "tok", DEBUG)
+	w.SetFormat("%M")
+	w.SetAcknowledgement(true, 100*time.Millisecond)
+	w.LogWrite(&LogRecord{Level: INFO, Created: created, Message: "123"})
+	if err := w.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := w.Write([]byte("null\n")); n != 5 || err != nil {
+		t.Errorf("Write = %d, %v", n, err)
+	}
+	w.SetLayout(JSONLayout{})
+	w.LogWrite(&LogRecord{Level: INFO, Created: created, Message: "123"})
+	w.Close()
+	mu.Lock()
+	got = append([]string(nil), events...)
+	mu.Unlock()
+	if len(got) != 3 || !strings.HasSuffix(got[0], `"event":"123"}`+"\n") || !strings.HasSuffix(got[1], `"event":"null"}`+"\n") ||
+		!strings.Contains(got[2], `"event":{`) {
+		t.Errorf("events %q", got)
+	}
+}
+
+func TestOTLPWriter(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	var types []string
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/v1/logs" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, data)
+		types = append(types, r.Header.Get("Content-Type"))
+	}))
+	defer s.Close()
+
+	created := time.Unix(1584714871, 5)
+	records := []*LogRecord{
+		{Level: WARN, Created: created, Source: "main.serve:12", Category: "db", Message: "slow",
+			Fields: Fields{{Key: TraceIDKey, Value: "0af7651916cd43dd8448eb211c80319c"}, {Key: SpanIDKey, Value: "b7ad6b7169203331"}, {Key: "rows", Value: 3}}},
+		{Level: INFO, Created: created, Message: "up", Fields: Fields{{Key: SpanIDKey, Value: "bad"}}},
+	}
+	log := func(encoding string) {
+		filt, err := NewOTLPFilter(OTLPConfig{
+			FilterConfig: FilterConfig{Level: "DEBUG"},
+			URL:          s.URL,
+			Encoding:     encoding,
+			Attributes:   map[string]string{"deployment.environment": "test"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range records {
+			filt.LogWrite(rec)
+		}
+		if err := filt.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		filt.Close()
+	}
+
+	log("json")
+	if len(bodies) != 1 || types[0] != "application/json" {
+		t.Fatalf("json export %s", types)
+	}
+	var req struct {
+		ResourceLogs []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string
+					Value map[string]interface{}
+				}
+			}
+			ScopeLogs []struct {
+				Scope      struct{ Name string }
+				LogRecords []struct {
+					TimeUnixNano   string
+					SeverityNumber int
+					SeverityText   string
+					Body           map[string]interface{}
+					Attributes     []struct {
+						Key   string
+						Value map[string]interface{}
+					}
+					TraceID string
+					SpanID  string
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(bodies[0], &req); err != nil {
+		t.Fatalf("%s: %s", err, bodies[0])
+	}
+	rl := req.ResourceLogs[0]
+	if len(rl.Resource.Attributes) != 2 || rl.Resource.Attributes[0].Key != "service.name" || rl.Resource.Attributes[0].Value["stringValue"] != Project {
+		t.Errorf("resource %+v", rl.Resource)
+	}
+	if len(rl.ScopeLogs) != 2 || rl.ScopeLogs[0].Scope.Name != "db" || rl.ScopeLogs[1].Scope.Name != "DEFAULT" {
+		t.Fatalf("scopes %s", bodies[0])
+	}
+	r := rl.ScopeLogs[0].LogRecords[0]
+	if r.TimeUnixNano != "1584714871000000005" || r.SeverityNumber != 13 || r.SeverityText != "WARN" || r.Body["stringValue"] != "slow" ||
+		r.TraceID != "0af7651916cd43dd8448eb211c80319c" || r.SpanID != "b7ad6b7169203331" {
+		t.Errorf("log record %+v", r)
+	}
+	var attrs []string
+	for _, a := range r.Attributes {
+		attrs = append(attrs, fmt.Sprintf("%s=%v", a.Key, a.Value))
+	}
+	if got := strings.Join(attrs, " "); got != "code.function=map[stringValue:main.serve] code.lineno=map[intValue:12] rows=map[intValue:3]" {
+		t.Errorf("attributes %s", got)
+	}
+	if r := rl.ScopeLogs[1].LogRecords[0]; r.SpanID != "" || len(r.Attributes) != 1 || r.Attributes[0].Key != SpanIDKey {
+		t.Errorf("an invalid span id is an attribute: %+v", r)
+	}
+
+	log("protobuf")
+	if len(bodies) != 2 || types[1] != "application/x-protobuf" {
+		t.Fatalf("protobuf export %s", types)
+	}
+	resourceLogs := protoFields(protoFields(bodies[1])[0].data)
+	service := protoFields(protoFields(resourceLogs[0].data)[0].data)
+	if string(service[0].data) != "service.name" || string(protoFields(service[1].data)[0].data) != Project {
+		t.Errorf("resource %q", resourceLogs[0].data)
+	}
+	scope := protoFields(resourceLogs[1].data)
+	if string(protoFields(scope[0].data)[0].data) != "db" {
+		t.Errorf("scope %q", scope[0].data)
+	}
+	got := make(map[int]string)
+	for _, f := range protoFields(scope[1].data) {
+		if f.num == 6 {
+			kv := protoFields(f.data)
+			got[6] += fmt.Sprintf("%s=%v ", kv[0].data, protoFields(kv[1].data)[0])
+		} else if f.num != 11 {
+			got[f.num] = fmt.Sprintf("%d %x", f.varint, f.data)
+		}
+	}
+	want := map[int]string{
+		1:  fmt.Sprintf("%d ", created.UnixNano()),
+		2:  "13 ",
+		3:  "0 5741524e",
+		5:  "0 0a04736c6f77",
+		6:  "code.function={1 0 [109 97 105 110 46 115 101 114 118 101]} code.lineno={3 12 []} rows={3 3 []} ",
+		9:  "0 0af7651916cd43dd8448eb211c80319c",
+		10: "0 b7ad6b7169203331",
+	}
+	for num, value := range want {
+		if got[num] != value {
+			t.Errorf("field %d: %q, want %q", num, got[num], value)
+		}
+	}
+
+	// Write exports the bytes as the body of a log record.
+	w := NewOTLPWriter(s.URL, DEBUG)
+	w.SetEncoding(OTLPJSON)
+	if n, err := w.Write([]byte("raw\n")); n != 4 || err != nil {
+		t.Errorf("Write = %d, %v", n, err)
+	}
+	w.Close()
+	if len(bodies) != 3 || types[2] != "application/json" {
+		t.Fatalf("written export %s", types)
+	}
+	req.ResourceLogs = nil
+	if err := json.Unmarshal(bodies[2], &req); err != nil {
+		t.Fatalf("%s: %s", err, bodies[2])
+	}
+	if len(req.ResourceLogs) != 1 || len(req.ResourceLogs[0].ScopeLogs) != 1 || len(req.ResourceLogs[0].ScopeLogs[0].LogRecords) != 1 {
+		t.Fatalf("written export %s", bodies[2])
+	}
+	if r := req.ResourceLogs[0].ScopeLogs[0].LogRecords[0]; r.SeverityText != "INFO" || r.Body["stringValue"] != "raw" {
+		t.Errorf("written log record %+v", r)
+	}
+}
+
+func TestFluentWriter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type forward struct {
+		tag, chunk string
+		entries    []interface{}
+		size       int64
+	}
+	received := make(chan forward, 16)
+	var mu sync.Mutex
+	lost := false
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					msg, err := readMsgpack(r)
+					if err != nil {
+						return
+					}
+					m := msg.([]interface{})
+					options := m[2].(map[string]interface{})
+					f := forward{tag: m[0].(string), size: options["size"].(int64)}
+					entries := bufio.NewReader(bytes.NewReader(m[1].([]byte)))
+					for {
+						entry, err := readMsgpack(entries)
+						if err == io.EOF {
+							break
+						} else if err != nil {
+							t.Errorf("bad entry: %s", err)
+							break
+						}
+						f.entries = append(f.entries, entry)
+					}
+					f.chunk, _ = options["chunk"].(string)
+					received <- f
+					mu.Lock()
+					first := !lost
+					lost = true
+					mu.Unlock()
+					if first {
+						// The first batch is not acknowledged.
+						continue
+					}
+					ack := appendMsgpackMap(nil, 1)
+					ack = appendMsgpackString(ack, "ack")
+					_, _ = conn.Write(appendMsgpackString(ack, f.chunk))
+				}
+			}(conn)
+		}
+	}()
+
+	w := NewFluentWriter("tcp", ln.Addr().String(), DEBUG)
+	w.SetAck(true, 100*time.Millisecond)
+	w.SetBackoff(time.Millisecond, time.Millisecond)
+	w.SetBatchLimits(0, 0, 0)
+	created := time.Unix(1584714871, 5)
+	w.LogWrite(&LogRecord{Level: WARN, Created: created, Source: "main.serve:12", Category: "db", Message: "slow",
+		Fields: Fields{{Key: "rows", Value: 3}, {Key: "level", Value: "x"}}})
+	w.LogWrite(&LogRecord{Level: INFO, Created: created, Category: "db", Message: "again"})
+	w.LogWrite(&LogRecord{Level: INFO, Created: created, Message: "up"})
+	if err := w.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	w.LogWrite(&LogRecord{Level: INFO, Created: created, Message: "last"})
+	w.Close()
+
+	var got []forward
+	for len(received) > 0 {
+		got = append(got, <-received)
+	}
+	if len(got) != 4 {
+		t.Fatalf("%d messages received, want 4: %v", len(got), got)
+	}
+	if got[0].chunk == "" || got[1].chunk != got[0].chunk || got[2].chunk == got[0].chunk {
+		t.Errorf("chunks %q %q %q: the batch not acknowledged must be sent again", got[0].chunk, got[1].chunk, got[2].chunk)
+	}
+	tags := []string{Project + ".db", Project + ".db", Project + ".DEFAULT", Project + ".DEFAULT"}
+	sizes := []int64{2, 2, 1, 1}
+	for i, f := range got {
+		if f.tag != tags[i] || f.size != sizes[i] || len(f.entries) != int(sizes[i]) {
+			t.Errorf("message %d: tag %q size %d with %d entries, want %q %d", i, f.tag, f.size, len(f.entries), tags[i], sizes[i])
+		}
+	}
+	entry := got[0].entries[0].([]interface{})
+	if ts := entry[0].([]byte); !bytes.Equal(ts, []byte{0x5e, 0x74, 0xd4, 0x77, 0, 0, 0, 5}) {
+		t.Errorf("event time %x", ts)
+	}
+	record := fmt.Sprint(entry[1])
+	if want := "map[category:db fields.level:x level:WARN message:slow rows:3 source:main.serve:12]"; record != want {
+		t.Errorf("record %s\nwant %s", record, want)
+	}
+
+	// An ack announcing a huge string is refused before reading it.
+	if _, err := readMsgpackStringMap(bytes.NewReader([]byte{0x81, 0xa3, 'a', 'c', 'k', 0xdb, 0xff, 0xff, 0xff, 0xff})); err != errMsgpackSize {
+		t.Errorf("huge ack: %v", err)
+	}
+}
+
+func TestFluentHeartbeat(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	udp, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Skipf("no udp on the port of the listener: %s", err)
+	}
+	defer udp.Close()
+
+	closed := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				_, _ = io.Copy(ioutil.Discard, conn)
+				closed <- struct{}{}
+			}(conn)
+		}
+	}()
+	var beats, answer int32 = 0, 1
+	go func() {
+		var buf [16]byte
+		for {
+			n, addr, err := udp.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			if n != 1 || buf[0] != 0 {
+				t.Errorf("heartbeat %q", buf[:n])
+			}
+			atomic.AddInt32(&beats, 1)
+			if atomic.LoadInt32(&answer) == 1 {
+				_, _ = udp.WriteTo(buf[:n], addr)
+			}
+		}
+	}()
+
+	w := NewFluentWriter("tcp", ln.Addr().String(), DEBUG)
+	w.SetBatchLimits(0, 0, 0)
+	w.LogWrite(&LogRecord{Level: INFO, Message: "connect"})
+	if err := w.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w.SetHeartbeat(20 * time.Millisecond)
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&beats) < 5 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&beats); n < 5 {
+		t.Fatalf("%d heartbeats sent", n)
+	}
+	select {
+	case <-closed:
+		t.Fatal("connection closed while the heartbeats were answered")
+	default:
+	}
+
+	// Unanswered heartbeats drop the connection.
+	atomic.StoreInt32(&answer, 0)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection kept without heartbeats")
+	}
+
+	w.SetHeartbeat(0)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		w.Lock()
+		beating := w.beating
+		w.Unlock()
+		if !beating {
+			break
+		}
+	}
+	w.Lock()
+	beating := w.beating
+	w.Unlock()
+	if beating {
+		t.Error("heartbeats not stopped")
+	}
+	w.Close()
+}
+
+// snappyDecode decodes the snappy block format.
+func snappyDecode(src []byte) ([]byte, error) {
+	n, i := binary.Uvarint(src)
+	if i <= 0 {
+		return nil, fmt.Errorf("bad length")
+	}
+	dst := make([]byte, 0, n)
+	for i < len(src) {
+		tag := src[i]
+		switch tag & 3 {
+		case 0:
+			length := int(tag >> 2)
+			i++
+			if length >= 60 {
+				extra := length - 59
+				length = 0
+				for k := 0; k < extra; k++ {
+					length |= int(src[i+k]) << (8 * k)
+				}
+				i += extra
+			}
+			length++
+			dst = append(dst, src[i:i+length]...)
+			i += length
+		case 2:
+			length := int(tag>>2) + 1
+			offset := int(src[i+1]) | int(src[i+2])<<8
+			i += 3
+			if offset == 0 || offset > len(dst) {
+				return nil, fmt.Errorf("bad offset %d", offset)
+			}
+			for k := 0; k < length; k++ {
+				dst = append(dst, dst[len(dst)-offset])
+			}
+		default:
+			return nil, fmt.Errorf("unexpected tag %x", tag)
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, fmt.Errorf("decoded %d bytes, want %d", len(dst), n)
+	}
+	return dst, nil
+}
+
+type protoField struct {
+	num    int
+	varint uint64
+	data   []byte
+}
+
+// protoFields decodes the varint and length-delimited fields of a protobuf
+// message.
+func protoFields(b []byte) []protoField {
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		f := protoField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.varint, n = binary.Uvarint(b)
+			b = b[n:]
+		case 1:
+			f.varint, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			f.data, b = b[n:n+int(length)], b[n+int(length):]
+		default:
+			return fields
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// readMsgpack decodes the msgpack value at the start of r: maps, arrays,
+// strings, bins, integers and the EventTime extension (as its 8 bytes).
+func readMsgpack(r *bufio.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	next := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+	length := func(size int) (int, error) {
+		b, err := next(size)
+		n := 0
+		for _, c := range b {
+			n = n<<8 | int(c)
+		}
+		return n, err
+	}
+	var n int
+	switch {
+	case c < 0x80:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return readMsgpackMap(r, int(c&0x0f))
+	case c&0xf0 == 0x90:
+		return readMsgpackArray(r, int(c&0x0f))
+	case c&0xe0 == 0xa0:
+		b, err := next(int(c & 0x1f))
+		return string(b), err
+	case c == 0xcc || c == 0xcd || c == 0xce || c == 0xcf:
+		b, err := next(1 << (c - 0xcc))
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return int64(v), err
+	case c == 0xd7:
+		b, err := next(9)
+		return b[1:], err
+	case c == 0xd9 || c == 0xda:
+		if n, err = length(1 << (c - 0xd9)); err != nil {
+			return nil, err
+		}
+		b, err := next(n)
+		return string(b), err
+	case c == 0xc4 || c == 0xc5 || c == 0xc6:
+		if n, err = length(1 << (c - 0xc4)); err != nil {
+			return nil, err
+		}
+		return next(n)
+	case c == 0xdc:
+		if n, err = length(2); err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, n)
+	case c == 0xde:
+		if n, err = length(2); err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, n)
+	}
+	return nil, fmt.Errorf("unsupported msgpack type %#x", c)
+}
+
+func readMsgpackArray(r *bufio.Reader, n int) ([]interface{}, error) {
+	a := make([]interface{}, n)
+	for i := range a {
+		var err error
+		if a[i], err = readMsgpack(r); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func readMsgpackMap(r *bufio.Reader, n int) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		if m[fmt.Sprint(key)], err = readMsgpack(r); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,129 @@
+package logs
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// LogfmtTimeFormat is the layout used for the "time" key of logfmt records.
+const LogfmtTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// LogfmtLayout renders each record as a single logfmt line, e.g.
+//
+//	time=2020-03-20T14:34:31.717+08:00 level=INFO category=Test source=main.main:12 msg="hello world" project=App-Api user_id=42
+//
+// Values containing spaces, '=', quotes or control characters are quoted, so
+// a message never splits into extra pairs or lines.
+type LogfmtLayout struct{}
+
+// Format implements Layout.
+func (LogfmtLayout) Format(rec *LogRecord) string {
+	if rec == nil {
+		return "<nil>\n"
+	}
+	out := bytes.NewBuffer(make([]byte, 0, 256))
+
+	category := rec.Category
+	if len(category) == 0 {
+		category = "DEFAULT"
+	}
+
+	writeLogfmtPair(out, "time", rec.Created.Format(LogfmtTimeFormat))
+	out.WriteByte(' ')
+	writeLogfmtPair(out, "level", rec.Level.String())
+	out.WriteByte(' ')
+	writeLogfmtPair(out, "category", category)
+	out.WriteByte(' ')
+	writeLogfmtPair(out, "source", rec.Source)
+	out.WriteByte(' ')
+	writeLogfmtPair(out, "msg", rec.Message)
+	out.WriteByte(' ')
+	writeLogfmtPair(out, "project", Project)
+	writeFields(out, rec.Fields)
+	out.WriteByte('\n')
+
+	return out.String()
+}
+
+func writeLogfmtPair(out *bytes.Buffer, key string, value interface{}) {
+	writeLogfmtKey(out, key)
+	out.WriteByte('=')
+	writeLogfmtValue(out, value)
+}
+
+// writeLogfmtKey writes key with any character that would end the key
+// (space, '=', '"' or a control character) replaced by '_'.
+func writeLogfmtKey(out *bytes.Buffer, key string) {
+	if key == "" {
+		out.WriteByte('_')
+		return
+	}
+	for _, r := range key {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError {
+			out.WriteByte('_')
+			continue
+		}
+		out.WriteRune(r)
+	}
+}
+
+func writeLogfmtValue(out *bytes.Buffer, v interface{}) {
+	var s string
+	switch value := v.(type) {
+	case nil:
+		return
+	case string:
+		s = value
+	case error:
+		s = value.Error()
+	case fmt.Stringer:
+		s = value.String()
+	default:
+		s = fmt.Sprint(value)
+	}
+	if !logfmtNeedsQuote(s) {
+		out.WriteString(s)
+		return
+	}
+
+	out.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		switch {
+		case r == '"' || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case r == '\n':
+			out.WriteString(`\n`)
+		case r == '\r':
+			out.WriteString(`\r`)
+		case r == '\t':
+			out.WriteString(`\t`)
+		case r == utf8.RuneError && size == 1:
+			out.WriteRune(utf8.RuneError)
+		case r < ' ':
+			out.WriteString(`\u00`)
+			out.WriteByte(hexDigits[r>>4])
+			out.WriteByte(hexDigits[r&0xF])
+		default:
+			out.WriteRune(r)
+		}
+	}
+	out.WriteByte('"')
+}
+
+func logfmtNeedsQuote(s string) bool {
+	if s == "" {
+		return true
+	}
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || r == utf8.RuneError {
+			return true
+		}
+		i += size
+	}
+	return false
+}
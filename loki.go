@@ -0,0 +1,295 @@
+package logs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LokiEncoding is the body of the push requests of a LokiWriter.
+type LokiEncoding int
+
+const (
+	// LokiProtobuf sends snappy-compressed protobuf, as promtail does.  This
+	// is the default.
+	LokiProtobuf LokiEncoding = iota
+	// LokiJSON sends JSON.
+	LokiJSON
+)
+
+// ParseLokiEncoding maps "protobuf" (or "") and "json" to a LokiEncoding.
+func ParseLokiEncoding(s string) (LokiEncoding, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "protobuf", "proto":
+		return LokiProtobuf, nil
+	case "json":
+		return LokiJSON, nil
+	}
+	return LokiProtobuf, fmt.Errorf("unknown Loki encoding %q", s)
+}
+
+// The label keys taken from the record rather than from its fields.
+const (
+	LokiLabelProject  = "project"
+	LokiLabelCategory = "category"
+	LokiLabelLevel    = "level"
+)
+
+// DefaultLokiLabels are the label keys of a new LokiWriter.
+var DefaultLokiLabels = []string{LokiLabelProject, LokiLabelCategory, LokiLabelLevel}
+
+// LokiWriter pushes records to Grafana Loki.  It is an HTTPWriter, batching
+// and retrying alike.  Records are grouped into streams by their labels: the
+// static labels set with SetLabels, and the labels named by SetLabelKeys
+// taken from each record.  Within a stream the entries keep the order in
+// which they were logged: an entry not later than the one before it is moved
+// to 1ns after it, as Loki rejects entries out of order.
+//
+// The line of each entry is formatted by the layout, "(%S) %M%X" by default.
+type LokiWriter struct {
+	*HTTPWriter
+	encoding  LokiEncoding
+	labels    map[string]string
+	labelKeys []string
+	last      map[string]int64 // timestamp of the last entry of the recent streams
+}
+
+// NewLokiWriter returns a LokiWriter pushing to the Loki at url, e.g.
+// "http://localhost:3100", in protobuf.
+func NewLokiWriter(url string, level Level) *LokiWriter {
+	w := &LokiWriter{
+		HTTPWriter: newHTTPWriter(strings.TrimRight(url, "/")+"/loki/api/v1/push", level),
+		labelKeys:  DefaultLokiLabels,
+		last:       make(map[string]int64),
+	}
+	w.layout = PatternLayout("(%S) %M%X")
+	w.encode = w.entry
+	w.marshal = w.push
+	w.start(fmt.Sprintf("LokiWriter(%s)", url), w.write, w.flushBatch, w.exit)
+	return w
+}
+
+// SetEncoding sets the body of the push requests.
+func (w *LokiWriter) SetEncoding(encoding LokiEncoding) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.encoding = encoding
+}
+
+// SetLabels sets labels added to every stream, such as {"env": "prod"}.
+func (w *LokiWriter) SetLabels(labels map[string]string) {
+	copied := make(map[string]string, len(labels))
+	for name, value := range labels {
+		copied[lokiLabelName(name)] = value
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.labels = copied
+}
+
+// SetLabelKeys sets the labels taken from each record: LokiLabelProject,
+// LokiLabelCategory and LokiLabelLevel, or the key of a field of the record.
+// A record without such a field has no such label.  Every distinct set of
+// values makes a stream, so fields with many values (ids...) are best kept
+// out of the labels.
+func (w *LokiWriter) SetLabelKeys(keys ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.labelKeys = append([]string(nil), keys...)
+}
+
+// SetTenant sends the requests for a tenant of a multi-tenant Loki.
+func (w *LokiWriter) SetTenant(tenant string) {
+	w.SetHeader("X-Scope-OrgID", tenant)
+}
+
+// streamLabels returns the labels of the stream of rec, sorted by name; a
+// label taken from the record replaces a static label of the same name.  It
+// is called holding w.mu.
+func (w *LokiWriter) streamLabels(rec *LogRecord) [][2]string {
+	values := make(map[string]string, len(w.labels)+len(w.labelKeys))
+	for name, value := range w.labels {
+		values[name] = value
+	}
+	for _, key := range w.labelKeys {
+		var value string
+		switch key {
+		case LokiLabelProject:
+			value = Project
+		case LokiLabelCategory:
+			if value = rec.Category; value == "" {
+				value = "DEFAULT"
+			}
+		case LokiLabelLevel:
+			value = rec.Level.String()
+		default:
+			for _, field := range rec.Fields {
+				if field.Key == key {
+					value = fmt.Sprint(field.Value)
+				}
+			}
+		}
+		if value != "" {
+			values[lokiLabelName(key)] = value
+		}
+	}
+	labels := make([][2]string, 0, len(values))
+	for name, value := range values {
+		labels = append(labels, [2]string{name, value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+	return labels
+}
+
+// entry encodes rec for the batch as the labels of its stream, in both the
+// JSON and the Prometheus forms, its timestamp and its line, separated by
+// NULs (which the escaping of the labels keeps out of them).  It is called
+// holding w.mu.
+func (w *LokiWriter) entry(rec *LogRecord) []byte {
+	labels := w.streamLabels(rec)
+	var jsonLabels, promLabels bytes.Buffer
+	jsonLabels.WriteByte('{')
+	promLabels.WriteByte('{')
+	for i, label := range labels {
+		if i > 0 {
+			jsonLabels.WriteByte(',')
+			promLabels.WriteString(", ")
+		}
+		writeJSONString(&jsonLabels, label[0])
+		jsonLabels.WriteByte(':')
+		writeJSONString(&jsonLabels, label[1])
+		promLabels.WriteString(label[0])
+		promLabels.WriteByte('=')
+		promLabels.WriteString(strconv.Quote(label[1]))
+	}
+	jsonLabels.WriteByte('}')
+	promLabels.WriteByte('}')
+
+	created := rec.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	ts := created.UnixNano()
+	stream := promLabels.String()
+	if last, ok := w.last[stream]; ok && ts <= last {
+		ts = last + 1
+	}
+	w.last[stream] = ts
+
+	line := strings.TrimRight(w.layout.Format(rec), "\r\n")
+	out := make([]byte, 0, jsonLabels.Len()+len(stream)+len(line)+24)
+	out = append(out, jsonLabels.Bytes()...)
+	out = append(out, 0)
+	out = append(out, stream...)
+	out = append(out, 0)
+	out = strconv.AppendInt(out, ts, 10)
+	out = append(out, 0)
+	return append(out, line...)
+}
+
+// lokiEntry is an entry of a batch decoded.
+type lokiEntry struct {
+	jsonLabels, stream, line []byte
+	ts                       int64
+}
+
+// lokiStreamMemory is how long a LokiWriter at least remembers the last entry
+// of a stream, to keep the next entries after it.
+const lokiStreamMemory = time.Minute
+
+// push builds the push request of a batch, grouping the entries by stream
+// in the order the streams first appear.  The streams whose last entry is
+// older than lokiStreamMemory, or the batch wait if longer, are forgotten,
+// not to keep every stream ever seen.
+func (w *LokiWriter) push(batch [][]byte) ([]byte, string) {
+	w.mu.Lock()
+	encoding := w.encoding
+	memory := lokiStreamMemory
+	if w.maxWait > memory {
+		memory = w.maxWait
+	}
+	cutoff := time.Now().Add(-memory).UnixNano()
+	for stream, last := range w.last {
+		if last < cutoff {
+			delete(w.last, stream)
+		}
+	}
+	w.mu.Unlock()
+
+	var order []string
+	streams := make(map[string][]lokiEntry)
+	for _, msg := range batch {
+		parts := bytes.SplitN(msg, []byte{0}, 4)
+		if len(parts) != 4 {
+			continue
+		}
+		ts, _ := strconv.ParseInt(string(parts[2]), 10, 64)
+		e := lokiEntry{jsonLabels: parts[0], stream: parts[1], ts: ts, line: parts[3]}
+		key := string(e.stream)
+		if _, ok := streams[key]; !ok {
+			order = append(order, key)
+		}
+		streams[key] = append(streams[key], e)
+	}
+
+	if encoding == LokiJSON {
+		out := bytes.NewBuffer(make([]byte, 0, 256))
+		out.WriteString(`{"streams":[`)
+		for i, key := range order {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			entries := streams[key]
+			out.WriteString(`{"stream":`)
+			out.Write(entries[0].jsonLabels)
+			out.WriteString(`,"values":[`)
+			for j, e := range entries {
+				if j > 0 {
+					out.WriteByte(',')
+				}
+				out.WriteString(`["`)
+				out.WriteString(strconv.FormatInt(e.ts, 10))
+				out.WriteString(`",`)
+				writeJSONString(out, string(e.line))
+				out.WriteByte(']')
+			}
+			out.WriteString("]}")
+		}
+		out.WriteString("]}")
+		return out.Bytes(), "application/json"
+	}
+
+	// logproto.PushRequest{streams: [StreamAdapter{labels, entries:
+	// [EntryAdapter{timestamp, line}]}]}
+	var req, stream, entry, timestamp []byte
+	for _, key := range order {
+		stream = appendProtoString(stream[:0], 1, key)
+		for _, e := range streams[key] {
+			timestamp = appendProtoUint(timestamp[:0], 1, uint64(e.ts/1e9))
+			timestamp = appendProtoUint(timestamp, 2, uint64(e.ts%1e9))
+			entry = appendProtoMessage(entry[:0], 1, timestamp)
+			entry = appendProtoString(entry, 2, string(e.line))
+			stream = appendProtoMessage(stream, 2, entry)
+		}
+		req = appendProtoMessage(req, 1, stream)
+	}
+	return snappyEncode(req), "application/x-protobuf"
+}
+
+// lokiLabelName returns name with the characters Loki does not allow in a
+// label name replaced by '_'.
+func lokiLabelName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= '0' && c <= '9' && i > 0) {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
@@ -0,0 +1,225 @@
+package logs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Just enough of MessagePack to speak the Fluentd forward protocol: values
+// are appended to a byte slice, and the maps of strings the collector answers
+// with are read back.
+
+func appendMsgpackUint(b []byte, v uint64) []byte {
+	switch {
+	case v < 0x80:
+		return append(b, byte(v))
+	case v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return append(b, 0xcd, byte(v>>8), byte(v))
+	case v <= math.MaxUint32:
+		return append(b, 0xce, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	b = append(b, 0xcf)
+	return appendUint64(b, v)
+}
+
+func appendMsgpackInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0:
+		return appendMsgpackUint(b, uint64(v))
+	case v >= -32:
+		return append(b, byte(v))
+	case v >= math.MinInt8:
+		return append(b, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		return append(b, 0xd1, byte(v>>8), byte(v))
+	case v >= math.MinInt32:
+		return append(b, 0xd2, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	b = append(b, 0xd3)
+	return appendUint64(b, uint64(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// appendMsgpackHeader appends the header of a string, bin, array or map of n
+// elements, given the type bytes of its fixed form (0 if none) and of its 8,
+// 16 and 32-bit forms.
+func appendMsgpackHeader(b []byte, n int, fix, max int, c8, c16, c32 byte) []byte {
+	switch {
+	case n <= max && fix != 0:
+		return append(b, byte(fix|n))
+	case n <= math.MaxUint8 && c8 != 0:
+		return append(b, c8, byte(n))
+	case n <= math.MaxUint16:
+		return append(b, c16, byte(n>>8), byte(n))
+	}
+	return append(b, c32, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	b = appendMsgpackHeader(b, len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	return append(b, s...)
+}
+
+func appendMsgpackBin(b []byte, data []byte) []byte {
+	b = appendMsgpackHeader(b, len(data), 0, 0, 0xc4, 0xc5, 0xc6)
+	return append(b, data...)
+}
+
+func appendMsgpackArray(b []byte, n int) []byte {
+	return appendMsgpackHeader(b, n, 0x90, 15, 0, 0xdc, 0xdd)
+}
+
+func appendMsgpackMap(b []byte, n int) []byte {
+	return appendMsgpackHeader(b, n, 0x80, 15, 0, 0xde, 0xdf)
+}
+
+// appendMsgpackEventTime appends t as the EventTime extension of the forward
+// protocol: type 0, seconds and nanoseconds as big-endian uint32s.
+func appendMsgpackEventTime(b []byte, t time.Time) []byte {
+	sec, nsec := uint32(t.Unix()), uint32(t.Nanosecond())
+	return append(b, 0xd7, 0x00,
+		byte(sec>>24), byte(sec>>16), byte(sec>>8), byte(sec),
+		byte(nsec>>24), byte(nsec>>16), byte(nsec>>8), byte(nsec))
+}
+
+// appendMsgpackValue appends the value of a field, mapped as writeJSONValue
+// maps it to JSON.
+func appendMsgpackValue(b []byte, v interface{}) []byte {
+	switch value := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case string:
+		return appendMsgpackString(b, value)
+	case []byte:
+		return appendMsgpackBin(b, value)
+	case bool:
+		if value {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case int:
+		return appendMsgpackInt(b, int64(value))
+	case int8:
+		return appendMsgpackInt(b, int64(value))
+	case int16:
+		return appendMsgpackInt(b, int64(value))
+	case int32:
+		return appendMsgpackInt(b, int64(value))
+	case int64:
+		return appendMsgpackInt(b, value)
+	case uint:
+		return appendMsgpackUint(b, uint64(value))
+	case uint8:
+		return appendMsgpackUint(b, uint64(value))
+	case uint16:
+		return appendMsgpackUint(b, uint64(value))
+	case uint32:
+		return appendMsgpackUint(b, uint64(value))
+	case uint64:
+		return appendMsgpackUint(b, value)
+	case float32:
+		bits := math.Float32bits(value)
+		return append(b, 0xca, byte(bits>>24), byte(bits>>16), byte(bits>>8), byte(bits))
+	case float64:
+		b = append(b, 0xcb)
+		return appendUint64(b, math.Float64bits(value))
+	case error:
+		return appendMsgpackString(b, value.Error())
+	case fmt.Stringer:
+		return appendMsgpackString(b, value.String())
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return appendMsgpackString(b, fmt.Sprint(v))
+	}
+	return appendMsgpackString(b, string(data))
+}
+
+var errMsgpackType = errors.New("unexpected msgpack type")
+
+// The largest strings and maps read back; the acks of the forward protocol
+// are a one-entry map with a 24-byte chunk id.
+const (
+	maxMsgpackReadString = 1024
+	maxMsgpackReadMap    = 16
+)
+
+var errMsgpackSize = errors.New("msgpack value too long")
+
+// readMsgpackStringMap reads a map of strings to strings from r, such as the
+// ack of the forward protocol.
+func readMsgpackStringMap(r io.Reader) (map[string]string, error) {
+	n, err := readMsgpackHeader(r, 0x80, 15, 0, 0xde, 0xdf)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > maxMsgpackReadMap {
+		return nil, errMsgpackSize
+	}
+	m := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		key, err := readMsgpackString(r)
+		if err != nil {
+			return nil, err
+		}
+		if m[key], err = readMsgpackString(r); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func readMsgpackString(r io.Reader) (string, error) {
+	n, err := readMsgpackHeader(r, 0xa0, 31, 0xd9, 0xda, 0xdb)
+	if err != nil {
+		return "", err
+	}
+	if n < 0 || n > maxMsgpackReadString {
+		return "", errMsgpackSize
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+// readMsgpackHeader reads a header written by appendMsgpackHeader with the
+// same type bytes and returns its number of elements.
+func readMsgpackHeader(r io.Reader, fix, max int, c8, c16, c32 byte) (int, error) {
+	var buf [5]byte
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return 0, err
+	}
+	size := 0
+	switch c := buf[0]; {
+	case fix != 0 && int(c)&^max == fix:
+		return int(c) & max, nil
+	case c8 != 0 && c == c8:
+		size = 1
+	case c == c16:
+		size = 2
+	case c == c32:
+		size = 4
+	default:
+		return 0, errMsgpackType
+	}
+	if _, err := io.ReadFull(r, buf[1:1+size]); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, c := range buf[1 : 1+size] {
+		n = n<<8 | int(c)
+	}
+	return n, nil
+}
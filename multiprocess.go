@@ -0,0 +1,76 @@
+package logs
+
+import (
+	"fmt"
+	"os"
+)
+
+// Suffixes of the lock files shared by the processes writing one log file:
+// one is held around each write and rotation, the other around the work on
+// the backups.
+const (
+	writeLockSuffix  = ".lock"
+	backupLockSuffix = ".backups.lock"
+)
+
+// OpenSharedFileLogWriter is OpenFileLogWriter for a file written by several
+// processes at once, such as prefork workers.  Writes and rotations hold an
+// advisory lock (flock) on filename.lock; a process finding that a sibling has
+// rotated the file reopens the new file instead of rotating again.  Opening
+// appends to the file rather than starting a numbered backup.
+//
+// Size limits are checked against the size of the file on disk; line limits
+// count the lines found on opening plus the ones written by this process.
+// Where flock is not available the file is not protected.
+func OpenSharedFileLogWriter(fileName string, rotate bool, daily bool) (*FileLogWriter, error) {
+	return openFileLogWriter(fileName, rotate, daily, true, nil)
+}
+
+// locked runs fn holding the lock shared with the other processes writing the
+// file, if any.
+func (w *FileLogWriter) locked(fn func() error) error {
+	if w.shared == nil {
+		return fn()
+	}
+	if err := flock(w.shared); err != nil {
+		return fmt.Errorf("lock: %s", err)
+	}
+	defer funlock(w.shared)
+	return fn()
+}
+
+// lockBackups runs fn holding the lock on the backups shared with the other
+// processes writing the file, if any.  The lock file is opened for each call,
+// so the lock also keeps the goroutines of one process apart.
+func (w *FileLogWriter) lockBackups(fn func()) {
+	if w.shared == nil {
+		fn()
+		return
+	}
+	lock, err := os.OpenFile(w.filename+backupLockSuffix, os.O_RDWR|os.O_CREATE, 0660)
+	if err == nil {
+		defer lock.Close()
+		err = flock(lock)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "FileLogWriter(%q): lock backups: %s\n", w.filename, err)
+	}
+	fn()
+}
+
+// followSiblings, called holding the shared lock, reopens the file if another
+// process has rotated it, and takes the size of the file from the disk.
+func (w *FileLogWriter) followSiblings() error {
+	if w.file == nil {
+		return w.openFile(true)
+	}
+	open, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	if disk, err := os.Stat(w.filename); err != nil || !os.SameFile(open, disk) {
+		return w.reopen()
+	}
+	w.maxsizeCurSize = int(open.Size())
+	return nil
+}
@@ -0,0 +1,162 @@
+package logs
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A nameTemplate names the backups of a FileLogWriter after the time of their
+// last write.  It holds strftime verbs (app-%Y%m%d%H.log) if it contains a %,
+// a Go time layout (app-2006010215.log) otherwise.
+type nameTemplate struct {
+	layout   string         // Go layout, for a template without %
+	strftime string         // template with strftime verbs
+	re       *regexp.Regexp // matches the names made from strftime
+}
+
+// strftimeVerbs maps the supported strftime verbs to their Go layout and the
+// pattern of their output.
+var strftimeVerbs = map[byte][2]string{
+	'Y': {"2006", `\d{4}`},
+	'y': {"06", `\d{2}`},
+	'm': {"01", `\d{2}`},
+	'd': {"02", `\d{2}`},
+	'H': {"15", `\d{2}`},
+	'M': {"04", `\d{2}`},
+	'S': {"05", `\d{2}`},
+	'j': {"002", `\d{3}`},
+}
+
+func parseNameTemplate(template string) (*nameTemplate, error) {
+	if strings.ContainsAny(template, `/\`) {
+		return nil, fmt.Errorf("bad name template %q: must be a file name, not a path", template)
+	}
+	if !strings.Contains(template, "%") {
+		if time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC).Format(template) == template {
+			return nil, fmt.Errorf("bad name template %q: no time in it", template)
+		}
+		return &nameTemplate{layout: template}, nil
+	}
+
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if c != '%' {
+			re.WriteString(regexp.QuoteMeta(string(c)))
+			continue
+		}
+		if i++; i == len(template) {
+			return nil, fmt.Errorf("bad name template %q: trailing %%", template)
+		}
+		if template[i] == '%' {
+			re.WriteString("%")
+			continue
+		}
+		verb, ok := strftimeVerbs[template[i]]
+		if !ok {
+			return nil, fmt.Errorf("bad name template %q: unknown verb %%%c", template, template[i])
+		}
+		re.WriteString(verb[1])
+	}
+	re.WriteString("$")
+	return &nameTemplate{strftime: template, re: regexp.MustCompile(re.String())}, nil
+}
+
+// format returns the name of a backup last written at t.
+func (n *nameTemplate) format(t time.Time) string {
+	if n.re == nil {
+		return t.Format(n.layout)
+	}
+	var b strings.Builder
+	for i := 0; i < len(n.strftime); i++ {
+		c := n.strftime[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if n.strftime[i] == '%' {
+			b.WriteByte('%')
+		} else {
+			b.WriteString(t.Format(strftimeVerbs[n.strftime[i]][0]))
+		}
+	}
+	return b.String()
+}
+
+// match reports whether name is the name of a backup made from the template,
+// possibly followed by the .N of a second backup of the same period.
+func (n *nameTemplate) match(name string) bool {
+	if n.matchExact(name) {
+		return true
+	}
+	if i := strings.LastIndexByte(name, '.'); i > 0 && isDigits(name[i+1:]) {
+		return n.matchExact(name[:i])
+	}
+	return false
+}
+
+func (n *nameTemplate) matchExact(name string) bool {
+	if n.re != nil {
+		return n.re.MatchString(name)
+	}
+	_, err := time.Parse(n.layout, name)
+	return err == nil
+}
+
+// Layouts of the date intRotate appends to the backups of time-based rotation
+// without a template: daily rotation uses the date alone.
+const (
+	dailyBackupLayout = "2006-01-02"
+	timeBackupLayout  = "2006-01-02T15-04"
+)
+
+// backupMatcher returns a function recognising the file names (without
+// directory and .gz suffix) intRotate gives the backups of w: the log file name
+// followed by a number or a date, or a name made from the template.
+func (w *FileLogWriter) backupMatcher() func(name string) bool {
+	base, template := filepath.Base(w.filename), w.template
+	return func(name string) bool {
+		if name == base {
+			return false
+		}
+		if template != nil && template.match(name) {
+			return true
+		}
+		return strings.HasPrefix(name, base+".") && isBackupSuffix(name[len(base)+1:])
+	}
+}
+
+// isBackupSuffix reports whether s is the suffix intRotate gives a backup:
+// a backup number, or a date possibly followed by the .N of a second backup
+// of the same period.
+func isBackupSuffix(s string) bool {
+	if isDigits(s) {
+		return true
+	}
+	if i := strings.LastIndexByte(s, '.'); i > 0 && isDigits(s[i+1:]) {
+		s = s[:i]
+	}
+	for _, layout := range []string{dailyBackupLayout, timeBackupLayout} {
+		if _, err := time.Parse(layout, s); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -16,63 +16,184 @@ package logs
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// errSpoolFull is returned for a record that was neither sent nor spooled.
+var errSpoolFull = errors.New("connection down and spool full: record dropped")
+
+// errBackoff is returned by connect while waiting to retry.
+var errBackoff = errors.New("waiting to reconnect")
+
+// errTooLarge is returned for a record whose message cannot be sent at all.
+var errTooLarge = errors.New("message too large: record dropped")
+
 // ConnWriter implements LoggerInterface.
 // it writes messages in keep-live tcp connection.
 type ConnWriter struct {
 	sync.Mutex
+	*recordQueue
 	writer         io.WriteCloser
-	rec            chan *LogRecord
-	format         string
+	layout         Layout
 	ReconnectOnMsg bool   `json:"reconnectOnMsg"`
 	Reconnect      bool   `json:"reconnect"`
 	Net            string `json:"net"`
 	Addr           string `json:"addr"`
 	Level          Level  `json:"level"`
+
+	// Reconnection with exponential backoff
+	backoffMin, backoffMax time.Duration
+	failures               int
+	nextDial               time.Time
+
+	// Deadline of connecting and of each write, 0 for none
+	timeout time.Duration
+
+	// Connect with TLS if set
+	tls *TLSConfig
+
+	// Messages kept while the connection is down
+	spool *spool
+	// Builds the message of a record in place of layout and a newline, for
+	// the writers speaking a protocol on top of the connection
+	encode func(rec *LogRecord) []byte // nil for a record that cannot be sent
+	// Splits a message into the packets to write, if set
+	split func(msg []byte) [][]byte
+	// Waits for the collector to acknowledge a message written, if set
+	ack func(msg []byte) error
 }
 
+// Defaults of a new ConnWriter, see SetBackoff, SetTimeout and SetSpool.
+const (
+	DefaultBackoffMin   = 100 * time.Millisecond
+	DefaultBackoffMax   = 30 * time.Second
+	DefaultConnTimeout  = 5 * time.Second
+	DefaultSpoolRecords = 1000
+)
+
 // NewConn create new ConnWrite returning as LoggerInterface.
 func NewConn(Net, Addr, format string, level Level) *ConnWriter {
-	if format == "" {
-		format = "[%D %T] [%L] (%S) %M"
-	}
-	w := &ConnWriter{
-		rec:    make(chan *LogRecord, LogBufferLength),
-		format: format,
-		Net:    Net,
-		Addr:   Addr,
-		Level:  level,
-	}
-
-	go func() {
-		defer recoverPanic()
-		defer func() {
-			_ = w.connect()
-		}()
-
-		for {
-			select {
-			case rec, ok := <-w.rec:
-				if !ok {
-					return
-				}
-				w.write(rec)
-			}
-		}
-	}()
+	w := newConn(Net, Addr, format, level)
+	w.start(fmt.Sprintf("ConnWriter(%s %s)", Net, Addr), w.write, nil, w.disconnect)
+	go w.retryLoop()
 	return w
 }
 
-func (c *ConnWriter) LogWrite(rec *LogRecord) {
-	c.rec <- rec
+// newConn returns a ConnWriter that is not started yet.
+func newConn(Net, Addr, format string, level Level) *ConnWriter {
+	if format == "" {
+		format = "[%D %T] [%L] (%S) %M%X"
+	}
+	return &ConnWriter{
+		recordQueue: newRecordQueue(),
+		layout:      PatternLayout(format),
+		Net:         Net,
+		Addr:        Addr,
+		Level:       level,
+		backoffMin:  DefaultBackoffMin,
+		backoffMax:  DefaultBackoffMax,
+		timeout:     DefaultConnTimeout,
+		spool:       newSpool(DefaultSpoolRecords, "", 0),
+	}
 }
 
 func (c *ConnWriter) SetFormat(format string) {
-	c.format = format
+	c.SetLayout(PatternLayout(format))
+}
+
+// SetLayout replaces the %-pattern with an arbitrary Layout, e.g. JSONLayout{}.
+func (c *ConnWriter) SetLayout(layout Layout) {
+	c.Lock()
+	defer c.Unlock()
+	c.layout = layout
+}
+
+// SetBackoff sets the delays between attempts to reconnect: the first is min,
+// each further one doubles up to max, and each is shortened by a random part
+// of up to half so that many writers do not retry in step.
+func (c *ConnWriter) SetBackoff(min, max time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	if max < min {
+		max = min
+	}
+	c.backoffMin, c.backoffMax = min, max
+}
+
+// SetTimeout bounds connecting and each write, so that a collector that stops
+// reading (or a half-open TCP connection) cannot hang the writer.  0 disables
+// the deadlines.
+func (c *ConnWriter) SetTimeout(timeout time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.timeout = timeout
+}
+
+// SetSpool sets how many records are kept while the connection is down: up to
+// records in memory and, if dir is not empty, up to maxBytes (0 for no limit)
+// more in a file in dir.  They are sent in order once the connection is back.
+// The file outlives the process, so records spooled at exit are sent by the
+// next ConnWriter to the same address.  Records beyond these limits are
+// dropped and reported like the records dropped by the queue.
+func (c *ConnWriter) SetSpool(records int, dir string, maxBytes int64) {
+	path := ""
+	if dir != "" {
+		name := strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(c.Net + "_" + c.Addr)
+		path = filepath.Join(dir, name+".spool")
+	}
+	next := newSpool(records, path, maxBytes)
+
+	c.Lock()
+	defer c.Unlock()
+	for _, msg := range c.spool.mem {
+		if !next.push(msg) {
+			atomic.AddUint64(&c.dropped, 1)
+		}
+	}
+	c.spool.mem = nil
+	c.spool.close()
+	c.spool = next
+}
+
+// backoff returns how long to wait before the next attempt to connect.
+func (c *ConnWriter) backoff() time.Duration {
+	d := c.backoffMin
+	for i := 1; i < c.failures && d < c.backoffMax; i++ {
+		d *= 2
+	}
+	if d > c.backoffMax {
+		d = c.backoffMax
+	}
+	if half := int64(d / 2); half > 0 {
+		d -= time.Duration(rand.Int63n(half))
+	}
+	return d
+}
+
+// fail closes the connection after an error and schedules the next attempt to
+// connect.  The first failure of an outage is reported to stderr.
+func (c *ConnWriter) fail(err error) {
+	if c.writer != nil {
+		_ = c.writer.Close()
+		c.writer = nil
+	}
+	if c.failures == 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "%s: %s; spooling records\n", c.name, err)
+	}
+	c.failures++
+	c.nextDial = time.Now().Add(c.backoff())
 }
 
 func (c *ConnWriter) connect() error {
@@ -80,9 +201,24 @@ func (c *ConnWriter) connect() error {
 		_=c.writer.Close()
 		c.writer = nil
 	}
+	if time.Now().Before(c.nextDial) {
+		return errBackoff
+	}
 
-	conn, err := net.Dial(c.Net, c.Addr)
+	dialer := net.Dialer{Timeout: c.timeout}
+	var conn net.Conn
+	var err error
+	if c.tls != nil {
+		// Built for each connection so that rotated certificates are used.
+		var config *tls.Config
+		if config, err = c.tls.build(c.Addr); err == nil {
+			conn, err = tls.DialWithDialer(&dialer, c.Net, c.Addr, config)
+		}
+	} else {
+		conn, err = dialer.Dial(c.Net, c.Addr)
+	}
 	if err != nil {
+		c.fail(err)
 		return err
 	}
 
@@ -107,26 +243,145 @@ func (c *ConnWriter) needToConnectOnMsg() bool {
 	return c.ReconnectOnMsg
 }
 
+// Write sends p and a newline, after the records spooled while the connection
+// was down.  If the connection is down, p is spooled and Write reports success;
+// it fails only if p had to be dropped.
 func (c *ConnWriter) Write(p []byte) (n int, err error) {
+	msg := make([]byte, len(p)+1)
+	copy(msg, p)
+	msg[len(p)] = '\n'
+
 	c.Lock()
+	defer c.Unlock()
+	if err := c.send(msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// send writes msg to the connection, or spools it if that fails.  The caller
+// must hold c.Mutex.
+func (c *ConnWriter) send(msg []byte) error {
 	if c.needToConnectOnMsg() {
-		_=c.connect()
+		if err := c.connect(); err != nil {
+			return c.spoolMsg(msg)
+		}
+	}
+	if !c.spool.empty() {
+		if err := c.spool.replay(c.writeConn); err != nil {
+			return c.spoolMsg(msg)
+		}
+	}
+	if err := c.writeConn(msg); err != nil {
+		return c.spoolMsg(msg)
 	}
+	c.failures = 0
+	return nil
+}
 
-	n, err = c.writer.Write(append(p, '\n'))
-	if err != nil {
-		_=c.connect()
-		return 0, err
+// writeConn writes msg to the connection within the deadline, closing the
+// connection if that fails.
+func (c *ConnWriter) writeConn(msg []byte) error {
+	if c.writer == nil {
+		return errBackoff
+	}
+	if conn, ok := c.writer.(net.Conn); ok && c.timeout > 0 {
+		_ = conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	packets := [][]byte{msg}
+	if c.split != nil {
+		packets = c.split(msg)
+	}
+	for _, packet := range packets {
+		if _, err := c.writer.Write(packet); err != nil {
+			c.fail(err)
+			return err
+		}
+	}
+	if c.ack != nil {
+		if err := c.ack(msg); err != nil {
+			c.fail(err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ConnWriter) spoolMsg(msg []byte) error {
+	if c.spool.push(msg) {
+		return nil
+	}
+	atomic.AddUint64(&c.dropped, 1)
+	return errSpoolFull
+}
+
+// retryLoop reconnects in the background to send the spooled records, so they
+// do not wait for the next record to be logged.
+func (c *ConnWriter) retryLoop() {
+	defer recoverPanic()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			_ = c.do(context.Background(), c.retry)
+		}
+	}
+}
+
+func (c *ConnWriter) retry() {
+	c.Lock()
+	defer c.Unlock()
+	if c.spool.empty() || !time.Now().After(c.nextDial) {
+		return
+	}
+	if c.writer == nil && c.connect() != nil {
+		return
+	}
+	if c.spool.replay(c.writeConn) == nil {
+		c.failures = 0
 	}
-	c.Unlock()
-	return n, nil
 }
 
 // This is the SocketLogWriter's output method
-func (c *ConnWriter) write(rec *LogRecord) {
-	bt := bytes.NewBufferString(FormatLogRecord(c.format, rec))
-	_, _ = c.Write(bt.Bytes())
+func (c *ConnWriter) write(rec *LogRecord) error {
+	if c.encode != nil {
+		c.Lock()
+		defer c.Unlock()
+		msg := c.encode(rec)
+		if msg == nil {
+			atomic.AddUint64(&c.dropped, 1)
+			return errTooLarge
+		}
+		return c.send(msg)
+	}
+	c.Lock()
+	layout := c.layout
+	c.Unlock()
+	bt := bytes.NewBufferString(layout.Format(rec))
+	_, err := c.Write(bt.Bytes())
+	return err
+}
+
+func (c *ConnWriter) disconnect() {
+	c.Lock()
+	defer c.Unlock()
+	if c.writer != nil && !c.spool.empty() {
+		_ = c.spool.replay(c.writeConn)
+	}
+	if lost := c.spool.close(); lost > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "%s: closed with %d records not sent\n", c.name, lost)
+	}
+	if c.writer != nil {
+		_ = c.writer.Close()
+		c.writer = nil
+	}
 }
 
+// Close stops the writer once the records already queued have been sent, then
+// closes the connection.
 func (c *ConnWriter) Close() {
+	c.recordQueue.Close()
 }
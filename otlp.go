@@ -0,0 +1,399 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLPEncoding is the body of the export requests of an OTLPWriter.
+type OTLPEncoding int
+
+const (
+	// OTLPProtobuf sends OTLP/HTTP in binary protobuf.  This is the default.
+	OTLPProtobuf OTLPEncoding = iota
+	// OTLPJSON sends OTLP/HTTP in JSON.
+	OTLPJSON
+)
+
+// ParseOTLPEncoding maps "protobuf" (or "") and "json" to an OTLPEncoding.
+func ParseOTLPEncoding(s string) (OTLPEncoding, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "protobuf", "proto", "http/protobuf":
+		return OTLPProtobuf, nil
+	case "json", "http/json":
+		return OTLPJSON, nil
+	}
+	return OTLPProtobuf, fmt.Errorf("unknown OTLP encoding %q", s)
+}
+
+// otlpSeverities maps the levels to the OpenTelemetry severity numbers, the
+// first of each range.
+var otlpSeverities = [...]int{TRACE: 1, DEBUG: 5, INFO: 9, WARN: 13, ERROR: 17, FATAL: 21}
+
+func otlpSeverity(lvl Level) int {
+	if lvl < 0 || int(lvl) >= len(otlpSeverities) {
+		return 0 // SEVERITY_NUMBER_UNSPECIFIED
+	}
+	return otlpSeverities[lvl]
+}
+
+// OTLPWriter exports records as OpenTelemetry logs to an OTLP/HTTP endpoint,
+// such as an OpenTelemetry collector.  It is an HTTPWriter, batching and
+// retrying alike.  Each record is a log record with
+//
+//	severity     the level as SeverityNumber and SeverityText
+//	body         the record formatted by the layout, "%M" by default
+//	attributes   code.function and code.lineno from the source, and the fields
+//	trace, span  the trace_id and span_id fields (TraceIDKey, SpanIDKey)
+//
+// The trace_id and span_id fields are taken as IDs when they are hex strings
+// (or byte arrays) of the right length, and are left as attributes otherwise.
+// Records are grouped by category, sent as the instrumentation scope, under a
+// resource whose service.name is Project.
+type OTLPWriter struct {
+	*HTTPWriter
+	encoding   OTLPEncoding
+	attributes map[string]string // of the resource, besides service.name
+}
+
+// NewOTLPWriter returns an OTLPWriter exporting to the endpoint at url, e.g.
+// "http://localhost:4318", in protobuf.  The path "/v1/logs" is added to url
+// unless it is already there.
+func NewOTLPWriter(url string, level Level) *OTLPWriter {
+	endpoint := strings.TrimRight(url, "/")
+	if !strings.HasSuffix(endpoint, "/v1/logs") {
+		endpoint += "/v1/logs"
+	}
+	w := &OTLPWriter{HTTPWriter: newHTTPWriter(endpoint, level)}
+	w.layout = PatternLayout("%M")
+	w.encode = w.logRecord
+	w.marshal = w.export
+	w.start(fmt.Sprintf("OTLPWriter(%s)", url), w.write, w.flushBatch, w.exit)
+	return w
+}
+
+// SetEncoding sets the body of the export requests.  It is meant to be
+// called before logging, as records are encoded when batched.
+func (w *OTLPWriter) SetEncoding(encoding OTLPEncoding) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.encoding = encoding
+}
+
+// SetResourceAttributes sets attributes of the resource added to service.name,
+// such as {"deployment.environment": "prod"}.
+func (w *OTLPWriter) SetResourceAttributes(attributes map[string]string) {
+	copied := make(map[string]string, len(attributes))
+	for key, value := range attributes {
+		copied[key] = value
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.attributes = copied
+}
+
+// otlpAttribute is an attribute of a log record or resource, its value
+// normalized by otlpValue.
+type otlpAttribute struct {
+	key   string
+	value interface{}
+}
+
+// logRecord encodes rec for the batch as the length of its scope, its scope
+// and its log record in the encoding set.  It is called holding w.mu.
+func (w *OTLPWriter) logRecord(rec *LogRecord) []byte {
+	created := rec.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	scope := rec.Category
+	if scope == "" {
+		scope = "DEFAULT"
+	}
+	body := strings.TrimRight(w.layout.Format(rec), "\r\n")
+
+	var attrs []otlpAttribute
+	if rec.Source != "" {
+		function, line := splitSource(rec.Source)
+		attrs = append(attrs, otlpAttribute{"code.function", function})
+		if n, err := strconv.ParseInt(line, 10, 64); err == nil {
+			attrs = append(attrs, otlpAttribute{"code.lineno", n})
+		}
+	}
+	var traceID, spanID []byte
+	for _, field := range rec.Fields {
+		switch {
+		case field.Key == TraceIDKey && traceID == nil:
+			if traceID = otlpID(field.Value, 16); traceID != nil {
+				continue
+			}
+		case field.Key == SpanIDKey && spanID == nil:
+			if spanID = otlpID(field.Value, 8); spanID != nil {
+				continue
+			}
+		}
+		attrs = append(attrs, otlpAttribute{field.Key, otlpValue(field.Value)})
+	}
+
+	out := appendProtoVarint(nil, uint64(len(scope)))
+	out = append(out, scope...)
+	if w.encoding == OTLPJSON {
+		buf := bytes.NewBuffer(out)
+		nanos := strconv.FormatInt(created.UnixNano(), 10)
+		buf.WriteString(`{"timeUnixNano":"`)
+		buf.WriteString(nanos)
+		buf.WriteString(`","observedTimeUnixNano":"`)
+		buf.WriteString(strconv.FormatInt(time.Now().UnixNano(), 10))
+		fmt.Fprintf(buf, `","severityNumber":%d,"severityText":`, otlpSeverity(rec.Level))
+		writeJSONString(buf, rec.Level.String())
+		buf.WriteString(`,"body":`)
+		writeOTLPValue(buf, body)
+		buf.WriteString(`,"attributes":`)
+		writeOTLPAttributes(buf, attrs)
+		if traceID != nil {
+			buf.WriteString(`,"traceId":"`)
+			buf.WriteString(hex.EncodeToString(traceID))
+			buf.WriteByte('"')
+		}
+		if spanID != nil {
+			buf.WriteString(`,"spanId":"`)
+			buf.WriteString(hex.EncodeToString(spanID))
+			buf.WriteByte('"')
+		}
+		buf.WriteByte('}')
+		return buf.Bytes()
+	}
+
+	// opentelemetry.proto.logs.v1.LogRecord
+	out = appendProtoFixed64(out, 1, uint64(created.UnixNano()))
+	out = appendProtoUint(out, 2, uint64(otlpSeverity(rec.Level)))
+	out = appendProtoString(out, 3, rec.Level.String())
+	out = appendProtoMessage(out, 5, appendOTLPValue(nil, body))
+	for _, attr := range attrs {
+		out = appendProtoMessage(out, 6, appendOTLPAttribute(nil, attr))
+	}
+	if traceID != nil {
+		out = appendProtoMessage(out, 9, traceID)
+	}
+	if spanID != nil {
+		out = appendProtoMessage(out, 10, spanID)
+	}
+	return appendProtoFixed64(out, 11, uint64(time.Now().UnixNano()))
+}
+
+// export builds the export request of a batch: one resource, and its log
+// records grouped by scope in the order the scopes first appear.
+func (w *OTLPWriter) export(batch [][]byte) ([]byte, string) {
+	w.mu.Lock()
+	encoding := w.encoding
+	resource := make([]otlpAttribute, 0, len(w.attributes)+1)
+	resource = append(resource, otlpAttribute{"service.name", Project})
+	for key, value := range w.attributes {
+		if key != "service.name" {
+			resource = append(resource, otlpAttribute{key, value})
+		}
+	}
+	w.mu.Unlock()
+	extra := resource[1:]
+	sort.Slice(extra, func(i, j int) bool { return extra[i].key < extra[j].key })
+
+	var order []string
+	scopes := make(map[string][][]byte)
+	for _, msg := range batch {
+		n, i := binary.Uvarint(msg)
+		if i <= 0 || uint64(len(msg)-i) < n {
+			continue
+		}
+		scope := string(msg[i : i+int(n)])
+		if _, ok := scopes[scope]; !ok {
+			order = append(order, scope)
+		}
+		scopes[scope] = append(scopes[scope], msg[i+int(n):])
+	}
+
+	if encoding == OTLPJSON {
+		out := bytes.NewBuffer(make([]byte, 0, 256))
+		out.WriteString(`{"resourceLogs":[{"resource":{"attributes":`)
+		writeOTLPAttributes(out, resource)
+		out.WriteString(`},"scopeLogs":[`)
+		for i, scope := range order {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			out.WriteString(`{"scope":{"name":`)
+			writeJSONString(out, scope)
+			out.WriteString(`},"logRecords":[`)
+			out.Write(bytes.Join(scopes[scope], []byte{','}))
+			out.WriteString("]}")
+		}
+		out.WriteString("]}]}")
+		return out.Bytes(), "application/json"
+	}
+
+	// ExportLogsServiceRequest{resource_logs: [ResourceLogs{resource:
+	// Resource{attributes}, scope_logs: [ScopeLogs{scope:
+	// InstrumentationScope{name}, log_records}]}]}
+	var res, resourceLogs, scopeLogs []byte
+	for _, attr := range resource {
+		res = appendProtoMessage(res, 1, appendOTLPAttribute(nil, attr))
+	}
+	resourceLogs = appendProtoMessage(resourceLogs, 1, res)
+	for _, scope := range order {
+		scopeLogs = appendProtoMessage(scopeLogs[:0], 1, appendProtoString(nil, 1, scope))
+		for _, record := range scopes[scope] {
+			scopeLogs = appendProtoMessage(scopeLogs, 2, record)
+		}
+		resourceLogs = appendProtoMessage(resourceLogs, 2, scopeLogs)
+	}
+	return appendProtoMessage(nil, 1, resourceLogs), "application/x-protobuf"
+}
+
+// otlpID returns v as a trace or span ID of size bytes, or nil if it is not
+// one: a hex string (or a fmt.Stringer printing one, as the IDs of the
+// OpenTelemetry API do) or a byte slice or array.  An ID of zeros is invalid.
+func otlpID(v interface{}, size int) []byte {
+	var id []byte
+	switch value := v.(type) {
+	case []byte:
+		id = value
+	case [16]byte:
+		id = value[:]
+	case [8]byte:
+		id = value[:]
+	case string:
+		id, _ = hex.DecodeString(value)
+	case fmt.Stringer:
+		id, _ = hex.DecodeString(value.String())
+	}
+	if len(id) != size {
+		return nil
+	}
+	for _, b := range id {
+		if b != 0 {
+			return id
+		}
+	}
+	return nil
+}
+
+// otlpValue returns v as one of the types of an AnyValue: string, bool, int64
+// or float64, or nil for no value.
+func otlpValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case nil, string, bool, int64, float64:
+		return value
+	case int:
+		return int64(value)
+	case int8:
+		return int64(value)
+	case int16:
+		return int64(value)
+	case int32:
+		return int64(value)
+	case uint:
+		return otlpUint(uint64(value))
+	case uint8:
+		return int64(value)
+	case uint16:
+		return int64(value)
+	case uint32:
+		return int64(value)
+	case uint64:
+		return otlpUint(value)
+	case float32:
+		return float64(value)
+	case error:
+		return value.Error()
+	case fmt.Stringer:
+		return value.String()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// otlpUint returns v as an int64, or as a string if it does not fit.
+func otlpUint(v uint64) interface{} {
+	if v > math.MaxInt64 {
+		return strconv.FormatUint(v, 10)
+	}
+	return int64(v)
+}
+
+// appendOTLPValue appends the fields of an AnyValue holding v, a value
+// returned by otlpValue.  The members of the oneof are written even if zero.
+func appendOTLPValue(b []byte, v interface{}) []byte {
+	switch value := v.(type) {
+	case string:
+		return appendProtoMessage(b, 1, []byte(value))
+	case bool:
+		b = appendProtoTag(b, 2, protoVarint)
+		if value {
+			return appendProtoVarint(b, 1)
+		}
+		return appendProtoVarint(b, 0)
+	case int64:
+		b = appendProtoTag(b, 3, protoVarint)
+		return appendProtoVarint(b, uint64(value))
+	case float64:
+		return appendProtoFixed64(b, 4, math.Float64bits(value))
+	}
+	return b
+}
+
+// appendOTLPAttribute appends the fields of the KeyValue of attr.
+func appendOTLPAttribute(b []byte, attr otlpAttribute) []byte {
+	b = appendProtoString(b, 1, attr.key)
+	return appendProtoMessage(b, 2, appendOTLPValue(nil, attr.value))
+}
+
+// writeOTLPValue writes the JSON AnyValue holding v, a value returned by
+// otlpValue.
+func writeOTLPValue(out *bytes.Buffer, v interface{}) {
+	switch value := v.(type) {
+	case string:
+		out.WriteString(`{"stringValue":`)
+		writeJSONString(out, value)
+	case bool:
+		out.WriteString(`{"boolValue":`)
+		out.WriteString(strconv.FormatBool(value))
+	case int64:
+		// 64-bit integers are strings in the JSON mapping of protobuf.
+		out.WriteString(`{"intValue":"`)
+		out.WriteString(strconv.FormatInt(value, 10))
+		out.WriteByte('"')
+	case float64:
+		out.WriteString(`{"doubleValue":`)
+		writeJSONFloat(out, value, 64)
+	default:
+		out.WriteString("{}")
+		return
+	}
+	out.WriteByte('}')
+}
+
+// writeOTLPAttributes writes attrs as a JSON array of KeyValues.
+func writeOTLPAttributes(out *bytes.Buffer, attrs []otlpAttribute) {
+	out.WriteByte('[')
+	for i, attr := range attrs {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		out.WriteString(`{"key":`)
+		writeJSONString(out, attr.key)
+		out.WriteString(`,"value":`)
+		writeOTLPValue(out, otlpValue(attr.value))
+		out.WriteByte('}')
+	}
+	out.WriteByte(']')
+}
@@ -0,0 +1,61 @@
+package logs
+
+import "encoding/binary"
+
+// Just enough of the protobuf wire format to encode the push requests of
+// collectors such as Loki, without depending on a protobuf library.  Fields
+// are appended to a byte slice in field order.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+func appendProtoVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendProtoTag(b []byte, field, wireType int) []byte {
+	return appendProtoVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// appendProtoUint appends an integer field (int32, int64, uint32, uint64,
+// bool or enum), omitting it if it is zero.
+func appendProtoUint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoTag(b, field, protoVarint)
+	return appendProtoVarint(b, v)
+}
+
+// appendProtoString appends a string field, omitting it if it is empty.
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendProtoTag(b, field, protoBytes)
+	b = appendProtoVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendProtoMessage appends an embedded message already encoded in msg.
+func appendProtoMessage(b []byte, field int, msg []byte) []byte {
+	b = appendProtoTag(b, field, protoBytes)
+	b = appendProtoVarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
+
+// appendProtoFixed64 appends a fixed64 or double field, even if it is zero:
+// a member of a oneof is always written.
+func appendProtoFixed64(b []byte, field int, v uint64) []byte {
+	b = appendProtoTag(b, field, protoFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
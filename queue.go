@@ -0,0 +1,447 @@
+package logs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrWriterClosed is returned when a writer is asked to do work after its
+// goroutine has stopped.
+var ErrWriterClosed = errors.New("log writer closed")
+
+// DroppedReportInterval is how often a writer that had to drop records writes
+// a WARN record saying how many were lost.
+var DroppedReportInterval = 10 * time.Second
+
+/****** OverflowPolicy ******/
+
+// An OverflowPolicy decides what LogWrite does when a writer's queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for room in the queue.  This is the default.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards the record being logged.
+	OverflowDropNewest
+	// OverflowDropOldest discards the oldest queued records to make room.
+	OverflowDropOldest
+	// OverflowBlockTimeout waits for room for a limited time, then discards
+	// the record being logged.
+	OverflowBlockTimeout
+)
+
+var overflowStrings = [...]string{"block", "drop-newest", "drop-oldest", "block-timeout"}
+
+func (p OverflowPolicy) String() string {
+	if p < 0 || int(p) >= len(overflowStrings) {
+		return "unknown"
+	}
+	return overflowStrings[p]
+}
+
+// ParseOverflowPolicy maps "block", "drop-newest", "drop-oldest" and
+// "block-timeout" to an OverflowPolicy.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if name == "" {
+		return OverflowBlock, nil
+	}
+	for i, str := range overflowStrings {
+		if str == name {
+			return OverflowPolicy(i), nil
+		}
+	}
+	return OverflowBlock, fmt.Errorf("unknown overflow policy %q", s)
+}
+
+/****** recordQueue ******/
+
+// recordQueue is the buffered hand-off between LogWrite and the goroutine of
+// a writer.  Besides records, the goroutine runs control functions sent with
+// do between two records, which is how flushes, rotations and
+// reconfigurations are kept in order with the records around them.
+type recordQueue struct {
+	dropped uint64 // records discarded since the last report, atomic; first for alignment
+
+	mu         sync.Mutex
+	buf        []*LogRecord
+	bytes      int // estimated size of buf
+	taken      int // records taken off buf by the writer and not written yet
+	takenBytes int // estimated size of those
+	waiting    int // LogWrite calls waiting for room
+	maxRecords int // limit on len(buf), 0 for none
+	maxBytes   int // limit on bytes, 0 for none
+	policy     OverflowPolicy
+	timeout    time.Duration // for OverflowBlockTimeout
+	closed     bool
+	closeCtx   context.Context // of the first CloseContext
+	closing    chan struct{}   // closed with the queue
+	ready      chan struct{}   // signalled when records are queued or the queue is closed
+	space      chan struct{}   // closed (and replaced) when records are taken off
+
+	ctl      chan func()
+	done     chan struct{}
+	flushCtx context.Context // of the Flush being served, only used on the writer goroutine
+
+	name  string                 // for error messages, e.g. FileLogWriter("x.log")
+	write func(*LogRecord) error // writes one record
+	sync  func() error           // commits written records to storage, may be nil
+	err   error                  // first write error since the last Flush
+}
+
+func newRecordQueue() *recordQueue {
+	return &recordQueue{
+		maxRecords: LogBufferLength,
+		closing:    make(chan struct{}),
+		ready:      make(chan struct{}, 1),
+		space:      make(chan struct{}),
+		ctl:        make(chan func()),
+		done:       make(chan struct{}),
+	}
+}
+
+// SetOverflowPolicy sets what LogWrite does when the queue is full.  timeout
+// is only used by OverflowBlockTimeout.
+func (q *recordQueue) SetOverflowPolicy(policy OverflowPolicy, timeout time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.policy, q.timeout = policy, timeout
+}
+
+// SetQueueLimits sizes the queue by number of records and by the estimated
+// bytes of the records; 0 disables a limit.  With both disabled the queue is
+// unbounded.
+func (q *recordQueue) SetQueueLimits(records, bytes int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.maxRecords, q.maxBytes = records, bytes
+	q.wakeProducers()
+}
+
+// Dropped returns the number of records discarded by the overflow policy that
+// have not been reported yet.
+func (q *recordQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// recordSize estimates the memory held by a queued record.
+func recordSize(rec *LogRecord) int {
+	n := 64 + len(rec.Message) + len(rec.Source) + len(rec.Category)
+	for _, field := range rec.Fields {
+		n += 16 + len(field.Key)
+	}
+	return n
+}
+
+// full reports whether a record of size n does not fit.  The records the
+// writer is still working through count against the limits, so that refilling
+// the queue meanwhile does not double the memory held.  An empty queue always
+// takes a record, so one oversized record cannot block forever.
+func (q *recordQueue) full(n int) bool {
+	count := len(q.buf) + q.taken
+	if count == 0 {
+		return false
+	}
+	return (q.maxRecords > 0 && count >= q.maxRecords) ||
+		(q.maxBytes > 0 && q.bytes+q.takenBytes+n > q.maxBytes)
+}
+
+// wakeProducers releases the LogWrite calls waiting for room.  The caller
+// must hold q.mu.
+func (q *recordQueue) wakeProducers() {
+	close(q.space)
+	q.space = make(chan struct{})
+}
+
+// This is the output method of the writer.  When the queue is full, the
+// overflow policy decides whether this blocks or discards a record.
+func (q *recordQueue) LogWrite(rec *LogRecord) {
+	n := recordSize(rec)
+	var deadline <-chan time.Time
+
+	q.mu.Lock()
+wait:
+	for q.full(n) && !q.closed {
+		switch q.policy {
+		case OverflowDropNewest:
+			q.mu.Unlock()
+			atomic.AddUint64(&q.dropped, 1)
+			return
+		case OverflowDropOldest:
+			if len(q.buf) == 0 {
+				// Only records being written are left: they cannot be
+				// dropped, so the queue takes this one over its limit.
+				break wait
+			}
+			q.bytes -= recordSize(q.buf[0])
+			q.buf[0] = nil
+			q.buf = q.buf[1:]
+			atomic.AddUint64(&q.dropped, 1)
+			continue
+		case OverflowBlockTimeout:
+			if deadline == nil {
+				timer := time.NewTimer(q.timeout)
+				defer timer.Stop()
+				deadline = timer.C
+			}
+		}
+
+		space := q.space
+		q.waiting++
+		q.mu.Unlock()
+		timedOut := false
+		select {
+		case <-space:
+		case <-deadline:
+			timedOut = true
+		}
+		q.mu.Lock()
+		q.waiting--
+		if timedOut {
+			q.mu.Unlock()
+			atomic.AddUint64(&q.dropped, 1)
+			return
+		}
+	}
+	if q.closed {
+		// Logging after Close: there is nobody left to write the record.
+		q.mu.Unlock()
+		return
+	}
+	q.buf = append(q.buf, rec)
+	q.bytes += n
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take removes and returns every queued record.  They keep counting against
+// the limits of the queue until each is passed to written.
+func (q *recordQueue) take() (recs []*LogRecord, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	recs, closed = q.buf, q.closed
+	if len(recs) > 0 {
+		q.taken, q.takenBytes = len(recs), q.bytes
+		q.buf, q.bytes = nil, 0
+	}
+	return recs, closed
+}
+
+// written frees the room held by rec, a record returned by take.
+func (q *recordQueue) written(rec *LogRecord) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.taken--
+	q.takenBytes -= recordSize(rec)
+	if q.taken == 0 {
+		q.takenBytes = 0
+	}
+	if q.waiting > 0 {
+		q.wakeProducers()
+	}
+}
+
+// start runs the writer goroutine until the queue is closed and drained, then
+// calls exit (if not nil).
+func (q *recordQueue) start(name string, write func(*LogRecord) error, sync func() error, exit func()) {
+	q.name, q.write, q.sync = name, write, sync
+	go func() {
+		defer close(q.done)
+		if exit != nil {
+			defer exit()
+		}
+		defer recoverPanic()
+
+		report := time.NewTicker(DroppedReportInterval)
+		defer report.Stop()
+
+		for {
+			select {
+			case fn := <-q.ctl:
+				// Records queued before the call to do come first.
+				q.drain()
+				fn()
+			case <-report.C:
+				q.reportDropped()
+			case <-q.ready:
+				if closed := q.drain(); closed {
+					q.reportDropped()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// drain writes every queued record and reports whether the queue is closed.
+func (q *recordQueue) drain() bool {
+	for {
+		recs, closed := q.take()
+		if len(recs) == 0 {
+			return closed
+		}
+		for _, rec := range recs {
+			q.writeRecord(rec)
+			q.written(rec)
+		}
+	}
+}
+
+func (q *recordQueue) writeRecord(rec *LogRecord) {
+	if err := q.write(rec); err != nil {
+		if q.err == nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", q.name, err)
+			q.err = err
+		}
+	}
+}
+
+// reportDropped writes a WARN record telling how many records were discarded
+// since the last report.
+func (q *recordQueue) reportDropped() {
+	n := atomic.SwapUint64(&q.dropped, 0)
+	if n == 0 {
+		return
+	}
+	q.writeRecord(&LogRecord{
+		Level:    WARN,
+		Created:  time.Now(),
+		Source:   "logs." + q.name,
+		Message:  fmt.Sprintf("%d log records dropped: queue full", n),
+		Category: "logs",
+	})
+}
+
+// do runs fn on the writer goroutine, waiting for it to be picked up unless
+// ctx is done first.
+func (q *recordQueue) do(ctx context.Context, fn func()) error {
+	select {
+	case q.ctl <- fn:
+		return nil
+	case <-q.done:
+		return ErrWriterClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sleep waits for d on the writer goroutine, unless the Flush or CloseContext
+// being served gives up waiting first.  It reports whether d has passed.
+func (q *recordQueue) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	var flushDone <-chan struct{}
+	if q.flushCtx != nil {
+		flushDone = q.flushCtx.Done()
+	}
+	select {
+	case <-timer.C:
+		return true
+	case <-flushDone:
+		return false
+	case <-q.closing:
+	}
+
+	q.mu.Lock()
+	closeDone := q.closeCtx.Done()
+	q.mu.Unlock()
+	select {
+	case <-timer.C:
+		return true
+	case <-flushDone:
+		return false
+	case <-closeDone:
+		return false
+	}
+}
+
+// Flush blocks until every record handed to LogWrite before the call has been
+// written and synced, or ctx is done.  It returns the first write error seen
+// since the previous Flush.
+func (q *recordQueue) Flush(ctx context.Context) error {
+	reply := make(chan error, 1)
+	err := q.do(ctx, func() {
+		q.flushCtx = ctx
+		defer func() { q.flushCtx = nil }()
+		q.drain()
+		err := q.err
+		q.err = nil
+		if q.sync != nil {
+			if serr := q.sync(); err == nil {
+				err = serr
+			}
+		}
+		reply <- err
+	})
+	if err == ErrWriterClosed {
+		// Everything was written when the goroutine exited.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CloseContext stops the writer once the records already queued have been
+// written, waiting for that until ctx is done.  Records logged after
+// CloseContext are discarded.
+func (q *recordQueue) CloseContext(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed, q.closeCtx = true, ctx
+		close(q.closing)
+		q.wakeProducers()
+	}
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the writer, blocking until the records already queued have
+// been written.  Records logged after Close are discarded.
+func (q *recordQueue) Close() {
+	_ = q.CloseContext(context.Background())
+}
+
+// WriterErrors reports the writers of a Logger that failed to flush or close,
+// keyed by filter name.
+type WriterErrors map[string]error
+
+func (e WriterErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, 0, len(e))
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", name, e[name]))
+	}
+	return strings.Join(msgs, "; ")
+}
@@ -0,0 +1,353 @@
+package logs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadMu serialises configuration swaps so that two reloads never try to
+// reuse the same writers at once.
+var reloadMu sync.Mutex
+
+// newLogger builds the Logger described by c.  FileLogWriters of old whose
+// filename is unchanged are reused rather than reopened; the new settings for
+// them are returned in commit, to be applied only once the whole build has
+// succeeded.  On error every writer opened by the build is closed again and
+// old is left untouched.
+func (c *LogConfig) newLogger(old Logger) (log Logger, commit func(), err error) {
+	log = make(Logger)
+	var created []*Filter
+	var commits []func()
+	defer func() {
+		if err != nil {
+			for _, filt := range created {
+				filt.Close()
+			}
+			log, commit = nil, nil
+		}
+	}()
+
+	openFiles := make(map[string]*FileLogWriter)
+	for _, filt := range old {
+		if flw, ok := filt.LogWriter.(*FileLogWriter); ok {
+			openFiles[fileKey(flw.filename)] = flw
+		}
+	}
+
+	if c.Console != nil && c.Console.Enable {
+		filt, err := NewConsoleFilter(*c.Console)
+		if err != nil {
+			return log, nil, err
+		}
+		created = append(created, filt)
+		log["stdout"] = filt
+		log["default"] = filt
+	}
+
+	register := func(category string, build func() (*Filter, error)) error {
+		if category == "" {
+			return errors.New("category is required")
+		}
+		key := category
+		if strings.EqualFold(category, "default") {
+			key = "default"
+		} else if category == "stdout" {
+			return fmt.Errorf("category %q is reserved for the console", category)
+		}
+		if prev, ok := log[key]; ok && prev != log["stdout"] {
+			return fmt.Errorf("duplicate category %q", category)
+		}
+		filt, err := build()
+		if err != nil {
+			return err
+		}
+		log[key] = filt
+		return nil
+	}
+	// add registers the filter made by build under category, naming the
+	// writer in the error.  After an error, add does nothing.
+	add := func(name, category string, build func() (*Filter, error)) {
+		if err != nil {
+			return
+		}
+		if rerr := register(category, build); rerr != nil {
+			err = fmt.Errorf("%s: %s", name, rerr)
+		}
+	}
+	// opened keeps track of the writers opened by the build, to close them
+	// again if it fails.
+	opened := func(filt *Filter, err error) (*Filter, error) {
+		if err == nil {
+			created = append(created, filt)
+		}
+		return filt, err
+	}
+
+	for _, fc := range c.Files {
+		if fc == nil || !fc.Enable {
+			continue
+		}
+		fc := *fc
+		add(fmt.Sprintf("file %q", fc.Filename), fc.Category, func() (*Filter, error) {
+			flw, ok := openFiles[fileKey(fc.Filename)]
+			if !ok || (flw.shared != nil) != fc.MultiProcess {
+				return opened(NewFileFilter(fc))
+			}
+			lvl, apply, err := fileSettings(fc)
+			if err != nil {
+				return nil, err
+			}
+			delete(openFiles, fileKey(fc.Filename))
+			commits = append(commits, func() { flw.reconfigure(apply) })
+			return &Filter{Level: lvl, LogWriter: flw, Category: categoryOrDefault(fc.Category), detached: !additive(fc.Additivity)}, nil
+		})
+	}
+	for _, sc := range c.Sockets {
+		if sc != nil && sc.Enable {
+			add(fmt.Sprintf("socket %q", sc.Addr), sc.Category, func() (*Filter, error) { return opened(NewSocketFilter(*sc)) })
+		}
+	}
+	for _, sc := range c.Syslog {
+		if sc != nil && sc.Enable {
+			add(fmt.Sprintf("syslog %q", sc.Addr), sc.Category, func() (*Filter, error) { return opened(NewSyslogFilter(*sc)) })
+		}
+	}
+	for _, hc := range c.HTTP {
+		if hc != nil && hc.Enable {
+			add(fmt.Sprintf("http %q", hc.URL), hc.Category, func() (*Filter, error) { return opened(NewHTTPFilter(*hc)) })
+		}
+	}
+	for _, ec := range c.Elasticsearch {
+		if ec != nil && ec.Enable {
+			add(fmt.Sprintf("elasticsearch %q", ec.URL), ec.Category, func() (*Filter, error) { return opened(NewElasticsearchFilter(*ec)) })
+		}
+	}
+	for _, lc := range c.Loki {
+		if lc != nil && lc.Enable {
+			add(fmt.Sprintf("loki %q", lc.URL), lc.Category, func() (*Filter, error) { return opened(NewLokiFilter(*lc)) })
+		}
+	}
+	for _, sc := range c.Splunk {
+		if sc != nil && sc.Enable {
+			add(fmt.Sprintf("splunk %q", sc.URL), sc.Category, func() (*Filter, error) { return opened(NewSplunkFilter(*sc)) })
+		}
+	}
+	for _, oc := range c.OTLP {
+		if oc != nil && oc.Enable {
+			add(fmt.Sprintf("otlp %q", oc.URL), oc.Category, func() (*Filter, error) { return opened(NewOTLPFilter(*oc)) })
+		}
+	}
+	for _, fc := range c.Fluent {
+		if fc != nil && fc.Enable {
+			add(fmt.Sprintf("fluent %q", fc.Addr), fc.Category, func() (*Filter, error) { return opened(NewFluentFilter(*fc)) })
+		}
+	}
+	if err != nil {
+		return log, nil, err
+	}
+
+	commit = func() {
+		for _, fn := range commits {
+			fn()
+		}
+	}
+	return log, commit, nil
+}
+
+func fileKey(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		return abs
+	}
+	return filepath.Clean(filename)
+}
+
+// ApplyConfiguration replaces the filters in Global with the ones described by
+// config.  Open FileLogWriters whose filename did not change keep writing
+// without being reopened.  Filters registered under a category that still
+// exists are updated in place, so loggers obtained earlier from GetLogger (and
+// their With children) follow the new configuration.  Writers that are no
+// longer used are closed in the background once their queues have drained.
+// If config is invalid an error is returned and Global is left untouched.
+func ApplyConfiguration(config *LogConfig) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	old := currentGlobal()
+	log, commit, err := config.newLogger(old)
+	if err != nil {
+		return err
+	}
+
+	globalMu.Lock()
+	assigned := make(map[*Filter]*Filter, len(log))
+	for key, filt := range log {
+		prev, ok := old[key]
+		if !ok || prev == nil {
+			continue
+		}
+		if to, taken := assigned[prev]; taken && to != filt {
+			// prev was shared by names that now go to different filters.
+			continue
+		}
+		assigned[prev] = filt
+		prev.Level, prev.LogWriter, prev.Category = filt.Level, filt.LogWriter, filt.Category
+		prev.detached = filt.detached
+		log[key] = prev
+	}
+	for key, prev := range old {
+		if _, ok := log[key]; !ok && assigned[prev] == nil {
+			// Keep loggers cached from a removed category usable: they now
+			// resolve through their ancestors, like an unconfigured category.
+			prev.LogWriter = nil
+			prev.detached = false
+		}
+	}
+	inUse := make(map[interface{}]bool, len(log))
+	for _, filt := range log {
+		inUse[writerKey(filt)] = true
+	}
+	var retired []LogWriter
+	for _, filt := range old {
+		if key := writerKey(filt); !inUse[key] {
+			inUse[key] = true
+			retired = append(retired, filt.LogWriter)
+		}
+	}
+	Global = log
+	globalMu.Unlock()
+
+	commit()
+	go func() {
+		defer recoverPanic()
+		for _, w := range retired {
+			w.Close()
+		}
+	}()
+	return nil
+}
+
+// ReloadJsonConfiguration reads the configuration file at path and applies it
+// with ApplyConfiguration.
+func ReloadJsonConfiguration(path string) error {
+	content, err := ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("ReloadJsonConfiguration: %s", err)
+	}
+	config, err := ParseJsonConfiguration([]byte(content))
+	if err != nil {
+		return err
+	}
+	if err := ApplyConfiguration(config); err != nil {
+		return fmt.Errorf("ReloadJsonConfiguration: %s", err)
+	}
+	return nil
+}
+
+/****** ConfigWatcher ******/
+
+// A ConfigWatcher reloads a JSON configuration file into Global whenever the
+// file changes on disk or the process receives SIGHUP; on SIGHUP the log files
+// are reopened as well, see ReopenFiles.  A configuration that fails to load is
+// reported to stderr and as an ERROR record, and the working setup is kept.
+type ConfigWatcher struct {
+	path     string
+	interval time.Duration
+
+	modTime time.Time
+	size    int64
+
+	hup  chan os.Signal
+	stop chan struct{}
+	done chan struct{}
+}
+
+// WatchJsonConfiguration loads the configuration file at path and keeps it
+// applied: the file is polled every interval (no polling if interval <= 0) and
+// re-read on SIGHUP.  The initial load must succeed.
+func WatchJsonConfiguration(path string, interval time.Duration) (*ConfigWatcher, error) {
+	cw := &ConfigWatcher{
+		path:     path,
+		interval: interval,
+		hup:      make(chan os.Signal, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	cw.modTime, cw.size = cw.stat()
+	if err := ReloadJsonConfiguration(path); err != nil {
+		return nil, err
+	}
+
+	signal.Notify(cw.hup, syscall.SIGHUP)
+	go cw.run()
+	return cw, nil
+}
+
+func (cw *ConfigWatcher) run() {
+	defer close(cw.done)
+	defer recoverPanic()
+
+	var tick <-chan time.Time
+	if cw.interval > 0 {
+		ticker := time.NewTicker(cw.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-cw.stop:
+			return
+		case <-cw.hup:
+			cw.modTime, cw.size = cw.stat()
+			cw.reload()
+			if err := ReopenFiles(); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "ConfigWatcher(%q): %s\n", cw.path, err)
+			}
+		case <-tick:
+			modTime, size := cw.stat()
+			if modTime.Equal(cw.modTime) && size == cw.size {
+				continue
+			}
+			cw.modTime, cw.size = modTime, size
+			cw.reload()
+		}
+	}
+}
+
+func (cw *ConfigWatcher) stat() (time.Time, int64) {
+	info, err := os.Stat(cw.path)
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return info.ModTime(), info.Size()
+}
+
+func (cw *ConfigWatcher) reload() {
+	if err := cw.Reload(); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "ConfigWatcher(%q): %s\n", cw.path, err)
+		currentGlobal().Log(ERROR, "logs.ConfigWatcher", fmt.Sprintf("keeping current logging configuration: %s", err))
+	}
+}
+
+// Reload re-reads the configuration file immediately.
+func (cw *ConfigWatcher) Reload() error {
+	return ReloadJsonConfiguration(cw.path)
+}
+
+// Stop ends the watch.  The configuration currently applied stays in place.
+func (cw *ConfigWatcher) Stop() {
+	signal.Stop(cw.hup)
+	select {
+	case <-cw.stop:
+	default:
+		close(cw.stop)
+	}
+	<-cw.done
+}
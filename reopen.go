@@ -0,0 +1,153 @@
+package logs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Reopen closes the log file and opens the file now found at its path, e.g.
+// after logrotate moved it away.  It waits for the records queued before the
+// call to be written to the old file.
+func (w *FileLogWriter) Reopen() error {
+	reply := make(chan error, 1)
+	if err := w.do(context.Background(), func() { reply <- w.locked(w.reopen) }); err != nil {
+		return err
+	}
+	return <-reply
+}
+
+func (w *FileLogWriter) reopen() error {
+	if w.file != nil {
+		_, _ = fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
+		_ = w.file.Close()
+	}
+	if err := w.openFile(true); err != nil {
+		w.file = nil
+		return fmt.Errorf("Reopen: %s", err)
+	}
+	return nil
+}
+
+// SetReopenCheck makes the writer compare the open file with the one at its
+// path every interval, and reopen the path when they differ because the file
+// was moved or removed (chainable).  0 stops checking.
+func (w *FileLogWriter) SetReopenCheck(interval time.Duration) *FileLogWriter {
+	if w.checkStop != nil {
+		close(w.checkStop)
+		w.checkStop = nil
+	}
+	if interval <= 0 {
+		return w
+	}
+
+	stop := make(chan struct{})
+	w.checkStop = stop
+	go func() {
+		defer recoverPanic()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-w.done:
+				return
+			case <-ticker.C:
+				_ = w.do(context.Background(), w.checkFile)
+			}
+		}
+	}()
+	return w
+}
+
+// SetCopyTruncate makes the checks of SetReopenCheck notice the file being
+// truncated in place, as logrotate's copytruncate does, and restart the size
+// and line counts from what is left (chainable).
+func (w *FileLogWriter) SetCopyTruncate(copyTruncate bool) *FileLogWriter {
+	w.copyTruncate = copyTruncate
+	return w
+}
+
+// checkFile reopens the log file if the path now leads to another file, and
+// notices truncation in copytruncate mode.
+func (w *FileLogWriter) checkFile() {
+	if w.file == nil {
+		if err := w.openFile(true); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+		}
+		return
+	}
+	open, err := w.file.Stat()
+	if err != nil {
+		return
+	}
+	disk, err := os.Stat(w.filename)
+	if err != nil || !os.SameFile(open, disk) {
+		if err := w.reopen(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+		}
+		return
+	}
+	if w.copyTruncate && disk.Size() < int64(w.maxsizeCurSize) {
+		w.MaxLinesCurLines, w.maxsizeCurSize = 0, int(disk.Size())
+		w.opened, w.linesCounted = timeNow(), disk.Size() == 0
+		if countsLines(w.rotation) {
+			w.countLines()
+		}
+	}
+}
+
+// ReopenFiles reopens the files of the FileLogWriters in Global, see
+// (*FileLogWriter).Reopen.
+func ReopenFiles() error {
+	errs := make(WriterErrors)
+	seen := make(map[*FileLogWriter]bool)
+	for name, filt := range currentGlobal() {
+		w, ok := filt.LogWriter.(*FileLogWriter)
+		if !ok || seen[w] {
+			continue
+		}
+		seen[w] = true
+		if err := w.Reopen(); err != nil {
+			errs[name] = err
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// NotifyReopen calls ReopenFiles whenever the process receives one of sigs,
+// SIGHUP if none is given, until stop is called.  Use it when logrotate is told
+// to signal the process after moving the files; a ConfigWatcher already
+// reopens the files on SIGHUP.
+func NotifyReopen(sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+	go func() {
+		defer recoverPanic()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ch:
+				if err := ReopenFiles(); err != nil {
+					_, _ = fmt.Fprintf(os.Stderr, "ReopenFiles: %s\n", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
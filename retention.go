@@ -0,0 +1,92 @@
+package logs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// retention says which old logfiles a FileLogWriter keeps.  A zero field sets
+// no limit.
+type retention struct {
+	maxAge       time.Duration // remove backups last written longer ago
+	maxBackups   int           // keep at most this many backups, newest first
+	maxTotalSize int64         // keep the newest backups fitting in this many bytes
+}
+
+func (r retention) enabled() bool {
+	return r.maxAge > 0 || r.maxBackups > 0 || r.maxTotalSize > 0
+}
+
+// SetRetention limits the old logfiles kept next to the log, numbered and
+// dated ones alike, compressed or not (chainable): backups last written more
+// than maxAge ago are removed, as are all but the newest maxBackups and those
+// beyond maxTotalSize bytes in total.  0 disables a limit.  The limits are
+// enforced in the background now and after each rotation.
+func (w *FileLogWriter) SetRetention(maxAge time.Duration, maxBackups int, maxTotalSize int64) *FileLogWriter {
+	w.retention = retention{maxAge: maxAge, maxBackups: maxBackups, maxTotalSize: maxTotalSize}
+	w.pruneBackups()
+	return w
+}
+
+// pruneBackups removes the backups the retention policy no longer keeps, in
+// the background.
+func (w *FileLogWriter) pruneBackups() {
+	r, isBackup := w.retention, w.backupMatcher()
+	if !r.enabled() {
+		return
+	}
+	w.background(func() {
+		for _, path := range r.expired(listBackups(filepath.Dir(w.filename), isBackup), time.Now()) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				_, _ = fmt.Fprintf(os.Stderr, "FileLogWriter(%q): retention: %s\n", w.filename, err)
+			}
+		}
+	})
+}
+
+// expired returns the paths of the backups r does not keep at now.
+func (r retention) expired(backups []backup, now time.Time) []string {
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].modTime.After(backups[j].modTime)
+	})
+
+	var paths []string
+	var total int64
+	for i, b := range backups {
+		total += b.size
+		if (r.maxBackups > 0 && i >= r.maxBackups) ||
+			(r.maxAge > 0 && now.Sub(b.modTime) > r.maxAge) ||
+			(r.maxTotalSize > 0 && total > r.maxTotalSize) {
+			paths = append(paths, b.path)
+		}
+	}
+	return paths
+}
+
+// A backup is an old logfile.
+type backup struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// listBackups returns the old logfiles in dir, compressed or not, whose names
+// isBackup recognises.
+func listBackups(dir string, isBackup func(name string) bool) []backup {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var backups []backup
+	for _, info := range infos {
+		if !info.IsDir() && isBackup(strings.TrimSuffix(info.Name(), gzipSuffix)) {
+			backups = append(backups, backup{filepath.Join(dir, info.Name()), info.ModTime(), info.Size()})
+		}
+	}
+	return backups
+}
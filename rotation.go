@@ -0,0 +1,180 @@
+package logs
+
+import (
+	"bytes"
+	"os"
+	"time"
+)
+
+// FileState describes the file a FileLogWriter is writing to.
+type FileState struct {
+	Size   int64     // bytes in the file, including what it held when opened
+	Lines  int       // lines in the file, counted when opened only if the policy needs them
+	Opened time.Time // when the file was opened, or last written to before that if it was appended to
+}
+
+// A RotationPolicy decides when a FileLogWriter starts a new file.  It is
+// consulted on the writer goroutine before each record is written.
+type RotationPolicy interface {
+	ShouldRotate(state FileState, now time.Time) bool
+}
+
+// SizePolicy rotates once the file holds max bytes.
+func SizePolicy(max int64) RotationPolicy {
+	return sizePolicy(max)
+}
+
+type sizePolicy int64
+
+func (p sizePolicy) ShouldRotate(state FileState, now time.Time) bool {
+	return state.Size >= int64(p)
+}
+
+// LinesPolicy rotates once the file holds max lines.
+func LinesPolicy(max int) RotationPolicy {
+	return linesPolicy(max)
+}
+
+type linesPolicy int
+
+func (p linesPolicy) ShouldRotate(state FileState, now time.Time) bool {
+	return state.Lines >= int(p)
+}
+
+// TimePolicy rotates at the times of schedule: when a rotation time has passed
+// since the file was opened.
+func TimePolicy(schedule Schedule) RotationPolicy {
+	return &timePolicy{schedule: schedule}
+}
+
+type timePolicy struct {
+	schedule Schedule
+	opened   time.Time // of the file next was computed for
+	next     time.Time
+}
+
+func (p *timePolicy) ShouldRotate(state FileState, now time.Time) bool {
+	if !state.Opened.Equal(p.opened) || p.next.IsZero() {
+		p.opened, p.next = state.Opened, p.schedule.Next(state.Opened)
+	}
+	return !now.Before(p.next)
+}
+
+// AnyOf rotates as soon as one of policies says so.
+func AnyOf(policies ...RotationPolicy) RotationPolicy {
+	return anyOf(policies)
+}
+
+type anyOf []RotationPolicy
+
+func (p anyOf) ShouldRotate(state FileState, now time.Time) bool {
+	for _, policy := range p {
+		if policy.ShouldRotate(state, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// countsLines reports whether p may look at FileState.Lines, which makes
+// opening a file that is appended to count its lines.
+func countsLines(p RotationPolicy) bool {
+	switch p := p.(type) {
+	case nil, sizePolicy, *timePolicy:
+		return false
+	case anyOf:
+		for _, policy := range p {
+			if countsLines(policy) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// SetRotationPolicy adds policy to the size, line and time limits set with the
+// other Set* methods (chainable): the file rotates as soon as one of them says
+// so.  A nil policy removes the one set before.
+func (w *FileLogWriter) SetRotationPolicy(policy RotationPolicy) *FileLogWriter {
+	w.custom = policy
+	w.updateRotation()
+	return w
+}
+
+// updateRotation rebuilds the policy consulted before each write.
+func (w *FileLogWriter) updateRotation() {
+	var policies anyOf
+	if w.maxsize > 0 {
+		policies = append(policies, SizePolicy(int64(w.maxsize)))
+	}
+	if w.MaxLines > 0 {
+		policies = append(policies, LinesPolicy(w.MaxLines))
+	}
+	if w.schedule != nil {
+		policies = append(policies, TimePolicy(w.schedule))
+	}
+	if w.custom != nil {
+		policies = append(policies, w.custom)
+	}
+
+	switch len(policies) {
+	case 0:
+		w.rotation = nil
+	case 1:
+		w.rotation = policies[0]
+	default:
+		w.rotation = policies
+	}
+	if countsLines(w.rotation) {
+		w.countLines()
+	}
+}
+
+// fileState returns the state of the open file.
+func (w *FileLogWriter) fileState() FileState {
+	return FileState{Size: int64(w.maxsizeCurSize), Lines: w.MaxLinesCurLines, Opened: w.opened}
+}
+
+// seedState sets the rotation state of the file just opened.  prev is the
+// file as it was before the writer first opened it, nil if it did not exist or
+// the file is opened by a rotation: a file appended to on startup counts with
+// what it holds already, otherwise the counts start at zero.
+func (w *FileLogWriter) seedState(prev os.FileInfo, now time.Time) {
+	w.MaxLinesCurLines, w.maxsizeCurSize = 0, 0
+	w.opened, w.linesCounted = now, true
+	if prev == nil || prev.Size() == 0 {
+		return
+	}
+	w.opened, w.linesCounted = prev.ModTime(), false
+	if info, err := w.file.Stat(); err == nil {
+		w.maxsizeCurSize = int(info.Size())
+	}
+	if countsLines(w.rotation) {
+		w.countLines()
+	}
+}
+
+// countLines counts the lines already in the file, once per file.
+func (w *FileLogWriter) countLines() {
+	if w.linesCounted || w.file == nil {
+		return
+	}
+	w.linesCounted = true
+	f, err := os.Open(w.filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	lines := 0
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		lines += bytes.Count(buf[:n], []byte{'\n'})
+		if err != nil {
+			break
+		}
+	}
+	w.MaxLinesCurLines = lines
+}
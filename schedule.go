@@ -0,0 +1,210 @@
+package logs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule decides when a FileLogWriter rotates by time.
+type Schedule interface {
+	// Next returns the first rotation time strictly after t.
+	Next(t time.Time) time.Time
+}
+
+// Every returns a Schedule rotating each interval at fixed boundaries of the
+// clock of loc (time.Local if nil), shifted by offset: Every(time.Hour, 0, loc)
+// rotates on the hour, Every(24*time.Hour, 4*time.Hour, loc) daily at 04:00.
+// Intervals dividing a day are counted from midnight; longer ones must be a
+// whole number of days and are counted from Monday 2000-01-03, so that
+// Every(7*24*time.Hour, 0, loc) rotates on Monday mornings.
+func Every(interval, offset time.Duration, loc *time.Location) (Schedule, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	const day = 24 * time.Hour
+	switch {
+	case interval < time.Minute:
+		return nil, fmt.Errorf("rotation interval %s is shorter than a minute", interval)
+	case interval < day && day%interval != 0:
+		return nil, fmt.Errorf("rotation interval %s does not divide a day", interval)
+	case interval > day && interval%day != 0:
+		return nil, fmt.Errorf("rotation interval %s is not a whole number of days", interval)
+	case offset < 0 || offset >= day:
+		return nil, fmt.Errorf("rotation boundary %s is not within a day", offset)
+	}
+	return every{interval: interval, offset: offset, loc: loc}, nil
+}
+
+type every struct {
+	interval, offset time.Duration
+	loc              *time.Location
+}
+
+// epochDay is the day number of Monday 2000-01-03, the origin of intervals
+// longer than a day.
+var epochDay = dayNumber(2000, time.January, 3)
+
+// dayNumber counts the days since 1970-01-01 without regard to time zones.
+func dayNumber(year int, month time.Month, day int) int64 {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / 86400
+}
+
+func (e every) Next(t time.Time) time.Time {
+	t = t.In(e.loc)
+	y, m, d := t.Date()
+	days := int64(e.interval / (24 * time.Hour))
+	if days <= 1 {
+		// t may fall before the first boundary of its own day.
+		for i := -1; i <= 1; i++ {
+			start := time.Date(y, m, d+i, 0, 0, 0, 0, e.loc).Add(e.offset)
+			end := time.Date(y, m, d+i+1, 0, 0, 0, 0, e.loc).Add(e.offset)
+			for next := start; next.Before(end); next = next.Add(e.interval) {
+				if next.After(t) {
+					return next
+				}
+			}
+		}
+		return time.Date(y, m, d+2, 0, 0, 0, 0, e.loc).Add(e.offset)
+	}
+
+	into := (dayNumber(y, m, d) - epochDay) % days
+	if into < 0 {
+		into += days
+	}
+	next := time.Date(y, m, d-int(into), 0, 0, 0, 0, e.loc).Add(e.offset)
+	if !next.After(t) {
+		next = time.Date(y, m, d-int(into)+int(days), 0, 0, 0, 0, e.loc).Add(e.offset)
+	}
+	return next
+}
+
+// ParseSchedule parses a rotation schedule in loc (time.Local if nil):
+//
+//	@hourly, @daily, @weekly (Monday 00:00), @monthly
+//	@every 6h        every 6 hours from midnight, see Every
+//	30 4 * * *       a cron spec: minute hour day-of-month month day-of-week
+//
+// Cron fields take *, numbers, ranges (1-5), lists (1,15) and steps (*/15);
+// day-of-week counts from 0 for Sunday.
+func ParseSchedule(spec string, loc *time.Location) (Schedule, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		return Every(time.Hour, 0, loc)
+	case "@daily", "@midnight":
+		return Every(24*time.Hour, 0, loc)
+	case "@weekly":
+		return Every(7*24*time.Hour, 0, loc)
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := strToDuration(strings.TrimPrefix(spec, "@every "))
+		if err != nil {
+			return nil, fmt.Errorf("bad schedule %q: %s", spec, err)
+		}
+		return Every(interval, 0, loc)
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("bad schedule %q: want 5 cron fields", spec)
+	}
+	c := cron{loc: loc}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("bad schedule %q: %s", spec, err)
+		}
+		*sets[i] = set
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday as well
+	}
+	c.domStar, c.dowStar = fields[2] == "*", fields[4] == "*"
+	if c.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("bad schedule %q: never fires", spec)
+	}
+	return c, nil
+}
+
+// parseCronField returns the set of values in field as a bit mask.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step, part = n, part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+	loc                           *time.Location
+}
+
+func (c cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (c cron) Next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	// Five years covers every valid spec, including 29 February.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,79 @@
+package logs
+
+import (
+	"encoding/binary"
+)
+
+// snappyEncode compresses src in the snappy block format, which Loki expects
+// for protobuf push requests.  Matches are found with a hash table of the
+// 4-byte sequences seen so far, as the reference encoder does; offsets are
+// kept under 64K so that only 2-byte offset copies are needed.
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, len(src)+len(src)/6+32)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+
+	const (
+		tableBits = 14
+		minMatch  = 4
+		maxOffset = 1<<16 - 1
+	)
+	var table [1 << tableBits]int32 // position+1 of the last sequence with a hash
+	hash := func(i int) uint32 {
+		return binary.LittleEndian.Uint32(src[i:]) * 0x1e35a7bd >> (32 - tableBits)
+	}
+
+	literal := 0 // start of the bytes not encoded yet
+	for i := 0; i+minMatch <= len(src); {
+		h := hash(i)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > maxOffset ||
+			binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+		end := i + minMatch
+		for end < len(src) && src[end] == src[end-i+candidate] {
+			end++
+		}
+		dst = snappyLiteral(dst, src[literal:i])
+		dst = snappyCopy(dst, i-candidate, end-i)
+		i, literal = end, end
+	}
+	return snappyLiteral(dst, src[literal:])
+}
+
+// snappyLiteral appends the bytes lit as they are.
+func snappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// snappyCopy appends a copy of length bytes from offset bytes back, in pieces
+// of at most 64 bytes.
+func snappyCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
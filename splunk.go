@@ -0,0 +1,329 @@
+package logs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults of a new SplunkWriter.
+const (
+	DefaultSplunkSourceType = "_json"
+	DefaultSplunkAckTimeout = 30 * time.Second
+)
+
+// splunkAckInterval is how often a SplunkWriter asks which batches have been
+// indexed.
+var splunkAckInterval = time.Second
+
+// SplunkWriter sends records to a Splunk HTTP Event Collector (HEC).  It is
+// an HTTPWriter, batching and retrying alike.  Each record is an event whose
+// body is the record formatted by the layout: the object made by JSONLayout,
+// the default, or a string with any other layout.  The event has the metadata
+//
+//	time        time of the record
+//	host        see SetHost
+//	source      function of the source of the record
+//	sourcetype  "_json" by default, see SetEventMetadata
+//	index       the default index of the token unless set, see SetEventMetadata
+//
+// With indexer acknowledgement (SetAcknowledgement) the writer asks the
+// collector, in the background, which batches have been indexed; a batch not
+// acknowledged in time is sent again, up to the retries of SetRetries, and
+// then given up.  Flush only waits for the batches to be received; Close also
+// waits, up to the ack timeout, for them to be acknowledged.
+type SplunkWriter struct {
+	*HTTPWriter
+	base       string
+	host       string
+	source     string // instead of the source of the record if set
+	sourceType string
+	index      string
+
+	// Indexer acknowledgement, guarded by mu
+	channel    string // "" if disabled
+	ackTimeout time.Duration
+	pending    map[int64]*splunkBatch
+	resends    int // of the batch being sent
+}
+
+// splunkBatch is a batch waiting to be acknowledged.
+type splunkBatch struct {
+	batch   [][]byte
+	sent    time.Time
+	resends int
+}
+
+// NewSplunkWriter returns a SplunkWriter sending to the collector at url, e.g.
+// "https://splunk:8088", with token.
+func NewSplunkWriter(url, token string, level Level) *SplunkWriter {
+	base := strings.TrimRight(url, "/")
+	w := &SplunkWriter{
+		HTTPWriter: newHTTPWriter(base+"/services/collector/event", level),
+		base:       base,
+		sourceType: DefaultSplunkSourceType,
+		ackTimeout: DefaultSplunkAckTimeout,
+		pending:    make(map[int64]*splunkBatch),
+	}
+	w.host, _ = os.Hostname()
+	w.header.Set("Authorization", "Splunk "+token)
+	w.encode = w.event
+	w.marshal = w.events
+	w.results = w.received
+	w.start(fmt.Sprintf("SplunkWriter(%s)", url), w.write, w.flushBatch, w.close)
+	go w.ackLoop(splunkAckInterval)
+	return w
+}
+
+// SetHost sets the host of the events; the empty name stands for
+// os.Hostname().
+func (w *SplunkWriter) SetHost(name string) {
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.host = name
+}
+
+// SetEventMetadata sets the source, sourcetype and index of the events.  An
+// empty source stands for the source of each record, an empty sourcetype for
+// "_json" and an empty index for the default index of the token.
+func (w *SplunkWriter) SetEventMetadata(source, sourceType, index string) {
+	if sourceType == "" {
+		sourceType = DefaultSplunkSourceType
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.source, w.sourceType, w.index = source, sourceType, index
+}
+
+// SetAcknowledgement enables indexer acknowledgement, which must also be
+// enabled on the token; a batch not acknowledged within timeout is sent again.
+func (w *SplunkWriter) SetAcknowledgement(enable bool, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultSplunkAckTimeout
+	}
+	channel := ""
+	if enable {
+		channel = newChannelID()
+	}
+	w.SetHeader("X-Splunk-Request-Channel", channel)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.channel, w.ackTimeout = channel, timeout
+}
+
+// newChannelID returns a random UUID, as HEC wants for a channel.
+func newChannelID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// event encodes rec as a HEC event.  It is called holding w.mu.
+func (w *SplunkWriter) event(rec *LogRecord) []byte {
+	created := rec.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	source := w.source
+	if source == "" {
+		source, _ = splitSource(rec.Source)
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, 256))
+	fmt.Fprintf(out, `{"time":%d.%03d`, created.Unix(), created.Nanosecond()/1e6)
+	if w.host != "" {
+		out.WriteString(`,"host":`)
+		writeJSONString(out, w.host)
+	}
+	if source != "" {
+		out.WriteString(`,"source":`)
+		writeJSONString(out, source)
+	}
+	out.WriteString(`,"sourcetype":`)
+	writeJSONString(out, w.sourceType)
+	if w.index != "" {
+		out.WriteString(`,"index":`)
+		writeJSONString(out, w.index)
+	}
+	out.WriteString(`,"event":`)
+	body := strings.TrimRight(w.layout.Format(rec), "\r\n")
+	switch w.layout.(type) {
+	case JSONLayout, *JSONLayout:
+		out.WriteString(body)
+	default:
+		writeJSONString(out, body)
+	}
+	out.WriteString("}\n")
+	return out.Bytes()
+}
+
+// events puts the events of a batch one after the other, as HEC wants them.
+func (w *SplunkWriter) events(batch [][]byte) ([]byte, string) {
+	return bytes.Join(batch, nil), "application/json"
+}
+
+// received notes the ack id of a batch the collector received, if
+// acknowledgement is enabled.
+func (w *SplunkWriter) received(resp []byte, batch [][]byte) ([][]byte, int, error) {
+	var r struct {
+		AckID *int64 `json:"ackId"`
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.channel == "" {
+		return nil, 0, nil
+	}
+	if json.Unmarshal(resp, &r) != nil || r.AckID == nil {
+		// Acknowledgement is not enabled on the token: nothing to wait for.
+		return nil, 0, nil
+	}
+	w.pending[*r.AckID] = &splunkBatch{batch: batch, sent: time.Now(), resends: w.resends}
+	return nil, 0, nil
+}
+
+// ackLoop checks the acknowledgements in the background, every interval.
+func (w *SplunkWriter) ackLoop(interval time.Duration) {
+	defer recoverPanic()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			waiting := len(w.pending) > 0
+			w.mu.Unlock()
+			if waiting {
+				_ = w.do(context.Background(), func() { w.checkAcks(false) })
+			}
+		}
+	}
+}
+
+// checkAcks forgets the batches acknowledged, and sends again the ones that
+// waited too long, or gives them up if closing or out of retries.  It runs on
+// the writer goroutine.
+func (w *SplunkWriter) checkAcks(closing bool) {
+	w.mu.Lock()
+	ids := make([]int64, 0, len(w.pending))
+	for id := range w.pending {
+		ids = append(ids, id)
+	}
+	channel, timeout, retries := w.channel, w.ackTimeout, w.retries
+	w.mu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	acked, err := w.queryAcks(channel, ids)
+	now := time.Now()
+	var resend []*splunkBatch
+	w.mu.Lock()
+	for _, id := range ids {
+		p := w.pending[id]
+		if acked[id] {
+			delete(w.pending, id)
+		} else if closing || now.Sub(p.sent) >= timeout {
+			delete(w.pending, id)
+			resend = append(resend, p)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, p := range resend {
+		if closing || p.resends >= retries {
+			if err == nil {
+				err = fmt.Errorf("not acknowledged within %s", timeout)
+			}
+			derr := w.giveUp(len(p.batch), 0, err)
+			_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", w.name, derr)
+			continue
+		}
+		w.mu.Lock()
+		w.resends = p.resends + 1
+		w.mu.Unlock()
+		if failed, status, serr := w.send(p.batch); failed > 0 {
+			_ = w.giveUp(failed, status, serr)
+		}
+		w.mu.Lock()
+		w.resends = 0
+		w.mu.Unlock()
+	}
+}
+
+// queryAcks asks the collector which of ids have been indexed.
+func (w *SplunkWriter) queryAcks(channel string, ids []int64) (map[int64]bool, error) {
+	body, _ := json.Marshal(map[string][]int64{"acks": ids})
+	req, err := http.NewRequest(http.MethodPost, w.base+"/services/collector/ack?channel="+channel, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	w.mu.Lock()
+	for key, values := range w.header {
+		req.Header[key] = values
+	}
+	client := w.client
+	w.mu.Unlock()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("ack query: %s: %s", resp.Status, strings.TrimSpace(string(text)))
+	}
+	var r struct {
+		Acks map[string]bool `json:"acks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("ack query: %s", err)
+	}
+	acked := make(map[int64]bool, len(r.Acks))
+	for id, ok := range r.Acks {
+		if n, err := strconv.ParseInt(id, 10, 64); err == nil && ok {
+			acked[n] = true
+		}
+	}
+	return acked, nil
+}
+
+// close sends the last batch, then waits up to the ack timeout for the
+// batches sent to be acknowledged, giving up the others.
+func (w *SplunkWriter) close() {
+	w.exit()
+	w.mu.Lock()
+	deadline := time.Now().Add(w.ackTimeout)
+	w.mu.Unlock()
+	for {
+		w.mu.Lock()
+		waiting := len(w.pending) > 0
+		w.mu.Unlock()
+		if !waiting {
+			return
+		}
+		if time.Now().After(deadline) {
+			w.checkAcks(true)
+			return
+		}
+		time.Sleep(splunkAckInterval / 4)
+		w.checkAcks(false)
+	}
+}
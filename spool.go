@@ -0,0 +1,179 @@
+package logs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// maxSpoolMessage bounds the length read from a message header of the file,
+// which a crash or a stray file may have garbled.
+const maxSpoolMessage = 64 << 20
+
+// A spool keeps the messages a ConnWriter could not send, in order: in memory
+// first and, once that is full, in a file.  Every message in memory is older
+// than every message in the file, so a message goes to memory only while the
+// file is empty.  The file outlives the process: a ConnWriter spooling to the
+// same file later sends what is left in it first.
+type spool struct {
+	mem    [][]byte
+	maxMem int // messages kept in memory
+
+	path     string // "" for no file
+	maxBytes int64  // size limit of the file, 0 for none
+	file     *os.File
+	size     int64 // bytes in the file
+	offset   int64 // bytes of the file already sent
+}
+
+// newSpool returns a spool keeping maxMem messages in memory and, if path is
+// not empty, up to maxBytes in the file path.
+func newSpool(maxMem int, path string, maxBytes int64) *spool {
+	s := &spool{maxMem: maxMem, path: path, maxBytes: maxBytes}
+	if path != "" {
+		if info, err := os.Stat(path); err == nil {
+			s.size = info.Size()
+		}
+	}
+	return s
+}
+
+// len returns the number of messages in memory; those in the file are not
+// counted.
+func (s *spool) len() int {
+	return len(s.mem)
+}
+
+func (s *spool) empty() bool {
+	return len(s.mem) == 0 && s.offset >= s.size
+}
+
+// push adds msg at the end of the spool, reporting false if there is no room
+// left for it.
+func (s *spool) push(msg []byte) bool {
+	if s.offset >= s.size && len(s.mem) < s.maxMem {
+		s.mem = append(s.mem, append([]byte(nil), msg...))
+		return true
+	}
+	return s.appendFile(msg) == nil
+}
+
+// appendFile writes msg to the file, prefixed with its length.
+func (s *spool) appendFile(msg []byte) error {
+	if s.path == "" {
+		return errSpoolFull
+	}
+	n := int64(4 + len(msg))
+	if s.maxBytes > 0 && s.size-s.offset+n > s.maxBytes {
+		return errSpoolFull
+	}
+	if s.file == nil {
+		f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+		if err != nil {
+			return err
+		}
+		s.file = f
+	}
+	buf := make([]byte, n)
+	binary.BigEndian.PutUint32(buf, uint32(len(msg)))
+	copy(buf[4:], msg)
+	if _, err := s.file.Write(buf); err != nil {
+		return err
+	}
+	s.size += n
+	return nil
+}
+
+// replay sends the spooled messages in order, stopping at the first error;
+// the messages not sent stay in the spool.
+func (s *spool) replay(send func([]byte) error) error {
+	for len(s.mem) > 0 {
+		if err := send(s.mem[0]); err != nil {
+			return err
+		}
+		s.mem[0] = nil
+		s.mem = s.mem[1:]
+	}
+	if s.offset >= s.size {
+		return nil
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(s.offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	var head [4]byte
+	for s.offset < s.size {
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return s.discardFile()
+		}
+		n := int64(binary.BigEndian.Uint32(head[:]))
+		if n > maxSpoolMessage || 4+n > s.size-s.offset {
+			// Not a header: nothing more can be read.
+			return s.discardFile()
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			// Cut short by a crash while writing: nothing more to send.
+			return s.discardFile()
+		}
+		if err := send(msg); err != nil {
+			return err
+		}
+		s.offset += int64(4 + len(msg))
+	}
+	return s.discardFile()
+}
+
+// discardFile empties the file once everything in it has been sent.
+func (s *spool) discardFile() error {
+	if s.file != nil {
+		_ = s.file.Close()
+		s.file = nil
+	}
+	s.size, s.offset = 0, 0
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// close keeps what is left for a later process if the spool has a file: the
+// messages in memory are written to it ahead of those in it not sent yet, and
+// the ones already sent are cut off.  It returns the number of messages lost,
+// those left in memory otherwise.
+func (s *spool) close() int {
+	if s.file != nil {
+		_ = s.file.Close()
+		s.file = nil
+	}
+	if s.path == "" || (len(s.mem) == 0 && s.offset == 0) {
+		return len(s.mem)
+	}
+
+	tmp := s.path + ".tmp"
+	old := &spool{path: s.path, size: s.size, offset: s.offset}
+	next := &spool{path: tmp}
+	for _, msg := range s.mem {
+		if next.appendFile(msg) != nil {
+			break
+		}
+		s.mem = s.mem[1:]
+	}
+	if s.offset < s.size {
+		_ = old.replay(next.appendFile)
+	}
+	if next.file != nil {
+		_ = next.file.Close()
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		_ = os.Remove(tmp)
+	}
+	return len(s.mem)
+}
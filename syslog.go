@@ -0,0 +1,222 @@
+package logs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SyslogFormat is the version of the syslog protocol a SyslogWriter speaks.
+type SyslogFormat int
+
+const (
+	RFC5424 SyslogFormat = iota // "<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID - MSG"
+	RFC3164                     // "<PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG", the BSD format
+)
+
+// ParseSyslogFormat maps "5424" (or "") and "3164" to a SyslogFormat; an
+// "rfc" prefix is allowed.
+func ParseSyslogFormat(s string) (SyslogFormat, error) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "rfc") {
+	case "", "5424":
+		return RFC5424, nil
+	case "3164":
+		return RFC3164, nil
+	}
+	return RFC5424, fmt.Errorf("unknown syslog format %q", s)
+}
+
+// Facility is the syslog facility of the messages of a SyslogWriter.
+type Facility int
+
+const (
+	FacilityKern Facility = iota
+	FacilityUser
+	FacilityMail
+	FacilityDaemon
+	FacilityAuth
+	FacilitySyslog
+	FacilityLPR
+	FacilityNews
+	FacilityUUCP
+	FacilityCron
+	FacilityAuthPriv
+	FacilityFTP
+)
+
+const (
+	FacilityLocal0 Facility = iota + 16
+	FacilityLocal1
+	FacilityLocal2
+	FacilityLocal3
+	FacilityLocal4
+	FacilityLocal5
+	FacilityLocal6
+	FacilityLocal7
+)
+
+var facilityNames = map[string]Facility{
+	"kern":     FacilityKern,
+	"user":     FacilityUser,
+	"mail":     FacilityMail,
+	"daemon":   FacilityDaemon,
+	"auth":     FacilityAuth,
+	"syslog":   FacilitySyslog,
+	"lpr":      FacilityLPR,
+	"news":     FacilityNews,
+	"uucp":     FacilityUUCP,
+	"cron":     FacilityCron,
+	"authpriv": FacilityAuthPriv,
+	"ftp":      FacilityFTP,
+	"local0":   FacilityLocal0,
+	"local1":   FacilityLocal1,
+	"local2":   FacilityLocal2,
+	"local3":   FacilityLocal3,
+	"local4":   FacilityLocal4,
+	"local5":   FacilityLocal5,
+	"local6":   FacilityLocal6,
+	"local7":   FacilityLocal7,
+}
+
+// ParseFacility maps the name of a facility, such as "daemon" or "local0", to
+// a Facility.  An empty name is FacilityUser.
+func ParseFacility(name string) (Facility, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return FacilityUser, nil
+	}
+	if f, ok := facilityNames[name]; ok {
+		return f, nil
+	}
+	return FacilityUser, fmt.Errorf("unknown syslog facility %q", name)
+}
+
+// syslogSeverities maps the levels to the syslog severities: debug (7),
+// informational (6), warning (4), error (3) and critical (2).
+var syslogSeverities = [...]int{TRACE: 7, DEBUG: 7, INFO: 6, WARN: 4, ERROR: 3, FATAL: 2}
+
+func syslogSeverity(lvl Level) int {
+	if lvl < 0 || int(lvl) >= len(syslogSeverities) {
+		return 6
+	}
+	return syslogSeverities[lvl]
+}
+
+// SyslogWriter sends records to a syslog daemon such as rsyslog or syslog-ng.
+// It is a ConnWriter, and so reconnects, spools and speaks TLS alike, whose
+// messages follow RFC 5424 or RFC 3164.  Over stream sockets (tcp, unix) each
+// message is framed by octet counting (RFC 6587); over datagram sockets (udp,
+// unixgram) each message is one datagram.
+//
+// The layout formats the message part only, "%M%X" by default.
+type SyslogWriter struct {
+	*ConnWriter
+	format   SyslogFormat
+	facility Facility
+	appName  string // Project if empty
+	hostname string
+	pid      int
+}
+
+// NewSyslogWriter returns a SyslogWriter sending to addr over network ("udp",
+// "tcp", "unix", "unixgram"...), in RFC 5424 with the user facility.
+func NewSyslogWriter(network, addr string, level Level) *SyslogWriter {
+	w := &SyslogWriter{
+		ConnWriter: newConn(network, addr, "%M%X", level),
+		facility:   FacilityUser,
+		pid:        os.Getpid(),
+	}
+	w.hostname, _ = os.Hostname()
+	w.encode = w.message
+	w.start(fmt.Sprintf("SyslogWriter(%s %s)", network, addr), w.write, nil, w.disconnect)
+	go w.retryLoop()
+	return w
+}
+
+// SetSyslogFormat sets the version of the protocol.
+func (w *SyslogWriter) SetSyslogFormat(format SyslogFormat) {
+	w.Lock()
+	defer w.Unlock()
+	w.format = format
+}
+
+// SetFacility sets the facility of the messages.
+func (w *SyslogWriter) SetFacility(facility Facility) {
+	w.Lock()
+	defer w.Unlock()
+	w.facility = facility
+}
+
+// SetAppName sets the APP-NAME (RFC 5424) or TAG (RFC 3164) of the messages;
+// the empty name stands for the value of Project when the record is sent.
+func (w *SyslogWriter) SetAppName(name string) {
+	w.Lock()
+	defer w.Unlock()
+	w.appName = name
+}
+
+// SetHostname sets the HOSTNAME of the messages; the empty name stands for
+// os.Hostname().
+func (w *SyslogWriter) SetHostname(name string) {
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.hostname = name
+}
+
+// message builds the syslog message of rec, framed for the network.  It is
+// called holding the lock of the ConnWriter.
+func (w *SyslogWriter) message(rec *LogRecord) []byte {
+	pri := int(w.facility)*8 + syslogSeverity(rec.Level)
+	appName := w.appName
+	if appName == "" {
+		appName = Project
+	}
+	msg := strings.TrimRight(w.layout.Format(rec), "\r\n")
+
+	var buf bytes.Buffer
+	switch w.format {
+	case RFC3164:
+		fmt.Fprintf(&buf, "<%d>%s %s %s[%d]: %s", pri, rec.Created.Format(time.Stamp),
+			syslogField(w.hostname, 255), syslogField(appName, 32), w.pid, msg)
+	default:
+		fmt.Fprintf(&buf, "<%d>1 %s %s %s %d %s - %s", pri, rec.Created.Format("2006-01-02T15:04:05.000000Z07:00"),
+			syslogField(w.hostname, 255), syslogField(appName, 48), w.pid, syslogField(rec.Category, 32), msg)
+	}
+
+	if !w.streaming() {
+		return buf.Bytes()
+	}
+	framed := strconv.AppendInt(nil, int64(buf.Len()), 10)
+	framed = append(framed, ' ')
+	return append(framed, buf.Bytes()...)
+}
+
+// streaming reports whether the network is a stream, whose messages need
+// framing.
+func (w *SyslogWriter) streaming() bool {
+	return strings.HasPrefix(w.Net, "tcp") || w.Net == "unix"
+}
+
+// syslogField returns s as a header field: printable ASCII without spaces, at
+// most max bytes, and "-" (the nil value) if empty.
+func syslogField(s string, max int) string {
+	if s == "" {
+		return "-"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if c < 33 || c > 126 {
+			b[i] = '_'
+		}
+	}
+	if len(b) > max {
+		b = b[:max]
+	}
+	return string(b)
+}
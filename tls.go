@@ -0,0 +1,86 @@
+package logs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// TLSConfig secures the connection of a ConnWriter.  The files are read again
+// on every connection, so certificates rotated on disk are picked up at the
+// next reconnect.
+type TLSConfig struct {
+	CA         string `json:"ca"`         // PEM bundle of the CAs to trust; the system pool if empty
+	Cert       string `json:"cert"`       // PEM client certificate, for mutual TLS
+	Key        string `json:"key"`        // PEM key of Cert
+	ServerName string `json:"serverName"` // name to verify; the host of the address if empty
+	MinVersion string `json:"minVersion"` // "1.0" to "1.3"; 1.2 if empty
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// build loads the files of t and returns the tls.Config to dial addr with.
+func (t *TLSConfig) build(addr string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: t.ServerName, MinVersion: tls.VersionTLS12}
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[strings.TrimPrefix(t.MinVersion, "TLS")]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", t.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config.ServerName = host
+	}
+
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", t.CA)
+		}
+	}
+	if t.Cert != "" || t.Key != "" {
+		if t.Cert == "" || t.Key == "" {
+			return nil, errors.New("a client certificate needs both cert and key")
+		}
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// SetTLS makes the writer connect with TLS, or without if config is nil.  The
+// files of config are checked now and read again on every connection.
+func (c *ConnWriter) SetTLS(config *TLSConfig) error {
+	if config != nil {
+		if _, err := config.build(c.Addr); err != nil {
+			return err
+		}
+		copied := *config
+		config = &copied
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.tls = config
+	return nil
+}
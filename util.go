@@ -2,6 +2,9 @@ package logs
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 	"unsafe"
 )
 
@@ -10,25 +13,45 @@ func recoverPanic() {
 		fmt.Printf("Panicing %s\n", e)
 	}
 }
-//
-//func strToNumSuffix(str string, mult int) int {
-//	num := 1
-//	if len(str) > 1 {
-//		switch str[len(str)-1] {
-//		case 'G', 'g':
-//			num *= mult
-//			fallthrough
-//		case 'M', 'm':
-//			num *= mult
-//			fallthrough
-//		case 'K', 'k':
-//			num *= mult
-//			str = str[0 : len(str)-1]
-//		}
-//	}
-//	parsed, _ := strconv.Atoi(str)
-//	return parsed * num
-//}
+
+// strToNumSuffix parses a number with an optional K, M or G suffix, each step
+// multiplying by mult (1024 for sizes, 1000 for line counts).
+func strToNumSuffix(str string, mult int) (int, error) {
+	str = strings.TrimSpace(str)
+	num := 1
+	if len(str) > 1 {
+		switch str[len(str)-1] {
+		case 'G', 'g':
+			num *= mult
+			fallthrough
+		case 'M', 'm':
+			num *= mult
+			fallthrough
+		case 'K', 'k':
+			num *= mult
+			str = str[0 : len(str)-1]
+		}
+	}
+	parsed, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, err
+	}
+	return parsed * num, nil
+}
+
+// strToDuration parses a time.Duration, also accepting a number of days such
+// as "7d".
+func strToDuration(str string) (time.Duration, error) {
+	str = strings.TrimSpace(str)
+	if strings.HasSuffix(str, "d") {
+		days, err := strconv.Atoi(str[:len(str)-1])
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(str)
+}
 
 // BytesToString converts byte slice to string.
 func BytesToString(b []byte) string {
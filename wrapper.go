@@ -3,51 +3,92 @@
 package logs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 )
 
 var (
 	Global Logger
+
+	// globalMu guards replacing Global and the filters in it.  Logging takes
+	// the read lock only to find the writers of a record, then writes to them
+	// without it.  A record racing with a configuration swap may still reach
+	// a retired writer, which writes it if it comes before the Close.
+	globalMu sync.RWMutex
 )
 
 var Project = "App-Api"
 
-const FORMAT = "[%A][%L][%P] %F:%M"
+const FORMAT = "[%A][%L][%P] %F:%M%X"
 
 func init() {
 	Global = NewDefaultLogger(TRACE)
 }
 
 func SetDefaultLog(filter *Filter) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
 	Global["default"] = filter
 }
 
+// currentGlobal returns Global as of now; Global may be replaced by a
+// configuration reload at any time.
+func currentGlobal() Logger {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	return Global
+}
+
 //Formats: map[string]string{
 //// TODO(kevlar): How can I do this so it'll work outside of PST?
 //FORMAT_DEFAULT: "[2009/02/13 23:31:30 UTC] [EROR] (source) message\n",
 //FORMAT_SHORT:   "[23:31 13/02/09] [EROR] message\n",
 //FORMAT_ABBREV:  "[EROR] message\n",
 //},
-func SetConsole(config ConsoleConfig) {
-	clw := NewConsoleLogWriter()
-	clw.SetFormat(FORMAT)
-
-	Global["stdout"] = &Filter{getLogLevel(config.Level), clw, "DEFAULT"}
+func SetConsole(config ConsoleConfig) error {
+	filt, err := NewConsoleFilter(config)
+	if err != nil {
+		return err
+	}
+	globalMu.Lock()
+	Global["stdout"] = filt
+	globalMu.Unlock()
+	return nil
 }
 
-func SetConn(config SocketConfig) {
-	clw := NewConn(config.Protocol, config.Addr, FORMAT, getLogLevel(config.Level))
-	Global["socket"] = &Filter{getLogLevel(config.Level), clw, "SOCKET"}
+func SetConn(config SocketConfig) error {
+	filt, err := NewSocketFilter(config)
+	if err != nil {
+		return err
+	}
+	if filt.Category == "DEFAULT" {
+		filt.Category = "SOCKET"
+	}
+	globalMu.Lock()
+	Global["socket"] = filt
+	globalMu.Unlock()
+	return nil
 }
 
-func SetFile(config FileConfig) {
-	clw := NewFileLogWriter(config.Filename, config.Rotate, config.Daily)
-	clw.SetFormat(FORMAT)
+func SetFile(config FileConfig) error {
+	filt, err := NewFileFilter(config)
+	if err != nil {
+		return err
+	}
+	globalMu.Lock()
+	Global["file"] = filt
+	globalMu.Unlock()
+	return nil
+}
 
-	Global["file"] = &Filter{getLogLevel(config.Level), clw, "DEFAULT"}
+// With returns a child of Global with kv bound as fields on every record.
+// Wrapper for (*Logger).With
+func With(kv ...interface{}) Logger {
+	return currentGlobal().With(kv...)
 }
 
 // Wrapper for (*Logger).AddFilter
@@ -57,65 +98,92 @@ func SetFile(config FileConfig) {
 
 // Wrapper for (*Logger).Close (closes and removes all logwriters)
 func Close() {
-	Global.Close()
+	takeGlobal().Close()
+}
+
+// Flush waits until every record logged so far has been written, or ctx is
+// done.
+// Wrapper for (*Logger).Flush
+func Flush(ctx context.Context) error {
+	return currentGlobal().Flush(ctx)
+}
+
+// CloseContext closes and removes all logwriters, waiting until ctx is done at
+// the latest for their queued records to be written.
+// Wrapper for (*Logger).CloseContext
+func CloseContext(ctx context.Context) error {
+	return takeGlobal().CloseContext(ctx)
+}
+
+// takeGlobal removes every filter from Global and returns them, to be closed
+// without holding globalMu.
+func takeGlobal() Logger {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	log := make(Logger, len(Global))
+	for name, filt := range Global {
+		log[name] = filt
+		delete(Global, name)
+	}
+	return log
 }
 
 // Compatibility with `log`
 func Exit(args ...interface{}) {
 	if len(args) > 0 {
-		Global.intLogf(ERROR, strings.Repeat(" %v", len(args))[1:], args...)
+		currentGlobal().intLogf(ERROR, strings.Repeat(" %v", len(args))[1:], args...)
 	}
-	Global.Close() // so that hopefully the messages get logged
+	Close() // so that hopefully the messages get logged
 	os.Exit(0)
 }
 
 // Compatibility with `log`
 func Exitf(format string, args ...interface{}) {
-	Global.intLogf(ERROR, format, args...)
-	Global.Close() // so that hopefully the messages get logged
+	currentGlobal().intLogf(ERROR, format, args...)
+	Close() // so that hopefully the messages get logged
 	os.Exit(0)
 }
 
 // Compatibility with `log`
 func Stderr(args ...interface{}) {
 	if len(args) > 0 {
-		Global.intLogf(ERROR, strings.Repeat(" %v", len(args))[1:], args...)
+		currentGlobal().intLogf(ERROR, strings.Repeat(" %v", len(args))[1:], args...)
 	}
 }
 
 // Compatibility with `log`
 func Stderrf(format string, args ...interface{}) {
-	Global.intLogf(ERROR, format, args...)
+	currentGlobal().intLogf(ERROR, format, args...)
 }
 
 // Compatibility with `log`
 func Stdout(args ...interface{}) {
 	if len(args) > 0 {
-		Global.intLogf(INFO, strings.Repeat(" %v", len(args))[1:], args...)
+		currentGlobal().intLogf(INFO, strings.Repeat(" %v", len(args))[1:], args...)
 	}
 }
 
 // Compatibility with `log`
 func Stdoutf(format string, args ...interface{}) {
-	Global.intLogf(INFO, format, args...)
+	currentGlobal().intLogf(INFO, format, args...)
 }
 
 // Send a log message manually
 // Wrapper for (*Logger).Log
 func Log(lvl Level, source, message string) {
-	Global.Log(lvl, source, message)
+	currentGlobal().Log(lvl, source, message)
 }
 
 // Send a formatted log message easily
 // Wrapper for (*Logger).Logf
 func Logf(lvl Level, format string, args ...interface{}) {
-	Global.intLogf(lvl, format, args...)
+	currentGlobal().intLogf(lvl, format, args...)
 }
 
 // Send a closure log message
 // Wrapper for (*Logger).Logc
 func Logc(lvl Level, closure func() string) {
-	Global.intLogc(lvl, closure)
+	currentGlobal().intLogc(lvl, closure)
 }
 
 // Utility for debug log messages
@@ -127,7 +195,7 @@ func Debug(arg0 interface{}, args ...interface{}) {
 	const (
 		lvl = DEBUG
 	)
-	doLog(lvl, arg0, args...)
+	doLog(currentGlobal(), lvl, arg0, args...)
 }
 
 // Utility for trace log messages (see Debug() for parameter explanation)
@@ -136,7 +204,7 @@ func Trace(arg0 interface{}, args ...interface{}) {
 	const (
 		lvl = TRACE
 	)
-	doLog(lvl, arg0, args...)
+	doLog(currentGlobal(), lvl, arg0, args...)
 }
 
 // Utility for info log messages (see Debug() for parameter explanation)
@@ -145,7 +213,7 @@ func Info(arg0 interface{}, args ...interface{}) {
 	const (
 		lvl = INFO
 	)
-	doLog(lvl, arg0, args...)
+	doLog(currentGlobal(), lvl, arg0, args...)
 }
 
 // Utility for warn log messages (returns an error for easy function returns) (see Debug() for parameter explanation)
@@ -155,7 +223,7 @@ func Warn(arg0 interface{}, args ...interface{}) error {
 	const (
 		lvl = WARN
 	)
-	return doErrLog(lvl, arg0, args...)
+	return doErrLog(currentGlobal(), lvl, arg0, args...)
 }
 
 //no err return Warn
@@ -163,7 +231,7 @@ func WarnLog(arg0 interface{}, args ...interface{}) {
 	const (
 		lvl = WARN
 	)
-	_ = doErrLog(lvl, arg0, args...)
+	_ = doErrLog(currentGlobal(), lvl, arg0, args...)
 }
 
 // Utility for error log messages (returns an error for easy function returns) (see Debug() for parameter explanation)
@@ -173,7 +241,7 @@ func Error(arg0 interface{}, args ...interface{}) error {
 	const (
 		lvl = ERROR
 	)
-	return doErrLog(lvl, arg0, args...)
+	return doErrLog(currentGlobal(), lvl, arg0, args...)
 }
 
 //no err return Error
@@ -181,7 +249,7 @@ func ErrorLog(arg0 interface{}, args ...interface{}) {
 	const (
 		lvl = ERROR
 	)
-	_ = doErrLog(lvl, arg0, args...)
+	_ = doErrLog(currentGlobal(), lvl, arg0, args...)
 }
 
 // Utility for critical log messages (returns an error for easy function returns) (see Debug() for parameter explanation)
@@ -191,7 +259,7 @@ func Fatal(arg0 interface{}, args ...interface{}) error {
 	const (
 		lvl = FATAL
 	)
-	return doErrLog(lvl, arg0, args...)
+	return doErrLog(currentGlobal(), lvl, arg0, args...)
 }
 
 //no err return Fatal
@@ -199,37 +267,37 @@ func FatalLog(arg0 interface{}, args ...interface{}) {
 	const (
 		lvl = FATAL
 	)
-	_ = doErrLog(lvl, arg0, args...)
+	_ = doErrLog(currentGlobal(), lvl, arg0, args...)
 }
 
-func doErrLog(lvl Level, arg0 interface{}, args ...interface{}) error {
+func doErrLog(log Logger, lvl Level, arg0 interface{}, args ...interface{}) error {
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		Global.intLogf(lvl, first, args...)
+		log.intLogf(lvl, first, args...)
 		return errors.New(fmt.Sprintf(first, args...))
 	case func() string:
 		// Log the closure (no other arguments used)
 		str := first()
-		Global.intLogf(lvl, "%s", str)
+		log.intLogf(lvl, "%s", str)
 		return errors.New(str)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		Global.intLogf(lvl, fmt.Sprint(first)+strings.Repeat(" %v", len(args)), args...)
+		log.intLogf(lvl, fmt.Sprint(first)+strings.Repeat(" %v", len(args)), args...)
 		return errors.New(fmt.Sprint(first) + fmt.Sprintf(strings.Repeat(" %v", len(args)), args...))
 	}
 }
 
-func doLog(lvl Level, arg0 interface{}, args ...interface{}) {
+func doLog(log Logger, lvl Level, arg0 interface{}, args ...interface{}) {
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		Global.intLogf(lvl, first, args...)
+		log.intLogf(lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		Global.intLogc(lvl, first)
+		log.intLogc(lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		Global.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+		log.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
 }